@@ -53,6 +53,9 @@ func (c *Command) Usage() {
 var exitStatus = 0
 var exitMu sync.Mutex
 
+// lastError is the message of the latest errorf, guarded by exitMu.
+var lastError string
+
 func setExitStatus(n int) {
 	exitMu.Lock()
 	if exitStatus < n {
@@ -77,5 +80,8 @@ func exit() {
 func errorf(format string, args ...interface{}) {
 	fmt.Printf(format, args...)
 	fmt.Println()
+	exitMu.Lock()
+	lastError = strings.TrimSpace(fmt.Sprintf(format, args...))
+	exitMu.Unlock()
 	setExitStatus(1)
 }
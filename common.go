@@ -1,37 +1,238 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/duego/mongotool/storage"
+	"io/ioutil"
 	"labix.org/v2/mgo"
+	"net"
 	"net/url"
 	"os"
+	"path"
 	"strings"
+	"time"
 )
 
+// Resolvers used for mongodb+srv addresses, replaced in tests.
+var (
+	lookupSRV = net.LookupSRV
+	lookupTXT = net.LookupTXT
+)
+
+// mongoConn holds the connection settings parsed from an address.
+type mongoConn struct {
+	// URL is in the form understood by mgo.
+	URL string
+	// TLS is set when the servers must be dialed over TLS.
+	TLS bool
+	// Mode is the read preference translated into a session mode.
+	Mode mgo.Mode
+}
+
+// parseMongoAddr accepts a plain host/db address or a full mongodb:// or mongodb+srv:// URI.
+// Seed lists of mongodb+srv are resolved through DNS and the options mgo does not know about
+// (tls, readPreference, retryReads) are translated or dropped.
+func parseMongoAddr(addr string) (c mongoConn, err error) {
+	srv := strings.HasPrefix(addr, "mongodb+srv://")
+	rest := strings.TrimPrefix(strings.TrimPrefix(addr, "mongodb+srv://"), "mongodb://")
+
+	var rawQuery string
+	if i := strings.Index(rest, "?"); i >= 0 {
+		rest, rawQuery = rest[:i], rest[i+1:]
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return
+	}
+	var userinfo string
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		userinfo, rest = rest[:i+1], rest[i+1:]
+	}
+	hosts, db := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		hosts, db = rest[:i], rest[i:]
+	}
+
+	if srv {
+		if strings.ContainsAny(hosts, ",:") {
+			return c, errors.New("mongodb+srv address must name a single host without port")
+		}
+		if hosts, err = resolveSRV(hosts, query); err != nil {
+			return
+		}
+		c.TLS = true
+	}
+
+	for _, opt := range []string{"ssl", "tls"} {
+		if v := query.Get(opt); v != "" {
+			c.TLS = v == "true"
+			query.Del(opt)
+		}
+	}
+	// Reads are not retried by mgo, the option is accepted for compatibility with other tools.
+	query.Del("retryReads")
+
+	c.Mode = mgo.Strong
+	switch pref := query.Get("readPreference"); pref {
+	case "", "primary", "primaryPreferred":
+	case "secondary", "secondaryPreferred":
+		c.Mode = mgo.Monotonic
+	case "nearest":
+		c.Mode = mgo.Eventual
+	default:
+		return c, errors.New("Unknown readPreference: " + pref)
+	}
+	query.Del("readPreference")
+
+	// Talk to the given server only, unless asked to discover a replica set.
+	if query.Get("connect") == "" && query.Get("replicaSet") == "" && !strings.Contains(hosts, ",") {
+		query.Set("connect", "direct")
+	}
+
+	c.URL = "mongodb://" + userinfo + hosts + db
+	if len(query) > 0 {
+		c.URL += "?" + query.Encode()
+	}
+	return
+}
+
+// resolveSRV looks up the seed list of a mongodb+srv host, adding options from its TXT record
+// unless they have already been given in the URI.
+func resolveSRV(host string, query url.Values) (string, error) {
+	_, addrs, err := lookupSRV("mongodb", "tcp", host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", errors.New("No SRV records found for " + host)
+	}
+	hosts := make([]string, len(addrs))
+	for n, a := range addrs {
+		hosts[n] = fmt.Sprintf("%s:%d", strings.TrimSuffix(a.Target, "."), a.Port)
+	}
+
+	txts, err := lookupTXT(host)
+	if err != nil {
+		// A missing TXT record just means there are no default options.
+		txts = nil
+	}
+	for _, txt := range txts {
+		opts, err := url.ParseQuery(txt)
+		if err != nil {
+			return "", err
+		}
+		for k := range opts {
+			if query.Get(k) == "" {
+				query.Set(k, opts.Get(k))
+			}
+		}
+	}
+	return strings.Join(hosts, ","), nil
+}
+
 // mongoSession gives a session or dies trying.
 func mongoSession(addr string) *mgo.Session {
 	fmt.Fprintln(os.Stderr, "Connecting to", addr)
-	s, err := mgo.Dial(addr + "?connect=direct")
+	c, err := parseMongoAddr(addr)
+	if err != nil {
+		errorf("Invalid address %s: %v", addr, err)
+		exit()
+	}
+	info, err := mgo.ParseURL(c.URL)
+	if err != nil {
+		errorf("Invalid address %s: %v", addr, err)
+		exit()
+	}
+	if c.TLS {
+		info.Dial = func(addr net.Addr) (net.Conn, error) {
+			return tls.Dial("tcp", addr.String(), &tls.Config{})
+		}
+	}
+	s, err := mgo.DialWithInfo(info)
 	if err != nil {
 		errorf("Error connecting to %s: %v", addr, err)
 		exit()
 	}
+	s.SetMode(c.Mode, true)
 	return s
 }
 
+// completeMarker is saved below the dump root once every chunk of a dump has been stored.
+const completeMarker = storage.CompleteMarker
+
+// isDumpMetadata tells if fpath is one of the files stored next to the chunks of a dump.
+func isDumpMetadata(fpath string) bool {
+	name := path.Base(fpath)
+	return name == completeMarker || name == storage.ChecksumFile || name == storage.ManifestFile
+}
+
+// writeCompleteMarker marks the dump at root as complete, it must be the last object written.
+func writeCompleteMarker(store storage.Saver, root string, objects int64) error {
+	w, err := store.Save(path.Join(root, completeMarker))
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s %d objects\n", time.Now().UTC().Format(time.RFC3339), objects); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// dumpComplete tells if the dump at root finished, store must not be compressed.
+func dumpComplete(store storage.Fetcher, root string) bool {
+	r, err := store.Fetch(path.Join(root, completeMarker))
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+var (
+	// s3Adaptive is the -s3-adaptive flag of dump and restore, zero leaves S3 requests unbounded.
+	s3Adaptive int
+	// s3Limit is shared by every S3 storage selected, so the bound holds across all of them.
+	s3Limit *storage.AdaptiveLimit
+)
+
 // selectStorage will figure out what kind of storage we're looking for in specified target.
 func selectStorage(target string, compression bool) (root string, store storage.SaveFetcher) {
 	if target == "-" {
 		errorf("%s", "TODO: Set stdin storage here")
 		exit()
 	}
-	if strings.HasPrefix(target, "http") {
+	if strings.HasPrefix(target, "gs://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			errorf("%v", err)
+			exit()
+		}
+		key, err := ioutil.ReadFile(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+		if err != nil {
+			errorf("Could not read the service account key named by GOOGLE_APPLICATION_CREDENTIALS: %v", err)
+			exit()
+		}
+		if store, err = storage.NewGCS(u.Host, key); err != nil {
+			errorf("%v", err)
+			exit()
+		}
+		root = u.Path
+	} else if strings.HasPrefix(target, "http") {
 		if u, err := url.Parse(target); err != nil {
 			errorf("%v", err)
 			exit()
 		} else {
-			store = storage.NewS3(fmt.Sprintf("%s://%s", u.Scheme, u.Host))
+			s3 := storage.NewS3(fmt.Sprintf("%s://%s", u.Scheme, u.Host))
+			if s3Adaptive > 0 {
+				if s3Limit == nil {
+					s3Limit = storage.NewAdaptiveLimit(s3Adaptive)
+				}
+				s3.Limit = s3Limit
+			}
+			store = s3
 			root = u.Path
 		}
 	} else {
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/duego/mongotool/mongo"
+	"github.com/duego/mongotool/storage"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// dumpOnce stores one object at root the way runDump does, ending with the COMPLETE marker.
+func dumpOnce(store storage.SaveFetcher, root string, overwrite bool) error {
+	backend, err := prepareTarget(store, root, overwrite)
+	if err != nil {
+		return err
+	}
+	objects := make(chan storage.Filer, 1)
+	objects <- mongo.NewFile("test", "users", "5349b4ddd2781d08c09890f3", []byte("object"))
+	close(objects)
+	errc := make(chan error, 2)
+	worker(objects, errc, backend, root, ".tar", 1)
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			return err
+		}
+	}
+	return writeCompleteMarker(backend, root, 1)
+}
+
+func TestDumpTwice(t *testing.T) {
+	Convey("Given a dump stored at a root", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := storage.Filesystem{Root: dir}
+		So(dumpOnce(store, "dump", false), ShouldBeNil)
+		files := func() int {
+			infos, _ := ioutil.ReadDir(filepath.Join(dir, "dump"))
+			return len(infos)
+		}
+		So(files(), ShouldEqual, 2)
+
+		Convey("Dumping again to the same root should be refused before anything is written", func() {
+			err := dumpOnce(store, "dump", false)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "A complete dump is already stored")
+			So(files(), ShouldEqual, 2)
+		})
+		Convey("A root left with the chunks of an interrupted dump should be refused too", func() {
+			So(os.Remove(filepath.Join(dir, "dump", completeMarker)), ShouldBeNil)
+			err := dumpOnce(store, "dump", false)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "are already stored")
+			So(files(), ShouldEqual, 1)
+		})
+		Convey("With -overwrite the dump should go ahead", func() {
+			So(dumpOnce(store, "dump", true), ShouldBeNil)
+			So(files(), ShouldEqual, 3)
+		})
+		Convey("A dump to another root should not be refused", func() {
+			So(dumpOnce(store, "other", false), ShouldBeNil)
+		})
+	})
+}
+
+func TestIndexTarget(t *testing.T) {
+	Convey("The index should be kept in the directory above the dump", t, func() {
+		store, prefix, dump := indexTarget(storage.Filesystem{Root: "/backups/host/db/1/"}, "")
+		So(store, ShouldResemble, storage.Filesystem{Root: "/backups/host/db"})
+		So(prefix, ShouldEqual, "")
+		So(dump, ShouldEqual, "1")
+
+		s3 := storage.NewS3("https://mongotool.s3.amazonaws.com")
+		store, prefix, dump = indexTarget(s3, "/host/db/1")
+		So(store, ShouldEqual, s3)
+		So(prefix, ShouldEqual, "/host/db")
+		So(dump, ShouldEqual, "/host/db/1")
+	})
+}
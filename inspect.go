@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"github.com/duego/mongotool/mongo"
+	"github.com/duego/mongotool/storage"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var cmdInspect = &Command{
+	UsageLine: "inspect [-compression] path",
+	Short:     "show what a stored dump contains without restoring it",
+	Long: `
+Inspect reads the chunks stored below path on an S3 bucket or filesystem
+and prints a summary of the dump: when it was taken, which collections it
+holds with their object counts and sizes, and whether indexes were stored.
+Nothing is written to MongoDB or to the storage.
+
+The path is given in the same form as the -source flag of restore.
+
+When the dump has a MANIFEST.json, the time it completed, the server version,
+the compression, the labels and the size and MD5 of every chunk are printed
+from it, with the SHA-256 of each chunk when a SHA256SUMS listing was stored
+as well.
+
+Set -compression to false if the dump did not have compression enabled.
+
+A dump is flagged as incomplete when it has no COMPLETE marker, when a chunk
+ends in the middle of an object or when a collection is missing its indexes.
+`,
+}
+
+var (
+	// inspect flags
+	inspectCompressed bool
+)
+
+func init() {
+	cmdInspect.Run = runInspect
+	cmdInspect.Flag.BoolVar(&inspectCompressed, "compression", true, "")
+}
+
+// collectionSummary holds what was found for one collection in a dump.
+type collectionSummary struct {
+	Database   string
+	Collection string
+	Objects    int64
+	Size       int64
+	Indexes    bool
+}
+
+// dumpSummary describes the content of a dump as seen from its tar headers.
+type dumpSummary struct {
+	Root        string
+	Compressed  bool
+	Chunks      int
+	Started     time.Time
+	Finished    time.Time
+	Collections map[string]*collectionSummary
+	// Complete is set when the dump was marked as complete.
+	Complete bool
+	// Broken lists chunks that could not be read to the end.
+	Broken map[string]error
+	// Manifest and Sums are nil when the dump stored no MANIFEST.json or SHA256SUMS.
+	Manifest *storage.Manifest
+	Sums     map[string]string
+}
+
+// Incomplete reports if anything suggests the dump did not finish.
+func (d *dumpSummary) Incomplete() bool {
+	if !d.Complete || len(d.Broken) > 0 {
+		return true
+	}
+	for _, c := range d.Collections {
+		if !c.Indexes {
+			return true
+		}
+	}
+	return false
+}
+
+// add records one tar entry of the dump.
+func (d *dumpSummary) add(h *tar.Header) {
+	db, col, name, err := mongo.SplitPath(h.Name)
+	if err != nil || col == mongo.SettingsCollection {
+		return
+	}
+	key := db + "/" + col
+	c, ok := d.Collections[key]
+	if !ok {
+		c = &collectionSummary{Database: db, Collection: col}
+		d.Collections[key] = c
+	}
+	if name == "indexes.json" {
+		c.Indexes = true
+	} else {
+		c.Objects++
+		c.Size += h.Size
+	}
+	if d.Started.IsZero() || h.ModTime.Before(d.Started) {
+		d.Started = h.ModTime
+	}
+	if h.ModTime.After(d.Finished) {
+		d.Finished = h.ModTime
+	}
+}
+
+// inspectDump walks all chunks below root and summarizes them using only Fetch. The manifest
+// and checksums are read from raw, the storage below any compression.
+func inspectDump(raw, store storage.SaveFetcher, root string, compressed bool) (*dumpSummary, error) {
+	d := &dumpSummary{
+		Root:        root,
+		Compressed:  compressed,
+		Collections: make(map[string]*collectionSummary),
+		Broken:      make(map[string]error),
+	}
+	var err error
+	if d.Manifest, err = storage.ReadManifest(raw, root); err != nil && !storage.IsNotFound(err) {
+		d.Broken[path.Join(root, storage.ManifestFile)] = err
+	}
+	if d.Sums, err = storage.ReadSums(raw, root); err != nil && !storage.IsNotFound(err) {
+		d.Broken[path.Join(root, storage.ChecksumFile)] = err
+	}
+	err = store.(storage.Walker).Walk(root, func(fpath string, _ storage.ObjectInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path.Base(fpath) == completeMarker {
+			d.Complete = true
+		}
+		if isDumpMetadata(fpath) {
+			return nil
+		}
+		r, err := store.Fetch(fpath)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		d.Chunks++
+		tr := tar.NewReader(r)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				// Keep going, a broken chunk is what we want to report.
+				d.Broken[fpath] = err
+				return nil
+			}
+			d.add(h)
+		}
+	})
+	return d, err
+}
+
+// Print writes a human readable summary of the dump to w.
+func (d *dumpSummary) Print(w io.Writer) {
+	fmt.Fprintln(w, "Path:       ", d.Root)
+	fmt.Fprintln(w, "Chunks:     ", d.Chunks)
+	fmt.Fprintln(w, "Compressed: ", d.Compressed)
+	if !d.Started.IsZero() {
+		fmt.Fprintln(w, "Started:    ", d.Started.Format(time.RFC3339))
+		fmt.Fprintln(w, "Finished:   ", d.Finished.Format(time.RFC3339))
+	}
+	if m := d.Manifest; m != nil {
+		fmt.Fprintln(w, "Completed:  ", m.Completed.Format(time.RFC3339))
+		if m.ServerVersion != "" {
+			fmt.Fprintln(w, "Server:     ", m.ServerVersion)
+		}
+		if m.Compression != "" {
+			fmt.Fprintln(w, "Compression:", m.Compression)
+		}
+		if len(m.Labels) > 0 {
+			fmt.Fprintln(w, "Labels:     ", labels(m.Labels))
+		}
+	}
+	fmt.Fprintln(w)
+
+	keys := make([]string, 0, len(d.Collections))
+	for key := range d.Collections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tCOLLECTION\tOBJECTS\tSIZE\tINDEXES")
+	for _, key := range keys {
+		c := d.Collections[key]
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%t\n", c.Database, c.Collection, c.Objects, c.Size, c.Indexes)
+	}
+	tw.Flush()
+	d.printObjects(w)
+
+	if d.Incomplete() {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "WARNING: dump looks incomplete")
+		if !d.Complete {
+			fmt.Fprintf(w, "  no %s marker, the dump was interrupted or failed\n", completeMarker)
+		}
+		for fpath, err := range d.Broken {
+			fmt.Fprintf(w, "  %s: %v\n", fpath, err)
+		}
+		for _, key := range keys {
+			if !d.Collections[key].Indexes {
+				fmt.Fprintf(w, "  %s: no indexes stored\n", key)
+			}
+		}
+	}
+}
+
+// printObjects lists the stored chunks from the manifest, or from SHA256SUMS without one.
+func (d *dumpSummary) printObjects(w io.Writer) {
+	if d.Manifest == nil && d.Sums == nil {
+		return
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if d.Manifest != nil {
+		fmt.Fprintln(tw, "OBJECT\tSIZE\tMD5\tSHA256")
+		for _, e := range d.Manifest.Objects {
+			sum := d.Sums[strings.TrimLeft(path.Join(d.Root, e.Key), "/")]
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", e.Key, e.Size, e.MD5, sum)
+		}
+	} else {
+		keys := make([]string, 0, len(d.Sums))
+		for key := range d.Sums {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintln(tw, "OBJECT\tSHA256")
+		for _, key := range keys {
+			fmt.Fprintf(tw, "%s\t%s\n", key, d.Sums[key])
+		}
+	}
+	tw.Flush()
+}
+
+func runInspect(cmd *Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+	}
+	root, store := selectStorage(args[0], inspectCompressed)
+	_, raw := selectStorage(args[0], false)
+	d, err := inspectDump(raw, store, root, inspectCompressed)
+	if err != nil {
+		errorf("%v", err)
+		exit()
+	}
+	d.Print(os.Stdout)
+	if d.Incomplete() {
+		setExitStatus(1)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/duego/mongotool/storage"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// entry is one named object of a synthetic dump.
+type entry struct {
+	name, body string
+}
+
+// writeChunk stores a tar chunk with the given entries the same way dump does.
+func writeChunk(store storage.Saver, fpath string, entries ...entry) error {
+	w, err := store.Save(fpath)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		name, body := e.name, e.body
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(body)),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			return err
+		}
+	}
+	tw.Flush()
+	return w.Close()
+}
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given a synthetic dump on the filesystem", t, func() {
+		store := storage.Filesystem{Root: dir}
+		So(writeChunk(store, "dump/aaaa.tar",
+			entry{"test/users/indexes.json", "[]"},
+			entry{"test/users/5349b4ddd2781d08c09890f3", "foo"},
+			entry{"test/users/5349b4ddd2781d08c09890f4", "bar"},
+		), ShouldBeNil)
+		So(writeChunk(store, "dump/bbbb.tar",
+			entry{"test/posts/5349b4ddd2781d08c09890f5", "hello"},
+		), ShouldBeNil)
+
+		d, err := inspectDump(store, store, "dump", false)
+		So(err, ShouldBeNil)
+
+		Convey("The summary should count chunks, objects and sizes", func() {
+			So(d.Chunks, ShouldEqual, 2)
+			So(d.Collections["test/users"].Objects, ShouldEqual, 2)
+			So(d.Collections["test/users"].Size, ShouldEqual, 6)
+			So(d.Collections["test/posts"].Objects, ShouldEqual, 1)
+		})
+		Convey("The printed output should contain the key fields", func() {
+			var b bytes.Buffer
+			d.Print(&b)
+			out := b.String()
+			So(out, ShouldContainSubstring, "Chunks:      2")
+			So(out, ShouldContainSubstring, "Started:")
+			So(out, ShouldContainSubstring, "users")
+			So(out, ShouldContainSubstring, "posts")
+		})
+		Convey("A collection without indexes should flag the dump incomplete", func() {
+			So(d.Incomplete(), ShouldBeTrue)
+			var b bytes.Buffer
+			d.Print(&b)
+			So(b.String(), ShouldContainSubstring, "test/posts: no indexes stored")
+		})
+		Convey("A dump without a completion marker should flag the dump incomplete", func() {
+			So(d.Complete, ShouldBeFalse)
+			So(dumpComplete(store, "dump"), ShouldBeFalse)
+			var b bytes.Buffer
+			d.Print(&b)
+			So(b.String(), ShouldContainSubstring, "no COMPLETE marker")
+		})
+		Convey("Once marked complete the marker should be found but not read as a chunk", func() {
+			So(writeChunk(store, "dump/cccc.tar",
+				entry{"test/posts/indexes.json", "[]"},
+			), ShouldBeNil)
+			So(writeCompleteMarker(store, "dump", 3), ShouldBeNil)
+			So(dumpComplete(store, "dump"), ShouldBeTrue)
+			d, err := inspectDump(store, store, "dump", false)
+			So(err, ShouldBeNil)
+			So(d.Complete, ShouldBeTrue)
+			So(d.Chunks, ShouldEqual, 3)
+			So(d.Broken, ShouldBeEmpty)
+			So(d.Incomplete(), ShouldBeFalse)
+		})
+		Convey("The manifest and checksums should be printed when stored", func() {
+			sums := storage.NewChecksumSaveFetcher(store)
+			manifest := storage.NewManifestSaveFetcher(sums)
+			manifest.ServerVersion, manifest.Compression = "4.4.6", "gzip"
+			manifest.Labels = map[string]string{"release": "v3", "app": "web"}
+			So(writeChunk(manifest, "dump/cccc.tar",
+				entry{"test/posts/indexes.json", "[]"},
+			), ShouldBeNil)
+			So(manifest.WriteManifest("dump"), ShouldBeNil)
+			So(sums.WriteSums("dump"), ShouldBeNil)
+			d, err := inspectDump(store, store, "dump", false)
+			So(err, ShouldBeNil)
+			So(d.Manifest, ShouldNotBeNil)
+			So(d.Manifest.Objects, ShouldHaveLength, 1)
+			So(d.Sums, ShouldNotBeEmpty)
+			So(d.Chunks, ShouldEqual, 3)
+
+			var b bytes.Buffer
+			d.Print(&b)
+			out := b.String()
+			So(out, ShouldContainSubstring, "Server:      4.4.6")
+			So(out, ShouldContainSubstring, "Compression: gzip")
+			So(out, ShouldContainSubstring, "Labels:      app=web,release=v3")
+			So(out, ShouldContainSubstring, "cccc.tar")
+			So(out, ShouldContainSubstring, d.Manifest.Objects[0].MD5)
+			So(out, ShouldContainSubstring, d.Sums["dump/cccc.tar"])
+		})
+	})
+}
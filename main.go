@@ -86,6 +86,8 @@ func help(args []string) {
 var commands = []*Command{
 	cmdDump,
 	cmdRestore,
+	cmdInspect,
+	cmdSelftest,
 }
 
 func main() {
@@ -15,6 +15,7 @@ const (
 )
 
 // File implements the storage.Filer interface, used for passing objects suitable to save in storage.
+// Its path is db/collection/name, with the database and collection escaped by EscapeName.
 type File struct {
 	*bytes.Reader
 	name   string
@@ -24,7 +25,7 @@ type File struct {
 func NewFile(db, collection, name string, data []byte) *File {
 	return &File{
 		bytes.NewReader(data),
-		strings.Join([]string{db, collection, name}, "/"),
+		strings.Join([]string{EscapeName(db), EscapeName(collection), name}, "/"),
 		int64(len(data)),
 	}
 }
@@ -78,6 +79,30 @@ func (o *Object) GetBSON() (interface{}, error) {
 
 // Dump will stream all objects from a collection on the returned channel
 func Dump(s *mgo.Session, collection string) <-chan *File {
+	return DumpThrottled(s, collection, nil)
+}
+
+// DumpThrottled is like Dump but holds off reading more objects while throttle finds the server busy.
+// A nil throttle never waits.
+func DumpThrottled(s *mgo.Session, collection string, throttle *LoadThrottle) <-chan *File {
+	return DumpWith(s, collection, DumpOptions{Throttle: throttle})
+}
+
+// DumpOptions changes how DumpWith reads collections.
+type DumpOptions struct {
+	// Throttle holds off reading more objects while the server is busy, nil never waits.
+	Throttle *LoadThrottle
+	// SortById reads objects in _id order instead of natural order, so unchanged data
+	// is dumped in the same order every time. It walks the _id index, which is slower than a
+	// collection scan on most collections.
+	SortById bool
+	// Settings dumps the profiling settings of the database along with its collections.
+	Settings bool
+}
+
+// DumpWith is like Dump with the given options.
+func DumpWith(s *mgo.Session, collection string, opts DumpOptions) <-chan *File {
+	throttle := opts.Throttle
 	c := make(chan *File)
 	go func() {
 		defer close(c)
@@ -100,6 +125,16 @@ func Dump(s *mgo.Session, collection string) <-chan *File {
 			collections = append(collections, collection)
 		}
 
+		if opts.Settings {
+			if settings, err := ReadSettings(db); err != nil {
+				log.Println(err)
+			} else if js, err := json.Marshal(settings); err != nil {
+				log.Println(err)
+			} else {
+				c <- NewFile(db.Name, SettingsCollection, SettingsFile, js)
+			}
+		}
+
 		for _, collection := range collections {
 			// Skip internal system collections
 			if strings.HasPrefix(collection, "system.") {
@@ -121,8 +156,13 @@ func Dump(s *mgo.Session, collection string) <-chan *File {
 			}
 
 			// Dump all objects
-			iter := col.Find(nil).Iter()
+			query := col.Find(nil)
+			if opts.SortById {
+				query = query.Sort("_id")
+			}
+			iter := query.Iter()
 			for {
+				throttle.Wait()
 				result := NewObject(db.Name, collection)
 				if iter.Next(result) {
 					c <- NewFile(
@@ -0,0 +1,69 @@
+package mongo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Database and collection names become path elements of the entries in a dump. Any byte that
+// would be taken for a separator, could not be stored by every backend or is the escape itself
+// is written as %XX with the hex of the byte: '%', '/', '\', control characters and DEL. A
+// leading '.' is escaped as well, so no element is ever "." or "..". Names without any of
+// these, which is the usual case, are stored unchanged.
+
+// EscapeName gives the path element used for a database or collection name.
+func EscapeName(name string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '%' || c == '/' || c == '\\' || c < 0x20 || c == 0x7f || (i == 0 && c == '.') {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// UnescapeName reverses EscapeName.
+func UnescapeName(element string) (string, error) {
+	if !strings.Contains(element, "%") {
+		return element, nil
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(element); i++ {
+		if element[i] != '%' {
+			b.WriteByte(element[i])
+			continue
+		}
+		if i+2 >= len(element) {
+			return "", errors.New("Truncated escape in name: " + element)
+		}
+		c, err := strconv.ParseUint(element[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("Invalid escape in name: " + element)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// SplitPath splits the path of a dump entry into its unescaped database and collection names
+// and the name of the entry itself.
+func SplitPath(p string) (db, collection, name string, err error) {
+	parts := strings.Split(p, "/")
+	if len(parts) != 3 {
+		return "", "", "", errors.New("Expected db, col and name in path: " + p)
+	}
+	if db, err = UnescapeName(parts[0]); err != nil {
+		return
+	}
+	if collection, err = UnescapeName(parts[1]); err != nil {
+		return
+	}
+	return db, collection, parts[2], nil
+}
@@ -0,0 +1,36 @@
+package mongo
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestEscapeName(t *testing.T) {
+	Convey("Names with unusual characters should round trip through entry paths", t, func() {
+		for _, name := range []string{
+			"users", "my.collection", "a/b", "..", ".hidden", "100%", `back\slash`,
+			"tab\there", "new\nline", "%2F", "ünicode", "a$b c",
+		} {
+			escaped := EscapeName(name)
+			So(strings.ContainsAny(escaped, "/\\\t\n"), ShouldBeFalse)
+			So(escaped[0], ShouldNotEqual, '.')
+
+			db, col, id, err := SplitPath(NewFile("db/"+name, name, "5349b4ddd2781d08c09890f3", nil).Path())
+			So(err, ShouldBeNil)
+			So(db, ShouldEqual, "db/"+name)
+			So(col, ShouldEqual, name)
+			So(id, ShouldEqual, "5349b4ddd2781d08c09890f3")
+		}
+	})
+	Convey("Plain names should be stored unchanged", t, func() {
+		So(EscapeName("my.collection"), ShouldEqual, "my.collection")
+		So(NewFile("test", "users", "indexes.json", nil).Path(), ShouldEqual, "test/users/indexes.json")
+	})
+	Convey("Broken escapes should be refused", t, func() {
+		for _, element := range []string{"abc%", "abc%2", "abc%zz"} {
+			_, err := UnescapeName(element)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package mongo
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Database settings are dumped as SettingsFile below SettingsCollection, a name no real
+// collection can have since collection names may not start with '$'.
+const (
+	SettingsCollection = "$database"
+	SettingsFile       = "settings.json"
+)
+
+// Settings holds the database level settings that can safely be reapplied on another server.
+type Settings struct {
+	// ProfilingLevel is 0 for off, 1 for slow operations only and 2 for all operations.
+	ProfilingLevel int `json:"profilingLevel" bson:"was"`
+	// SlowMs is the threshold in milliseconds for an operation to be considered slow.
+	SlowMs int `json:"slowms" bson:"slowms"`
+}
+
+// ReadSettings fetches the settings of db.
+func ReadSettings(db *mgo.Database) (s Settings, err error) {
+	err = db.Run(bson.M{"profile": -1}, &s)
+	return
+}
+
+// ApplySettings changes the settings of db to s.
+func ApplySettings(db *mgo.Database, s Settings) error {
+	cmd := bson.D{
+		{Name: "profile", Value: s.ProfilingLevel},
+		{Name: "slowms", Value: s.SlowMs},
+	}
+	return db.Run(cmd, nil)
+}
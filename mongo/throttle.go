@@ -0,0 +1,125 @@
+package mongo
+
+import (
+	"labix.org/v2/mgo"
+	"log"
+	"sync"
+	"time"
+)
+
+// Load is a sample of how busy the server we read from is.
+type Load struct {
+	// ReadTickets is the number of available WiredTiger read tickets, -1 when unknown.
+	ReadTickets int
+	// ReplicationLag is how far the node is behind the primary.
+	ReplicationLag time.Duration
+}
+
+// LoadThrottle pauses a dump while the server it reads from is under load.
+type LoadThrottle struct {
+	// Sample returns the current load of the server.
+	Sample func() (Load, error)
+	// MinReadTickets pauses the dump when fewer read tickets are available, zero disables the check.
+	MinReadTickets int
+	// MaxReplicationLag pauses the dump when the node lags further behind, zero disables the check.
+	MaxReplicationLag time.Duration
+	// Interval is how often the load is sampled.
+	Interval time.Duration
+	// Pauses counts how many times the dump had to wait for the load to drop.
+	Pauses int
+
+	mu      sync.Mutex
+	sampled time.Time
+}
+
+func NewLoadThrottle(s *mgo.Session) *LoadThrottle {
+	return &LoadThrottle{
+		Sample:   ServerLoad(s),
+		Interval: time.Second,
+	}
+}
+
+// busy tells if load crosses any of the thresholds.
+func (t *LoadThrottle) busy(load Load) bool {
+	if t.MinReadTickets > 0 && load.ReadTickets >= 0 && load.ReadTickets < t.MinReadTickets {
+		return true
+	}
+	if t.MaxReplicationLag > 0 && load.ReplicationLag > t.MaxReplicationLag {
+		return true
+	}
+	return false
+}
+
+// Wait returns immediately unless it is time to sample the load again and the server is busy,
+// in which case it blocks until the load has dropped below the thresholds.
+func (t *LoadThrottle) Wait() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.sampled) < t.Interval {
+		return
+	}
+	for {
+		t.sampled = time.Now()
+		load, err := t.Sample()
+		if err != nil {
+			// Don't hold up the dump when the server won't tell us how it is doing.
+			log.Println("Could not sample server load:", err)
+			return
+		}
+		if !t.busy(load) {
+			return
+		}
+		t.Pauses++
+		time.Sleep(t.Interval)
+	}
+}
+
+// ServerLoad samples serverStatus and replSetGetStatus of the server s is connected to.
+func ServerLoad(s *mgo.Session) func() (Load, error) {
+	return func() (Load, error) {
+		load := Load{ReadTickets: -1}
+
+		status := struct {
+			WiredTiger struct {
+				ConcurrentTransactions struct {
+					Read struct {
+						Available int `bson:"available"`
+					} `bson:"read"`
+				} `bson:"concurrentTransactions"`
+			} `bson:"wiredTiger"`
+		}{}
+		status.WiredTiger.ConcurrentTransactions.Read.Available = -1
+		if err := s.Run("serverStatus", &status); err != nil {
+			return load, err
+		}
+		load.ReadTickets = status.WiredTiger.ConcurrentTransactions.Read.Available
+
+		replSet := struct {
+			Members []struct {
+				StateStr   string    `bson:"stateStr"`
+				OptimeDate time.Time `bson:"optimeDate"`
+				Self       bool      `bson:"self"`
+			} `bson:"members"`
+		}{}
+		// Standalone servers have no replication lag to speak of.
+		if err := s.Run("replSetGetStatus", &replSet); err != nil {
+			return load, nil
+		}
+		var primary, self time.Time
+		for _, m := range replSet.Members {
+			if m.StateStr == "PRIMARY" {
+				primary = m.OptimeDate
+			}
+			if m.Self {
+				self = m.OptimeDate
+			}
+		}
+		if !primary.IsZero() && !self.IsZero() && primary.After(self) {
+			load.ReplicationLag = primary.Sub(self)
+		}
+		return load, nil
+	}
+}
@@ -0,0 +1,50 @@
+package mongo
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestLoadThrottle(t *testing.T) {
+	Convey("Given a server whose read tickets run low for a while", t, func() {
+		samples := []Load{{ReadTickets: 128}, {ReadTickets: 2}, {ReadTickets: 3}, {ReadTickets: 100}}
+		sampled := 0
+		throttle := &LoadThrottle{
+			Sample: func() (Load, error) {
+				load := samples[sampled]
+				if sampled < len(samples)-1 {
+					sampled++
+				}
+				return load, nil
+			},
+			MinReadTickets: 10,
+			Interval:       time.Millisecond,
+		}
+
+		Convey("The first wait should pass right through", func() {
+			throttle.Wait()
+			So(throttle.Pauses, ShouldEqual, 0)
+			Convey("The next wait should pause until tickets are available again", func() {
+				time.Sleep(2 * time.Millisecond)
+				throttle.Wait()
+				So(throttle.Pauses, ShouldEqual, 2)
+				So(sampled, ShouldEqual, 3)
+			})
+		})
+	})
+	Convey("Given a node lagging behind its primary", t, func() {
+		throttle := &LoadThrottle{
+			Sample: func() (Load, error) {
+				return Load{ReadTickets: -1, ReplicationLag: time.Minute}, nil
+			},
+			MaxReplicationLag: 10 * time.Second,
+		}
+		So(throttle.busy(Load{ReadTickets: -1, ReplicationLag: time.Minute}), ShouldBeTrue)
+		So(throttle.busy(Load{ReadTickets: -1, ReplicationLag: time.Second}), ShouldBeFalse)
+	})
+	Convey("A nil throttle should never wait", t, func() {
+		var throttle *LoadThrottle
+		throttle.Wait()
+	})
+}
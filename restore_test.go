@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/duego/mongotool/mongo"
+	"github.com/duego/mongotool/storage"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingTarget remembers the operations restore performs, in order.
+type recordingTarget struct {
+	ops []string
+}
+
+func (t *recordingTarget) Insert(o *mongo.Object) error {
+	t.ops = append(t.ops, "insert "+o.Collection)
+	return nil
+}
+
+func (t *recordingTarget) EnsureIndex(col string, index mgo.Index) error {
+	t.ops = append(t.ops, "index "+col+" "+index.Name)
+	return nil
+}
+
+func (t *recordingTarget) CreateCollection(col string) error {
+	t.ops = append(t.ops, "create "+col)
+	return nil
+}
+
+func (t *recordingTarget) ApplySettings(s mongo.Settings) error {
+	t.ops = append(t.ops, fmt.Sprintf("settings %d %d", s.ProfilingLevel, s.SlowMs))
+	return nil
+}
+
+func TestRestoreOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	restoreProgress = false
+
+	Convey("Given a dump where indexes are stored ahead of the objects", t, func() {
+		store := storage.Filesystem{Root: dir}
+		So(writeChunk(store, "dump/aaaa.tar",
+			entry{"test/users/indexes.json", `[{"Key":["_id"],"Name":"_id_"},{"Key":["name"],"Name":"name_1"}]`},
+			entry{"test/users/5349b4ddd2781d08c09890f3", "foo"},
+		), ShouldBeNil)
+		So(writeChunk(store, "dump/bbbb.tar",
+			entry{"test/users/5349b4ddd2781d08c09890f4", "bar"},
+		), ShouldBeNil)
+
+		Convey("Restore should insert all objects before building secondary indexes", func() {
+			target := &recordingTarget{}
+			So(restore(store, "dump", target), ShouldBeNil)
+			So(target.ops, ShouldResemble, []string{
+				"insert users",
+				"insert users",
+				"index users name_1",
+			})
+		})
+	})
+}
+
+func TestRestorePrecreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	restoreProgress = false
+
+	Convey("Given a dump with collections spread over chunks", t, func() {
+		store := storage.Filesystem{Root: dir}
+		So(writeChunk(store, "dump/aaaa.tar",
+			entry{"test/users/5349b4ddd2781d08c09890f3", "foo"},
+			entry{"test/posts/indexes.json", `[{"Key":["_id"],"Name":"_id_"}]`},
+		), ShouldBeNil)
+		So(writeChunk(store, "dump/bbbb.tar",
+			entry{"test/posts/5349b4ddd2781d08c09890f4", "bar"},
+			entry{"test/tags/5349b4ddd2781d08c09890f5", "baz"},
+		), ShouldBeNil)
+
+		Convey("All collections should be created before any insert", func() {
+			restorePrecreate = true
+			defer func() { restorePrecreate = false }()
+			target := &recordingTarget{}
+			So(restore(store, "dump", target), ShouldBeNil)
+			So(target.ops, ShouldResemble, []string{
+				"create posts",
+				"create tags",
+				"create users",
+				"insert users",
+				"insert posts",
+				"insert tags",
+			})
+		})
+	})
+}
+
+func TestRestoreSchemaOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	restoreProgress = false
+
+	Convey("Given a dump of collections with and without secondary indexes", t, func() {
+		store := storage.Filesystem{Root: dir}
+		So(writeChunk(store, "dump/aaaa.tar",
+			entry{"test/users/indexes.json", `[{"Key":["_id"],"Name":"_id_"},{"Key":["name"],"Name":"name_1"}]`},
+			entry{"test/users/5349b4ddd2781d08c09890f3", "foo"},
+			entry{"test/posts/indexes.json", `[{"Key":["_id"],"Name":"_id_"}]`},
+			entry{"test/posts/5349b4ddd2781d08c09890f4", "bar"},
+		), ShouldBeNil)
+
+		Convey("A schema only restore should create collections and indexes but insert nothing", func() {
+			restoreSchemaOnly = true
+			defer func() { restoreSchemaOnly = false }()
+			target := &recordingTarget{}
+			So(restore(store, "dump", target), ShouldBeNil)
+			So(target.ops, ShouldHaveLength, 3)
+			So(target.ops, ShouldContain, "create users")
+			So(target.ops, ShouldContain, "create posts")
+			So(target.ops, ShouldContain, "index users name_1")
+			for _, op := range target.ops {
+				So(strings.HasPrefix(op, "insert"), ShouldBeFalse)
+			}
+		})
+	})
+}
+
+func TestRestoreSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	restoreProgress = false
+
+	Convey("Given a dump of a database profiling all operations", t, func() {
+		js, err := json.Marshal(mongo.Settings{ProfilingLevel: 2, SlowMs: 250})
+		So(err, ShouldBeNil)
+		settings := mongo.NewFile("test", mongo.SettingsCollection, mongo.SettingsFile, js)
+		store := storage.Filesystem{Root: dir}
+		So(writeChunk(store, "dump/aaaa.tar",
+			entry{settings.Path(), string(js)},
+			entry{"test/users/5349b4ddd2781d08c09890f3", "foo"},
+		), ShouldBeNil)
+
+		Convey("Restoring with -settings should reapply the profiling level after the objects", func() {
+			restoreSettings = true
+			defer func() { restoreSettings = false }()
+			target := &recordingTarget{}
+			So(restore(store, "dump", target), ShouldBeNil)
+			So(target.ops, ShouldResemble, []string{"insert users", "settings 2 250"})
+		})
+		Convey("Restoring without -settings should leave the settings alone", func() {
+			target := &recordingTarget{}
+			So(restore(store, "dump", target), ShouldBeNil)
+			So(target.ops, ShouldResemble, []string{"insert users"})
+		})
+		Convey("Inspect should not count the settings as a collection", func() {
+			d, err := inspectDump(store, store, "dump", false)
+			So(err, ShouldBeNil)
+			So(d.Collections, ShouldHaveLength, 1)
+		})
+	})
+}
+
+// concurrentTarget counts inserts per object id and may be used from several goroutines.
+type concurrentTarget struct {
+	recordingTarget
+	mu       sync.Mutex
+	inserted map[string]int
+	fail     string
+}
+
+func (t *concurrentTarget) Insert(o *mongo.Object) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inserted[o.Id.Hex()]++
+	if o.Collection == t.fail {
+		return errors.New("refused " + o.Id.Hex())
+	}
+	return nil
+}
+
+func TestParallelInserts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	restoreProgress = false
+
+	Convey("Given a dump of many objects in a few chunks", t, func() {
+		store := storage.Filesystem{Root: dir}
+		var ids []string
+		for c := 0; c < 4; c++ {
+			var entries []entry
+			for n := 0; n < 25; n++ {
+				id := fmt.Sprintf("5349b4ddd2781d08c098%04x", c*25+n)
+				ids = append(ids, id)
+				col := "users"
+				if c == 3 {
+					col = "posts"
+				}
+				entries = append(entries, entry{"test/" + col + "/" + id, "foo"})
+			}
+			So(writeChunk(store, fmt.Sprintf("dump/%04d.tar", c), entries...), ShouldBeNil)
+		}
+		restoreWorkers = 8
+		defer func() { restoreWorkers = 1 }()
+
+		Convey("Parallel workers should insert every object exactly once", func() {
+			target := &concurrentTarget{inserted: make(map[string]int)}
+			So(restore(store, "dump", target), ShouldBeNil)
+			So(target.inserted, ShouldHaveLength, len(ids))
+			for _, id := range ids {
+				So(target.inserted[id], ShouldEqual, 1)
+			}
+		})
+		Convey("Failures of several workers should be reported together", func() {
+			target := &concurrentTarget{inserted: make(map[string]int), fail: "posts"}
+			err := restore(store, "dump", target)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "refused")
+			for _, count := range target.inserted {
+				So(count, ShouldEqual, 1)
+			}
+		})
+	})
+}
+
+// refusingTarget refuses indexes using dropDups, like servers that no longer support it.
+type refusingTarget struct {
+	recordingTarget
+	created []mgo.Index
+}
+
+func (t *refusingTarget) EnsureIndex(col string, index mgo.Index) error {
+	if index.DropDups {
+		return errors.New("dropDups is not supported")
+	}
+	t.created = append(t.created, index)
+	return nil
+}
+
+func TestDegradeIndexes(t *testing.T) {
+	Convey("Given a target refusing an index option", t, func() {
+		target := &refusingTarget{}
+		index := mgo.Index{Key: []string{"email"}, Name: "email_1", Unique: true, DropDups: true, Sparse: true}
+
+		Convey("The index should fail without degrading", func() {
+			_, err := ensureIndex(target, "users", index, false)
+			So(err, ShouldNotBeNil)
+			So(target.created, ShouldBeEmpty)
+		})
+		Convey("Degrading should strip the option and create the rest of the index", func() {
+			stripped, err := ensureIndex(target, "users", index, true)
+			So(err, ShouldBeNil)
+			So(stripped, ShouldResemble, []string{"dropDups"})
+			So(target.created, ShouldHaveLength, 1)
+			So(target.created[0].DropDups, ShouldBeFalse)
+			So(target.created[0].Unique, ShouldBeTrue)
+			So(target.created[0].Sparse, ShouldBeTrue)
+		})
+	})
+}
+
+func TestVerifyBeforeRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	restoreProgress = false
+
+	Convey("Given a dump with checksums", t, func() {
+		doc, err := bson.Marshal(bson.M{"name": "foo"})
+		So(err, ShouldBeNil)
+		store := storage.NewChecksumSaveFetcher(storage.Filesystem{Root: dir})
+		So(writeChunk(store, "dump/aaaa.tar",
+			entry{"test/users/indexes.json", `[{"Key":["name"],"Name":"name_1"}]`},
+			entry{"test/users/5349b4ddd2781d08c09890f3", string(doc)},
+		), ShouldBeNil)
+		So(writeChunk(store, "dump/bbbb.tar",
+			entry{"test/users/5349b4ddd2781d08c09890f4", string(doc)},
+		), ShouldBeNil)
+		So(store.WriteSums("dump"), ShouldBeNil)
+		raw := storage.Filesystem{Root: dir}
+		target := &recordingTarget{}
+
+		Convey("An intact dump should verify and be restored", func() {
+			So(verifiedRestore(raw, false, "dump", target), ShouldBeNil)
+			So(target.ops, ShouldHaveLength, 3)
+		})
+		Convey("A chunk that no longer matches its checksum should stop the restore before any write", func() {
+			chunk := filepath.Join(dir, "dump", "bbbb.tar")
+			b, err := ioutil.ReadFile(chunk)
+			So(err, ShouldBeNil)
+			b[len(b)-1] ^= 1
+			So(ioutil.WriteFile(chunk, b, 0644), ShouldBeNil)
+
+			err = verifiedRestore(raw, false, "dump", target)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Checksum mismatch")
+			So(target.ops, ShouldBeEmpty)
+		})
+		Convey("Checksums should be checked below a root with a leading slash, as S3 and GCS roots have", func() {
+			chunk := filepath.Join(dir, "dump", "bbbb.tar")
+			b, err := ioutil.ReadFile(chunk)
+			So(err, ShouldBeNil)
+			b[len(b)-1] ^= 1
+			So(ioutil.WriteFile(chunk, b, 0644), ShouldBeNil)
+
+			err = verifiedRestore(raw, false, "/dump", target)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "dump/bbbb.tar: Checksum mismatch")
+		})
+		Convey("A malformed SHA256SUMS should fail verification rather than skip the checksums", func() {
+			So(ioutil.WriteFile(filepath.Join(dir, "dump", storage.ChecksumFile), []byte("garbage\n"), 0644), ShouldBeNil)
+
+			err := verifiedRestore(raw, false, "dump", target)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Reading "+storage.ChecksumFile)
+			So(target.ops, ShouldBeEmpty)
+		})
+		Convey("A chunk listed in SHA256SUMS but missing should be reported", func() {
+			So(os.Remove(filepath.Join(dir, "dump", "aaaa.tar")), ShouldBeNil)
+
+			err := verifiedRestore(raw, false, "dump", target)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "dump/aaaa.tar: Listed in "+storage.ChecksumFile+" but missing")
+			So(target.ops, ShouldBeEmpty)
+		})
+		Convey("A chunk not listed in SHA256SUMS should be reported", func() {
+			So(writeChunk(raw, "dump/cccc.tar",
+				entry{"test/users/5349b4ddd2781d08c09890f5", string(doc)},
+			), ShouldBeNil)
+
+			err := verifiedRestore(raw, false, "dump", target)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Verification failed, nothing was restored: dump/cccc.tar: Not listed in "+storage.ChecksumFile)
+			So(target.ops, ShouldBeEmpty)
+		})
+		Convey("A truncated chunk should stop the restore before any write", func() {
+			chunk := filepath.Join(dir, "dump", "bbbb.tar")
+			b, err := ioutil.ReadFile(chunk)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(chunk, b[:100], 0644), ShouldBeNil)
+			So(os.Remove(filepath.Join(dir, "dump", storage.ChecksumFile)), ShouldBeNil)
+
+			So(verifiedRestore(raw, false, "dump", target), ShouldNotBeNil)
+			So(target.ops, ShouldBeEmpty)
+		})
+	})
+	Convey("Given a dump with a manifest", t, func() {
+		doc, err := bson.Marshal(bson.M{"name": "foo"})
+		So(err, ShouldBeNil)
+		store := storage.NewManifestSaveFetcher(storage.Filesystem{Root: dir})
+		So(writeChunk(store, "manifest/aaaa.tar",
+			entry{"test/users/5349b4ddd2781d08c09890f3", string(doc)},
+		), ShouldBeNil)
+		So(store.WriteManifest("manifest"), ShouldBeNil)
+		raw := storage.Filesystem{Root: dir}
+		target := &recordingTarget{}
+
+		Convey("An intact dump should verify and be restored", func() {
+			So(verifiedRestore(raw, false, "manifest", target), ShouldBeNil)
+			So(target.ops, ShouldHaveLength, 1)
+		})
+		Convey("A chunk no longer matching the manifest should stop the restore before any write", func() {
+			chunk := filepath.Join(dir, "manifest", "aaaa.tar")
+			b, err := ioutil.ReadFile(chunk)
+			So(err, ShouldBeNil)
+			b[len(b)-1] ^= 1
+			So(ioutil.WriteFile(chunk, b, 0644), ShouldBeNil)
+
+			err = verifiedRestore(raw, false, "manifest", target)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Backup does not match its manifest: manifest/aaaa.tar: MD5")
+			So(target.ops, ShouldBeEmpty)
+		})
+	})
+	Convey("Given a compressed dump with checksums", t, func() {
+		doc, err := bson.Marshal(bson.M{"name": "foo"})
+		So(err, ShouldBeNil)
+		sums := storage.NewChecksumSaveFetcher(storage.Filesystem{Root: dir})
+		So(writeChunk(storage.NewGzipSaveFetcher(sums), "gz/aaaa.tar.gz",
+			entry{"test/users/5349b4ddd2781d08c09890f3", string(doc)},
+		), ShouldBeNil)
+		So(sums.WriteSums("gz"), ShouldBeNil)
+		raw := &countingStorage{Filesystem: storage.Filesystem{Root: dir}, fetches: make(map[string]int)}
+
+		Convey("Each chunk should be fetched once to be both hashed and decoded", func() {
+			So(verifyDump(raw, true, "gz", 2), ShouldBeNil)
+			So(raw.fetches["gz/aaaa.tar.gz"], ShouldEqual, 1)
+		})
+		Convey("A compressed chunk not matching its checksum should be reported as such", func() {
+			chunk := filepath.Join(dir, "gz", "aaaa.tar.gz")
+			b, err := ioutil.ReadFile(chunk)
+			So(err, ShouldBeNil)
+			b[len(b)/2] ^= 1
+			So(ioutil.WriteFile(chunk, b, 0644), ShouldBeNil)
+			err = verifyDump(raw, true, "gz", 2)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "gz/aaaa.tar.gz: Checksum mismatch")
+		})
+	})
+}
+
+// countingStorage counts how many times each path is fetched.
+type countingStorage struct {
+	storage.Filesystem
+	mu      sync.Mutex
+	fetches map[string]int
+}
+
+func (c *countingStorage) Fetch(fpath string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	c.fetches[fpath]++
+	c.mu.Unlock()
+	return c.Filesystem.Fetch(fpath)
+}
+
+func TestParallelVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given a dump of many chunks with one corrupt", t, func() {
+		doc, err := bson.Marshal(bson.M{"name": "foo"})
+		So(err, ShouldBeNil)
+		sums := storage.NewChecksumSaveFetcher(storage.Filesystem{Root: dir})
+		for n := 0; n < 20; n++ {
+			So(writeChunk(sums, fmt.Sprintf("dump/%04d.tar", n),
+				entry{fmt.Sprintf("test/users/5349b4ddd2781d08c09890%02x", n), string(doc)},
+			), ShouldBeNil)
+		}
+		So(sums.WriteSums("dump"), ShouldBeNil)
+		chunk := filepath.Join(dir, "dump", "0013.tar")
+		b, err := ioutil.ReadFile(chunk)
+		So(err, ShouldBeNil)
+		b[len(b)-1] ^= 1
+		So(ioutil.WriteFile(chunk, b, 0644), ShouldBeNil)
+
+		raw := &countingStorage{Filesystem: storage.Filesystem{Root: dir}, fetches: make(map[string]int)}
+		err = verifyDump(raw, false, "dump", 8)
+
+		Convey("Every chunk should be checksummed exactly once", func() {
+			delete(raw.fetches, "dump/"+storage.ChecksumFile)
+			So(raw.fetches, ShouldHaveLength, 20)
+			for _, count := range raw.fetches {
+				So(count, ShouldEqual, 1)
+			}
+		})
+		Convey("The corrupt chunk should be reported", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "dump/0013.tar: Checksum mismatch")
+		})
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"github.com/duego/mongotool/storage"
+)
+
+var cmdSelftest = &Command{
+	UsageLine: "selftest [-compression] path",
+	Short:     "check that a storage target works end to end",
+	Long: `
+Selftest saves a small object below path on an S3 bucket, GCS bucket or
+filesystem, lists it, fetches it back, compares it with what was saved,
+copies it to a second object and deletes both again. Each step is
+reported as passed or failed along with how long it took, which validates
+credentials, connectivity and that the storage supports what dump and
+restore need.
+
+The path is given in the same form as the -target flag of dump.
+
+Set -compression to false to test without compression.
+
+The objects are deleted even when an earlier step failed, so the test leaves
+nothing behind once it could save them.
+`,
+}
+
+var (
+	// selftest flags
+	selftestCompressed bool
+)
+
+func init() {
+	cmdSelftest.Run = runSelftest
+	cmdSelftest.Flag.BoolVar(&selftestCompressed, "compression", true, "")
+}
+
+func runSelftest(cmd *Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+	}
+	root, store := selectStorage(args[0], selftestCompressed)
+	for _, check := range storage.SelfTest(store, root) {
+		fmt.Println(check)
+		if check.Err != nil {
+			setExitStatus(1)
+		}
+	}
+}
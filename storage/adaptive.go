@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimit bounds the number of requests in flight towards a backend that may throttle us.
+// Each throttled request halves the limit and doubles the delay before the next request is sent,
+// while successful requests slowly raise the limit again, AIMD-style.
+type AdaptiveLimit struct {
+	// Max is the highest number of requests allowed in flight.
+	Max int
+	// Backoff is the first delay applied after being throttled, it doubles up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    float64
+	inflight int
+	delay    time.Duration
+}
+
+func NewAdaptiveLimit(max int) *AdaptiveLimit {
+	a := &AdaptiveLimit{
+		Max:        max,
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: 5 * time.Second,
+		limit:      float64(max),
+	}
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+// Limit returns the current number of requests allowed in flight.
+func (a *AdaptiveLimit) Limit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return int(a.limit)
+}
+
+// Acquire blocks until another request may be sent.
+func (a *AdaptiveLimit) Acquire() {
+	a.mu.Lock()
+	for a.inflight >= int(a.limit) {
+		a.cond.Wait()
+	}
+	a.inflight++
+	delay := a.delay
+	a.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Release gives back the slot of a finished request, throttled tells if the backend asked us to slow down.
+func (a *AdaptiveLimit) Release(throttled bool) {
+	a.mu.Lock()
+	a.inflight--
+	if throttled {
+		a.limit /= 2
+		if a.limit < 1 {
+			a.limit = 1
+		}
+		if a.delay == 0 {
+			a.delay = a.Backoff
+		} else {
+			a.delay *= 2
+		}
+		if a.delay > a.MaxBackoff {
+			a.delay = a.MaxBackoff
+		}
+	} else {
+		// One more request per window of successful requests.
+		a.limit += 1 / a.limit
+		if a.limit > float64(a.Max) {
+			a.limit = float64(a.Max)
+		}
+		a.delay /= 2
+		if a.delay < a.Backoff {
+			a.delay = 0
+		}
+	}
+	a.cond.Broadcast()
+	a.mu.Unlock()
+}
+
+// isThrottled tells if S3 responded with SlowDown.
+func isThrottled(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// do sends req with client, holding a slot of limit while in flight unless limit is nil.
+func do(client *http.Client, limit *AdaptiveLimit, req *http.Request) (*http.Response, error) {
+	if limit == nil {
+		return client.Do(req)
+	}
+	limit.Acquire()
+	resp, err := client.Do(req)
+	limit.Release(err == nil && isThrottled(resp))
+	return resp, err
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimit(t *testing.T) {
+	setTestAwsKeys()
+	const capacity = 2
+	var mu sync.Mutex
+	inflight, throttled := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inflight++
+		over := inflight > capacity
+		if over {
+			throttled++
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		if over {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("<Error><Code>SlowDown</Code></Error>"))
+			return
+		}
+		w.Write([]byte("Foo"))
+	}))
+	defer ts.Close()
+
+	Convey("Given a bucket throttling more than two concurrent requests", t, func() {
+		store := NewS3(ts.URL)
+		store.Limit = NewAdaptiveLimit(8)
+		store.MaxRetries = 0
+		store.Limit.Backoff = time.Millisecond
+		store.Limit.MaxBackoff = 10 * time.Millisecond
+
+		var wg sync.WaitGroup
+		var sample sync.Once
+		limit := 0
+		for n := 0; n < 8; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 10; i++ {
+					if r, err := store.Fetch("object"); err == nil {
+						r.Close()
+					}
+				}
+				// Look at the limit while the others are still busy, it rises again once they are done.
+				sample.Do(func() { limit = store.Limit.Limit() })
+			}()
+		}
+		wg.Wait()
+
+		Convey("The limit should back off towards what the bucket accepts", func() {
+			So(throttled, ShouldBeGreaterThan, 0)
+			So(limit, ShouldBeLessThanOrEqualTo, capacity+1)
+		})
+	})
+	Convey("Given a limit that is never throttled", t, func() {
+		a := NewAdaptiveLimit(4)
+		a.Acquire()
+		a.Release(true)
+		So(a.Limit(), ShouldEqual, 2)
+		Convey("It should ramp back up to the maximum", func() {
+			for n := 0; n < 20; n++ {
+				a.Acquire()
+				a.Release(false)
+			}
+			So(a.Limit(), ShouldEqual, 4)
+		})
+	})
+}
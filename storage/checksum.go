@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ChecksumFile is the name of the listing written by ChecksumSaveFetcher.WriteSums.
+const ChecksumFile = "SHA256SUMS"
+
+// checksumWriteCloser hashes everything written and records the sum once the object is stored.
+type checksumWriteCloser struct {
+	io.WriteCloser
+	hash  hash.Hash
+	path  string
+	store *ChecksumSaveFetcher
+}
+
+func (c *checksumWriteCloser) Write(p []byte) (int, error) {
+	c.hash.Write(p)
+	return c.WriteCloser.Write(p)
+}
+
+func (c *checksumWriteCloser) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	c.store.mu.Lock()
+	c.store.sums[c.path] = hex.EncodeToString(c.hash.Sum(nil))
+	c.store.mu.Unlock()
+	return nil
+}
+
+// ChecksumSaveFetcher wraps another SaveFetcher to remember the SHA-256 of every object saved on it,
+// so a SHA256SUMS listing can be written next to them for verification with coreutils "sha256sum -c".
+type ChecksumSaveFetcher struct {
+	s    SaveFetcher
+	mu   sync.Mutex
+	sums map[string]string
+}
+
+func NewChecksumSaveFetcher(s SaveFetcher) *ChecksumSaveFetcher {
+	return &ChecksumSaveFetcher{s: s, sums: make(map[string]string)}
+}
+
+func (c *ChecksumSaveFetcher) Save(path string) (io.WriteCloser, error) {
+	return c.save(path, c.s.Save)
+}
+
+func (c *ChecksumSaveFetcher) SaveNew(path string) (io.WriteCloser, error) {
+	return c.save(path, saveNewOf(c.s))
+}
+
+func (c *ChecksumSaveFetcher) save(path string, open func(string) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	w, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumWriteCloser{w, sha256.New(), path, c}, nil
+}
+
+func (c *ChecksumSaveFetcher) Fetch(path string) (io.ReadCloser, error) {
+	return c.s.Fetch(path)
+}
+
+func (c *ChecksumSaveFetcher) Walk(path string, walkfn WalkFunc) error {
+	w := c.s.(Walker)
+	return w.Walk(path, walkfn)
+}
+
+func (c *ChecksumSaveFetcher) WalkIter(path string) Iterator {
+	w := c.s.(IterWalker)
+	return w.WalkIter(path)
+}
+
+func (c *ChecksumSaveFetcher) WalkPrefixes(path string, walkfn WalkFunc) error {
+	w := c.s.(PrefixWalker)
+	return w.WalkPrefixes(path, walkfn)
+}
+
+func (c *ChecksumSaveFetcher) Stat(path string) (ObjectInfo, error) {
+	return stat(c.s, path)
+}
+
+// Delete removes the object and forgets its sum, so it is not listed by WriteSums.
+func (c *ChecksumSaveFetcher) Delete(path string) error {
+	d := c.s.(Deleter)
+	if err := d.Delete(path); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.sums, path)
+	c.mu.Unlock()
+	return nil
+}
+
+// checksumLine formats one entry the way sha256sum does, escaping names with backslashes or newlines.
+func checksumLine(sum, name string) string {
+	if !strings.ContainsAny(name, "\\\n") {
+		return fmt.Sprintf("%s  %s\n", sum, name)
+	}
+	name = strings.Replace(name, "\\", "\\\\", -1)
+	name = strings.Replace(name, "\n", "\\n", -1)
+	return fmt.Sprintf("\\%s  %s\n", sum, name)
+}
+
+// WriteSums saves a SHA256SUMS listing at dir, with the objects saved below dir named relative to it.
+func (c *ChecksumSaveFetcher) WriteSums(dir string) error {
+	c.mu.Lock()
+	sums := make(map[string]string)
+	var names []string
+	for fpath, sum := range c.sums {
+		if rel, ok := relativeTo(dir, fpath); ok {
+			sums[rel] = sum
+			names = append(names, rel)
+		}
+	}
+	c.mu.Unlock()
+	sort.Strings(names)
+
+	w, err := c.s.Save(path.Join(dir, ChecksumFile))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := io.WriteString(w, checksumLine(sums[name], name)); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// ReadSums fetches the SHA256SUMS listing at dir, keyed by the full path of each object without
+// a leading slash, the way Walk gives it on every storage.
+func ReadSums(s Fetcher, dir string) (map[string]string, error) {
+	r, err := s.Fetch(path.Join(dir, ChecksumFile))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string)
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+		i := strings.Index(line, "  ")
+		if i < 0 {
+			return nil, errors.New("Malformed line in " + ChecksumFile + ": " + line)
+		}
+		sum, name := line[:i], line[i+2:]
+		if escaped {
+			name = unescapeName(name)
+		}
+		sums[strings.TrimLeft(path.Join(dir, name), "/")] = sum
+	}
+	return sums, nil
+}
+
+// unescapeName reverses the escaping done by checksumLine.
+func unescapeName(name string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+1 < len(name) {
+			i++
+			if name[i] == 'n' {
+				b.WriteByte('\n')
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// relativeTo returns fpath relative to dir if it is below it.
+func relativeTo(dir, fpath string) (string, bool) {
+	dir = strings.Trim(dir, "/")
+	fpath = strings.TrimLeft(fpath, "/")
+	if dir == "" {
+		return fpath, true
+	}
+	if !strings.HasPrefix(fpath, dir+"/") {
+		return "", false
+	}
+	return fpath[len(dir)+1:], true
+}
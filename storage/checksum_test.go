@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestChecksumSaveFetcher(t *testing.T) {
+	Convey("Given objects saved through a checksumming storage", t, func() {
+		mem := &memStorage{objects: make(map[string][]byte)}
+		store := NewChecksumSaveFetcher(mem)
+		for name, body := range map[string]string{"dump/b.tar": "bar", "dump/a.tar": "foo", "other/c.tar": "baz"} {
+			w, err := store.Save(name)
+			So(err, ShouldBeNil)
+			w.Write([]byte(body))
+			So(w.Close(), ShouldBeNil)
+		}
+		So(store.WriteSums("dump"), ShouldBeNil)
+		sums := string(mem.objects["dump/"+ChecksumFile])
+
+		Convey("The listing should be in sha256sum format, sorted and relative to its directory", func() {
+			So(sums, ShouldEqual,
+				"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae  a.tar\n"+
+					"fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9  b.tar\n")
+		})
+		Convey("Every line should validate against the stored object", func() {
+			scanner := bufio.NewScanner(strings.NewReader(sums))
+			for scanner.Scan() {
+				parts := strings.SplitN(scanner.Text(), "  ", 2)
+				So(parts, ShouldHaveLength, 2)
+				sum := sha256.Sum256(mem.objects["dump/"+parts[1]])
+				So(hex.EncodeToString(sum[:]), ShouldEqual, parts[0])
+			}
+		})
+	})
+	Convey("ReadSums should give back what WriteSums stored, keyed by full path", t, func() {
+		mem := &memStorage{objects: make(map[string][]byte)}
+		store := NewChecksumSaveFetcher(mem)
+		for _, name := range []string{"dump/a.tar", "dump/b\\n.tar", "dump/c\n.tar"} {
+			w, err := store.Save(name)
+			So(err, ShouldBeNil)
+			w.Write([]byte(name))
+			So(w.Close(), ShouldBeNil)
+		}
+		So(store.WriteSums("dump"), ShouldBeNil)
+		sums, err := ReadSums(mem, "dump")
+		So(err, ShouldBeNil)
+		So(sums, ShouldHaveLength, 3)
+		for name, sum := range sums {
+			expect := sha256.Sum256([]byte(name))
+			So(sum, ShouldEqual, hex.EncodeToString(expect[:]))
+		}
+	})
+	Convey("Names with backslashes should be escaped like coreutils does", t, func() {
+		line := checksumLine(strings.Repeat("0", 64), `a\b`)
+		So(line, ShouldEqual, `\`+strings.Repeat("0", 64)+`  a\\b`+"\n")
+		So(bytes.Count([]byte(line), []byte("\n")), ShouldEqual, 1)
+	})
+}
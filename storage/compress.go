@@ -45,7 +45,15 @@ func NewGzipSaveFetcher(s SaveFetcher) SaveFetcher {
 }
 
 func (c *GzipSaveFetcher) Save(path string) (io.WriteCloser, error) {
-	w, err := c.s.Save(path)
+	return c.save(path, c.s.Save)
+}
+
+func (c *GzipSaveFetcher) SaveNew(path string) (io.WriteCloser, error) {
+	return c.save(path, saveNewOf(c.s))
+}
+
+func (c *GzipSaveFetcher) save(path string, open func(string) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	w, err := open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -68,3 +76,22 @@ func (c *GzipSaveFetcher) Walk(path string, walkfn WalkFunc) error {
 	w := c.s.(Walker)
 	return w.Walk(path, walkfn)
 }
+
+func (c *GzipSaveFetcher) WalkIter(path string) Iterator {
+	w := c.s.(IterWalker)
+	return w.WalkIter(path)
+}
+
+func (c *GzipSaveFetcher) WalkPrefixes(path string, walkfn WalkFunc) error {
+	w := c.s.(PrefixWalker)
+	return w.WalkPrefixes(path, walkfn)
+}
+
+func (c *GzipSaveFetcher) Stat(path string) (ObjectInfo, error) {
+	return stat(c.s, path)
+}
+
+func (c *GzipSaveFetcher) Delete(path string) error {
+	d := c.s.(Deleter)
+	return d.Delete(path)
+}
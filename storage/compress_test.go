@@ -4,6 +4,9 @@ import (
 	"bytes"
 	. "github.com/smartystreets/goconvey/convey"
 	"io"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 )
 
@@ -38,5 +41,41 @@ func TestGzipSaver(t *testing.T) {
 			_, ok := g.(Walker)
 			So(ok, ShouldBeTrue)
 		})
+		Convey("Stat should fail rather than panic when the storage below cannot stat", func() {
+			_, err := g.(Stater).Stat("dump/a.tar")
+			So(err, ShouldEqual, errCannotStat)
+		})
+	})
+}
+
+func TestGzipRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given a GzipSaveFetcher over the filesystem", t, func() {
+		g := NewGzipSaveFetcher(Filesystem{dir})
+		content := bytes.Repeat([]byte("a very compressible document "), 1000)
+		w, err := g.Save("dump/chunk.tar.gz")
+		So(err, ShouldBeNil)
+		_, err = w.Write(content)
+		So(err, ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+
+		Convey("The object should be stored compressed under the given path", func() {
+			info, err := os.Stat(path.Join(dir, "dump/chunk.tar.gz"))
+			So(err, ShouldBeNil)
+			So(info.Size(), ShouldBeLessThan, len(content)/10)
+		})
+		Convey("Fetching it should give back the same bytes", func() {
+			r, err := g.Fetch("dump/chunk.tar.gz")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(b, content), ShouldBeTrue)
+		})
 	})
 }
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Copy streams the object at path from src to the same path on dst, without holding it in memory,
+// so backups can be moved between backends. When dst can save with a context, a failed copy aborts
+// the object being saved instead of storing what was read of it. Both ends are closed before Copy returns.
+func Copy(src Fetcher, dst Saver, path string) error {
+	r, err := src.Fetch(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Fetching %s to copy it: %v", path, err))
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var w io.WriteCloser
+	if c, ok := dst.(ContextSaveFetcher); ok {
+		w, err = c.SaveContext(ctx, path)
+	} else {
+		w, err = dst.Save(path)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Saving copy of %s: %v", path, err))
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		cancel()
+		w.Close()
+		return errors.New(fmt.Sprintf("Copying %s: %v", path, err))
+	}
+	if err := w.Close(); err != nil {
+		return errors.New(fmt.Sprintf("Saving copy of %s: %v", path, err))
+	}
+	return nil
+}
+
+// CopyAll copies every object below prefix from src to dst, one after the other, stopping at the
+// first that fails. src has to be a Walker.
+func CopyAll(src Fetcher, dst Saver, prefix string) error {
+	w, ok := src.(Walker)
+	if !ok {
+		return errors.New("Cannot list the objects to copy, the source is not a Walker")
+	}
+	return w.Walk(prefix, func(fpath string, _ ObjectInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return Copy(src, dst, strings.TrimLeft(fpath, "/"))
+	})
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// failingFetcher gives readers failing after a few bytes.
+type failingFetcher struct{}
+
+func (failingFetcher) Fetch(path string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(io.MultiReader(io.LimitReader(zeros{}, 10), errorReader{})), nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+type errorReader struct{}
+
+func (errorReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestCopy(t *testing.T) {
+	Convey("Given objects on one filesystem and another empty one", t, func() {
+		srcDir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(srcDir)
+		dstDir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dstDir)
+		src, dst := Filesystem{srcDir}, Filesystem{dstDir}
+		for _, name := range []string{"dump/a.tar", "dump/db/b.tar", "other/c.tar"} {
+			w, err := src.Save(name)
+			So(err, ShouldBeNil)
+			w.Write([]byte("content of " + name))
+			So(w.Close(), ShouldBeNil)
+		}
+
+		Convey("Copy should store the same object on the destination", func() {
+			So(Copy(src, dst, "dump/a.tar"), ShouldBeNil)
+			b, err := ioutil.ReadFile(path.Join(dstDir, "dump/a.tar"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "content of dump/a.tar")
+		})
+		Convey("Copy of a missing object should fail", func() {
+			err := Copy(src, dst, "dump/missing.tar")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "dump/missing.tar")
+		})
+		Convey("A failed read should not leave an object behind", func() {
+			err := Copy(failingFetcher{}, dst, "dump/a.tar")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "connection reset")
+			_, err = os.Stat(path.Join(dstDir, "dump/a.tar"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+		Convey("CopyAll should copy every object below the prefix", func() {
+			So(CopyAll(src, dst, "dump"), ShouldBeNil)
+			var keys []string
+			dst.Walk("", func(fpath string, _ ObjectInfo, err error) error {
+				keys = append(keys, fpath)
+				return err
+			})
+			So(keys, ShouldResemble, []string{"dump/a.tar", "dump/db/b.tar"})
+		})
+		Convey("CopyAll should refuse a source it cannot list", func() {
+			So(CopyAll(failingFetcher{}, dst, "dump"), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DryRunSaveFetcher wraps another SaveFetcher to print what saving and deleting would do instead of
+// doing it, so a rotation can be previewed. Fetch, Walk and Stat go to the wrapped storage, so the plan
+// printed is the one a real run would carry out.
+type DryRunSaveFetcher struct {
+	s   SaveFetcher
+	out io.Writer
+}
+
+// NewDryRunSaveFetcher prints the plan to out, os.Stderr when nil.
+func NewDryRunSaveFetcher(s SaveFetcher, out io.Writer) *DryRunSaveFetcher {
+	if out == nil {
+		out = os.Stderr
+	}
+	return &DryRunSaveFetcher{s, out}
+}
+
+// dryRunWriter counts what would have been saved.
+type dryRunWriter struct {
+	action string
+	path   string
+	size   int64
+	out    io.Writer
+}
+
+func (w *dryRunWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+func (w *dryRunWriter) Close() error {
+	fmt.Fprintf(w.out, "Would %s %s (%d bytes)\n", w.action, w.path, w.size)
+	return nil
+}
+
+// Save discards what is written, telling on Close whether it would have been a new object or replaced one.
+func (d *DryRunSaveFetcher) Save(path string) (io.WriteCloser, error) {
+	action := "save"
+	if _, err := stat(d.s, path); err == nil {
+		action = "overwrite"
+	} else if err != ErrNotFound && err != errCannotStat {
+		return nil, err
+	}
+	return &dryRunWriter{action: action, path: path, out: d.out}, nil
+}
+
+// SaveNew fails with ErrExists where a real run would, otherwise it is like Save.
+func (d *DryRunSaveFetcher) SaveNew(path string) (io.WriteCloser, error) {
+	w, err := d.Save(path)
+	if err == nil && w.(*dryRunWriter).action == "overwrite" {
+		return nil, ErrExists
+	}
+	return w, err
+}
+
+func (d *DryRunSaveFetcher) Fetch(path string) (io.ReadCloser, error) {
+	return d.s.Fetch(path)
+}
+
+func (d *DryRunSaveFetcher) Walk(path string, walkfn WalkFunc) error {
+	w := d.s.(Walker)
+	return w.Walk(path, walkfn)
+}
+
+func (d *DryRunSaveFetcher) WalkIter(path string) Iterator {
+	w := d.s.(IterWalker)
+	return w.WalkIter(path)
+}
+
+func (d *DryRunSaveFetcher) WalkPrefixes(path string, walkfn WalkFunc) error {
+	w := d.s.(PrefixWalker)
+	return w.WalkPrefixes(path, walkfn)
+}
+
+func (d *DryRunSaveFetcher) Stat(path string) (ObjectInfo, error) {
+	return stat(d.s, path)
+}
+
+// Delete prints the object it would delete, when the wrapped storage can delete at all.
+func (d *DryRunSaveFetcher) Delete(path string) error {
+	if _, ok := d.s.(Deleter); !ok {
+		return errors.New("Storage cannot delete " + path)
+	}
+	fmt.Fprintf(d.out, "Would delete %s\n", path)
+	return nil
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDryRunSaveFetcher(t *testing.T) {
+	Convey("Given a dry run over a filesystem with two backups", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		fs := Filesystem{dir}
+		for n, name := range []string{"host/db/1/chunk.tar", "host/db/1/" + CompleteMarker, "host/db/2/chunk.tar", "host/db/2/" + CompleteMarker} {
+			w, err := fs.Save(name)
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldBeNil)
+			modified := time.Now().Add(-time.Duration(10-n/2) * time.Hour)
+			So(os.Chtimes(path.Join(dir, name), modified, modified), ShouldBeNil)
+		}
+		var out bytes.Buffer
+		store := NewDryRunSaveFetcher(fs, &out)
+
+		Convey("Delete should only print the key", func() {
+			So(store.Delete("host/db/1/chunk.tar"), ShouldBeNil)
+			So(out.String(), ShouldEqual, "Would delete host/db/1/chunk.tar\n")
+			_, err := fs.Stat("host/db/1/chunk.tar")
+			So(err, ShouldBeNil)
+		})
+		Convey("Save should tell a new object from an overwrite and store nothing", func() {
+			for _, name := range []string{"host/db/2/chunk.tar", "host/db/3/chunk.tar"} {
+				w, err := store.Save(name)
+				So(err, ShouldBeNil)
+				w.Write([]byte("foobar"))
+				So(w.Close(), ShouldBeNil)
+			}
+			So(out.String(), ShouldEqual, "Would overwrite host/db/2/chunk.tar (6 bytes)\nWould save host/db/3/chunk.tar (6 bytes)\n")
+			b, err := ioutil.ReadFile(path.Join(dir, "host/db/2/chunk.tar"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "foo")
+			_, err = fs.Stat("host/db/3/chunk.tar")
+			So(err, ShouldEqual, ErrNotFound)
+		})
+		Convey("SaveNew should fail where a real run would", func() {
+			_, err := store.SaveNew("host/db/2/chunk.tar")
+			So(err, ShouldEqual, ErrExists)
+			w, err := store.SaveNew("host/db/3/chunk.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(out.String(), ShouldEqual, "Would save host/db/3/chunk.tar (0 bytes)\n")
+		})
+		Convey("Prune through it should print the plan of a real run", func() {
+			deleted, err := Prune(store, "host/db", PrunePolicy{KeepLast: 1})
+			So(err, ShouldBeNil)
+			So(deleted, ShouldHaveLength, 1)
+			So(out.String(), ShouldEqual, "Would delete host/db/1/"+CompleteMarker+"\nWould delete host/db/1/chunk.tar\n")
+			_, err = fs.Stat("host/db/1/chunk.tar")
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+)
+
+// encryptSegment is how much plaintext is sealed at a time, GCM cannot stream a whole object.
+const encryptSegment = 64 * 1024
+
+// errDecrypt is returned for an object that does not authenticate, never its garbled content.
+var errDecrypt = errors.New("Could not decrypt object, the key is wrong or the object was tampered with")
+
+// segmentNonce gives the nonce of the n-th segment, the counter is xored into the end of the random one.
+func segmentNonce(nonce []byte, n uint64) []byte {
+	seg := make([]byte, len(nonce))
+	copy(seg, nonce)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], n)
+	for i := range counter {
+		seg[len(seg)-8+i] ^= counter[i]
+	}
+	return seg
+}
+
+// segmentData tells apart the last segment, so an object cut at a segment boundary does not authenticate.
+func segmentData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptWriteCloser seals what is written one segment at a time, the last one on Close.
+type encryptWriteCloser struct {
+	aead     cipher.AEAD
+	nonce    []byte
+	segments uint64
+	buf      []byte
+	original io.WriteCloser
+	err      error
+}
+
+func (e *encryptWriteCloser) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	e.buf = append(e.buf, p...)
+	// A full segment is held back until more is written, the last one has to be sealed as such.
+	for len(e.buf) > encryptSegment {
+		if e.err = e.seal(e.buf[:encryptSegment], false); e.err != nil {
+			return 0, e.err
+		}
+		e.buf = e.buf[encryptSegment:]
+	}
+	return len(p), nil
+}
+
+func (e *encryptWriteCloser) seal(plain []byte, last bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.nonce, e.segments), plain, segmentData(last))
+	e.segments++
+	_, err := e.original.Write(sealed)
+	return err
+}
+
+// Close seals the last segment and closes the original WriteCloser, passing any errors.
+func (e *encryptWriteCloser) Close() error {
+	if e.err == nil {
+		e.err = e.seal(e.buf, true)
+	}
+	if e.err != nil {
+		e.original.Close()
+		return e.err
+	}
+	return e.original.Close()
+}
+
+// decryptReadCloser opens the segments of an object as they are read.
+type decryptReadCloser struct {
+	aead     cipher.AEAD
+	nonce    []byte
+	segments uint64
+	r        *bufio.Reader
+	sealed   []byte
+	buf      []byte
+	last     bool
+	original io.ReadCloser
+	err      error
+}
+
+func (d *decryptReadCloser) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.last {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// open reads and authenticates the next segment, the last one is shorter or followed by nothing.
+func (d *decryptReadCloser) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		d.last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := d.aead.Open(d.buf[:0], segmentNonce(d.nonce, d.segments), d.sealed[:n], segmentData(d.last))
+	if err != nil {
+		return errDecrypt
+	}
+	d.segments++
+	d.buf = plain
+	return nil
+}
+
+func (d *decryptReadCloser) Close() error {
+	return d.original.Close()
+}
+
+// EncryptSaveFetcher wraps another SaveFetcher to encrypt data saved on it with AES-256-GCM and to
+// decrypt and authenticate data fetched from it, so objects leave the host encrypted with a key of
+// our own. Every object starts with a random nonce, followed by its segments of encryptSegment bytes
+// each sealed on their own. Sizes walked or stated are the ones of the encrypted objects.
+//
+// Objects named in cleartext are saved and fetched as they are, so the MANIFEST.json of a backup can
+// be browsed without the key while its chunks stay encrypted. The tradeoff is that anyone who can
+// read the bucket learns what the manifest holds: the keys, sizes and MD5s of the chunks, the labels
+// and the server version. A manifest kept above encryption lists the MD5 of the plaintext, which
+// confirms a guess of a chunk's content. Keep ManifestSaveFetcher below EncryptSaveFetcher to list
+// the encrypted objects instead, which also lets Verify check a backup without the key.
+type EncryptSaveFetcher struct {
+	s         SaveFetcher
+	aead      cipher.AEAD
+	cleartext map[string]bool
+}
+
+// NewEncryptSaveFetcher encrypts with key, which must be 32 bytes long, every object but the ones
+// whose name, the last element of their path, is one of cleartext.
+func NewEncryptSaveFetcher(s SaveFetcher, key []byte, cleartext ...string) (SaveFetcher, error) {
+	if len(key) != 32 {
+		return nil, errors.New(fmt.Sprintf("Encryption key must be 32 bytes long, got %d", len(key)))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e := &EncryptSaveFetcher{s: s, aead: aead, cleartext: make(map[string]bool)}
+	for _, name := range cleartext {
+		e.cleartext[name] = true
+	}
+	return e, nil
+}
+
+func (e *EncryptSaveFetcher) Save(path string) (io.WriteCloser, error) {
+	return e.save(path, e.s.Save)
+}
+
+func (e *EncryptSaveFetcher) SaveNew(path string) (io.WriteCloser, error) {
+	return e.save(path, saveNewOf(e.s))
+}
+
+func (e *EncryptSaveFetcher) save(fpath string, open func(string) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	if e.cleartext[path.Base(fpath)] {
+		return open(fpath)
+	}
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	w, err := open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(nonce); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &encryptWriteCloser{aead: e.aead, nonce: nonce, original: w}, nil
+}
+
+func (e *EncryptSaveFetcher) Fetch(fpath string) (io.ReadCloser, error) {
+	r, err := e.s.Fetch(fpath)
+	if err != nil || e.cleartext[path.Base(fpath)] {
+		return r, err
+	}
+	br := bufio.NewReader(r)
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := io.ReadFull(br, nonce); err != nil {
+		r.Close()
+		return nil, errors.New("Encrypted object is too short: " + fpath)
+	}
+	return &decryptReadCloser{
+		aead:     e.aead,
+		nonce:    nonce,
+		r:        br,
+		sealed:   make([]byte, encryptSegment+e.aead.Overhead()),
+		original: r,
+	}, nil
+}
+
+func (e *EncryptSaveFetcher) Walk(path string, walkfn WalkFunc) error {
+	w := e.s.(Walker)
+	return w.Walk(path, walkfn)
+}
+
+func (e *EncryptSaveFetcher) WalkIter(path string) Iterator {
+	w := e.s.(IterWalker)
+	return w.WalkIter(path)
+}
+
+func (e *EncryptSaveFetcher) WalkPrefixes(path string, walkfn WalkFunc) error {
+	w := e.s.(PrefixWalker)
+	return w.WalkPrefixes(path, walkfn)
+}
+
+func (e *EncryptSaveFetcher) Stat(path string) (ObjectInfo, error) {
+	return stat(e.s, path)
+}
+
+func (e *EncryptSaveFetcher) Delete(path string) error {
+	d := e.s.(Deleter)
+	return d.Delete(path)
+}
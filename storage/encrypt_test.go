@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestEncryptSaveFetcher(t *testing.T) {
+	Convey("Given an encrypting storage over the filesystem", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		key := bytes.Repeat([]byte{7}, 32)
+		store, err := NewEncryptSaveFetcher(Filesystem{dir}, key)
+		So(err, ShouldBeNil)
+		// Spans a few segments without ending on a boundary.
+		content := bytes.Repeat([]byte("0123456789abcdef"), 3*encryptSegment/16+100)
+		save := func(name string, content []byte) {
+			w, err := store.Save(name)
+			So(err, ShouldBeNil)
+			_, err = w.Write(content)
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+		}
+		fetch := func(store SaveFetcher, name string) ([]byte, error) {
+			r, err := store.Fetch(name)
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		}
+
+		Convey("Fetch should give back what was saved", func() {
+			save("dump/a.tar", content)
+			b, err := fetch(store, "dump/a.tar")
+			So(err, ShouldBeNil)
+			So(bytes.Equal(b, content), ShouldBeTrue)
+		})
+		Convey("Empty objects and exact segments should round trip as well", func() {
+			save("dump/empty", nil)
+			b, err := fetch(store, "dump/empty")
+			So(err, ShouldBeNil)
+			So(b, ShouldBeEmpty)
+			save("dump/segment", content[:encryptSegment])
+			b, err = fetch(store, "dump/segment")
+			So(err, ShouldBeNil)
+			So(bytes.Equal(b, content[:encryptSegment]), ShouldBeTrue)
+		})
+		Convey("The stored object should not contain the plaintext", func() {
+			save("dump/a.tar", content)
+			stored, err := ioutil.ReadFile(path.Join(dir, "dump/a.tar"))
+			So(err, ShouldBeNil)
+			So(bytes.Contains(stored, content[:64]), ShouldBeFalse)
+		})
+		Convey("Fetching with the wrong key should fail", func() {
+			save("dump/a.tar", content)
+			other, err := NewEncryptSaveFetcher(Filesystem{dir}, bytes.Repeat([]byte{8}, 32))
+			So(err, ShouldBeNil)
+			_, err = fetch(other, "dump/a.tar")
+			So(err, ShouldEqual, errDecrypt)
+		})
+		Convey("A tampered or truncated object should fail", func() {
+			save("dump/a.tar", content)
+			fpath := path.Join(dir, "dump/a.tar")
+			stored, err := ioutil.ReadFile(fpath)
+			So(err, ShouldBeNil)
+			stored[len(stored)/2] ^= 1
+			So(ioutil.WriteFile(fpath, stored, 0600), ShouldBeNil)
+			_, err = fetch(store, "dump/a.tar")
+			So(err, ShouldEqual, errDecrypt)
+
+			save("dump/a.tar", content)
+			stored, err = ioutil.ReadFile(fpath)
+			So(err, ShouldBeNil)
+			// Cut right after the second segment.
+			cut := 12 + 2*(encryptSegment+16)
+			So(ioutil.WriteFile(fpath, stored[:cut], 0600), ShouldBeNil)
+			_, err = fetch(store, "dump/a.tar")
+			So(err, ShouldEqual, errDecrypt)
+		})
+		Convey("A manifest named in cleartext should be readable without the key", func() {
+			store, err := NewEncryptSaveFetcher(Filesystem{dir}, key, ManifestFile)
+			So(err, ShouldBeNil)
+			manifest := NewManifestSaveFetcher(store)
+			manifest.Labels = map[string]string{"release": "v3"}
+			w, err := manifest.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write(content)
+			So(w.Close(), ShouldBeNil)
+			So(manifest.WriteManifest("dump"), ShouldBeNil)
+
+			m, err := ReadManifest(Filesystem{dir}, "dump")
+			So(err, ShouldBeNil)
+			So(m.Objects, ShouldHaveLength, 1)
+			So(m.Objects[0].Key, ShouldEqual, "a.tar")
+			So(m.Labels["release"], ShouldEqual, "v3")
+			m, err = ReadManifest(store, "dump")
+			So(err, ShouldBeNil)
+			So(m.Objects, ShouldHaveLength, 1)
+
+			stored, err := ioutil.ReadFile(path.Join(dir, "dump/a.tar"))
+			So(err, ShouldBeNil)
+			So(bytes.Contains(stored, content[:64]), ShouldBeFalse)
+			other, err := NewEncryptSaveFetcher(Filesystem{dir}, bytes.Repeat([]byte{8}, 32), ManifestFile)
+			So(err, ShouldBeNil)
+			_, err = fetch(other, "dump/a.tar")
+			So(err, ShouldEqual, errDecrypt)
+		})
+		Convey("A key of the wrong size should be refused", func() {
+			_, err := NewEncryptSaveFetcher(Filesystem{dir}, []byte("short"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+// ExclusiveSaveFetcher wraps another SaveFetcher so Save never replaces an existing object, every
+// Save goes to SaveNew of the wrapped storage and fails with ErrExists where an object already is.
+// Put below other decorators, it covers whatever they save, such as SHA256SUMS or MANIFEST.json.
+type ExclusiveSaveFetcher struct {
+	s SaveFetcher
+}
+
+// NewExclusiveSaveFetcher fails when s cannot refuse to overwrite objects.
+func NewExclusiveSaveFetcher(s SaveFetcher) (*ExclusiveSaveFetcher, error) {
+	if _, ok := s.(ExclusiveSaver); !ok {
+		return nil, errors.New("Storage cannot refuse to overwrite objects, it has no SaveNew")
+	}
+	return &ExclusiveSaveFetcher{s}, nil
+}
+
+func (e *ExclusiveSaveFetcher) Save(path string) (io.WriteCloser, error) {
+	return e.s.(ExclusiveSaver).SaveNew(path)
+}
+
+func (e *ExclusiveSaveFetcher) SaveNew(path string) (io.WriteCloser, error) {
+	return e.Save(path)
+}
+
+func (e *ExclusiveSaveFetcher) Fetch(path string) (io.ReadCloser, error) {
+	return e.s.Fetch(path)
+}
+
+func (e *ExclusiveSaveFetcher) Walk(path string, walkfn WalkFunc) error {
+	w := e.s.(Walker)
+	return w.Walk(path, walkfn)
+}
+
+func (e *ExclusiveSaveFetcher) WalkIter(path string) Iterator {
+	w := e.s.(IterWalker)
+	return w.WalkIter(path)
+}
+
+func (e *ExclusiveSaveFetcher) WalkPrefixes(path string, walkfn WalkFunc) error {
+	w := e.s.(PrefixWalker)
+	return w.WalkPrefixes(path, walkfn)
+}
+
+func (e *ExclusiveSaveFetcher) Stat(path string) (ObjectInfo, error) {
+	return stat(e.s, path)
+}
+
+func (e *ExclusiveSaveFetcher) Delete(path string) error {
+	d := e.s.(Deleter)
+	return d.Delete(path)
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestExclusiveSaveFetcher(t *testing.T) {
+	Convey("Given a dump on the filesystem", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		fs := Filesystem{dir}
+		w, err := fs.Save("dump/" + ChecksumFile)
+		So(err, ShouldBeNil)
+		w.Write([]byte("first"))
+		So(w.Close(), ShouldBeNil)
+		read := func() string {
+			b, _ := ioutil.ReadFile(path.Join(dir, "dump", ChecksumFile))
+			return string(b)
+		}
+
+		Convey("Saving below it should never replace an object, whatever the decorators above save", func() {
+			exclusive, err := NewExclusiveSaveFetcher(fs)
+			So(err, ShouldBeNil)
+			sums := NewChecksumSaveFetcher(exclusive)
+			w, err := NewGzipSaveFetcher(sums).Save("dump/a.tar.gz")
+			So(err, ShouldBeNil)
+			w.Write([]byte("chunk"))
+			So(w.Close(), ShouldBeNil)
+			So(sums.WriteSums("dump"), ShouldEqual, ErrExists)
+			So(read(), ShouldEqual, "first")
+
+			_, err = exclusive.Save("dump/a.tar.gz")
+			So(err, ShouldEqual, ErrExists)
+		})
+		Convey("SaveNew should be forwarded through the decorators", func() {
+			store := NewGzipSaveFetcher(NewChecksumSaveFetcher(fs))
+			_, err := store.(ExclusiveSaver).SaveNew("dump/" + ChecksumFile)
+			So(err, ShouldEqual, ErrExists)
+			w, err := store.(ExclusiveSaver).SaveNew("dump/b.tar.gz")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+		})
+		Convey("Save through the decorators should still overwrite", func() {
+			w, err := NewGzipSaveFetcher(fs).Save("dump/" + ChecksumFile)
+			So(err, ShouldBeNil)
+			w.Write([]byte("forced"))
+			So(w.Close(), ShouldBeNil)
+			So(read(), ShouldNotEqual, "first")
+		})
+		Convey("A storage without SaveNew should be refused", func() {
+			_, err := NewExclusiveSaveFetcher(&memStorage{objects: make(map[string][]byte)})
+			So(err, ShouldNotBeNil)
+			_, err = NewGzipSaveFetcher(&memStorage{objects: make(map[string][]byte)}).(ExclusiveSaver).SaveNew("dump/a.tar")
+			So(err, ShouldEqual, errCannotSaveNew)
+		})
+	})
+}
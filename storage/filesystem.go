@@ -1,11 +1,18 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
 // Filesystem implements the SaveFetcher for the traditional disk storage.
@@ -13,29 +20,406 @@ type Filesystem struct {
 	Root string
 }
 
+// Save writes to a hidden file next to fpath, which only replaces it once closed without error.
+// The writer has to be closed, one abandoned leaves its hidden file behind, which Walk skips.
 func (f Filesystem) Save(fpath string) (io.WriteCloser, error) {
 	fullpath := path.Join(f.Root, fpath)
 	if err := os.MkdirAll(path.Dir(fullpath), 0700); err != nil {
 		return nil, err
 	}
-	fd, err := os.Create(fullpath)
+	fd, err := createPartial(fullpath)
 	if err != nil {
 		return nil, err
 	}
-	return fd, err
+	return &atomicFile{fd: fd, path: fullpath}, nil
 }
 
+// partialInfix is in the names of files still being written, Walk skips them.
+const partialInfix = ".partial-"
+
+// createPartial creates a hidden file to write fullpath to. Unlike ioutil.TempFile it is created
+// with the 0666 of os.Create, so the umask gives files their usual mode.
+func createPartial(fullpath string) (*os.File, error) {
+	prefix := path.Join(path.Dir(fullpath), "."+path.Base(fullpath)+partialInfix)
+	for try := 0; ; try++ {
+		fd, err := os.OpenFile(prefix+strconv.FormatUint(uint64(rand.Uint32()), 10), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && try < 10000 {
+			continue
+		}
+		return fd, err
+	}
+}
+
+func isPartial(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, partialInfix)
+}
+
+// metadataSuffix ends the names of the hidden files holding the metadata of objects, Walk skips them.
+const metadataSuffix = ".meta"
+
+func metadataPath(fullpath string) string {
+	return path.Join(path.Dir(fullpath), "."+path.Base(fullpath)+metadataSuffix)
+}
+
+func isMetadata(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, metadataSuffix)
+}
+
+// SaveNew is like Save but fails with ErrExists when fpath exists, either already or by the time the
+// file is closed. The file is then linked into place, which never replaces another one. Where hard
+// links are not supported, an empty file is created at fpath first, failing if there is one, and
+// the file is renamed over it, so readers may find that empty file for a moment.
+func (f Filesystem) SaveNew(fpath string) (io.WriteCloser, error) {
+	if _, err := os.Lstat(path.Join(f.Root, fpath)); err == nil {
+		return nil, ErrExists
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	w, err := f.Save(fpath)
+	if err != nil {
+		return nil, err
+	}
+	w.(*atomicFile).exclusive = true
+	return w, nil
+}
+
+// SaveWithMetadata is like Save, metadata is stored as JSON in a hidden file next to the object
+// once it is in place. Saving the object again without metadata removes it.
+func (f Filesystem) SaveWithMetadata(fpath string, metadata map[string]string) (io.WriteCloser, error) {
+	w, err := f.Save(fpath)
+	if err != nil {
+		return nil, err
+	}
+	a := w.(*atomicFile)
+	a.metadata = make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		a.metadata[strings.ToLower(k)] = v
+	}
+	return a, nil
+}
+
+// atomicFile writes an object to a hidden file renamed into place once closed without error, so
+// readers never see a partial object and a failed write leaves the previous one intact.
+// The file is not embedded, io.Copy would otherwise write through its ReadFrom.
+type atomicFile struct {
+	fd   *os.File
+	path string
+	// ctx fails writes once it is done, nil never does.
+	ctx context.Context
+	// metadata is written next to the file once it is in place, nil removes what was there.
+	metadata map[string]string
+	// exclusive fails to close with ErrExists rather than replace an existing file.
+	exclusive bool
+	err       error
+}
+
+func (a *atomicFile) Write(p []byte) (int, error) {
+	if a.err != nil {
+		return 0, a.err
+	}
+	if a.ctx != nil && a.ctx.Err() != nil {
+		a.err = a.ctx.Err()
+		return 0, a.err
+	}
+	n, err := a.fd.Write(p)
+	if err != nil {
+		a.err = err
+	}
+	return n, err
+}
+
+// Close moves the file into place, or removes it when a write or the close itself failed.
+// A file replaced keeps its mode.
+func (a *atomicFile) Close() error {
+	err := a.fd.Close()
+	if a.err != nil {
+		err = a.err
+	}
+	if err == nil && a.ctx != nil {
+		err = a.ctx.Err()
+	}
+	if info, serr := os.Stat(a.path); err == nil && serr == nil && !a.exclusive {
+		err = os.Chmod(a.fd.Name(), info.Mode().Perm())
+	}
+	if err == nil && a.exclusive {
+		err = placeNew(a.fd.Name(), a.path)
+	} else if err == nil {
+		err = os.Rename(a.fd.Name(), a.path)
+	}
+	if err != nil {
+		os.Remove(a.fd.Name())
+		return err
+	}
+	if a.metadata == nil {
+		if err := os.Remove(metadataPath(a.path)); !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(a.metadata)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metadataPath(a.path), b, 0600)
+}
+
+// link is os.Link, replaced by tests to act like a filesystem without hard links.
+var link = os.Link
+
+// placeNew moves the file at partial to fullpath unless there is a file there already.
+func placeNew(partial, fullpath string) error {
+	err := link(partial, fullpath)
+	if lerr, ok := err.(*os.LinkError); ok && (lerr.Err == syscall.EPERM || lerr.Err == syscall.ENOTSUP || lerr.Err == syscall.EOPNOTSUPP) {
+		var placeholder *os.File
+		if placeholder, err = os.OpenFile(fullpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666); err == nil {
+			placeholder.Close()
+			if err = os.Rename(partial, fullpath); err != nil {
+				os.Remove(fullpath)
+			}
+		}
+	}
+	if os.IsExist(err) {
+		err = ErrExists
+	}
+	os.Remove(partial)
+	return err
+}
+
+// Walk calls wfunc with the key of every file below p, relative to Root as Save and Fetch take them.
+// A file or directory that cannot be read is passed on with its error, a p that does not exist has no keys.
 func (f Filesystem) Walk(p string, wfunc WalkFunc) error {
 	fullpath := path.Join(f.Root, p)
 	return filepath.Walk(fullpath, func(fpath string, info os.FileInfo, err error) error {
-		if info.IsDir() {
+		if err != nil && fpath == fullpath && os.IsNotExist(err) {
 			return nil
 		}
-		relative := strings.TrimPrefix(fpath, f.Root)
-		return wfunc(strings.TrimLeft(relative, "/"), err)
+		key := f.key(fpath)
+		if err != nil {
+			return wfunc(key, ObjectInfo{Key: key}, err)
+		}
+		if info.IsDir() || isPartial(info.Name()) || isMetadata(info.Name()) {
+			return nil
+		}
+		return wfunc(key, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil)
 	})
 }
 
+// key turns the path of a file below Root into its key.
+func (f Filesystem) key(fpath string) string {
+	if rel, err := filepath.Rel(path.Clean(f.Root), fpath); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return strings.TrimLeft(strings.TrimPrefix(fpath, f.Root), "/")
+}
+
+// WalkPrefixes calls wfunc with every directory right below p, named with a trailing slash like S3 common prefixes.
+func (f Filesystem) WalkPrefixes(p string, wfunc WalkFunc) error {
+	infos, err := ioutil.ReadDir(path.Join(f.Root, p))
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		key := strings.TrimLeft(path.Join(p, info.Name()), "/") + "/"
+		if err := wfunc(key, ObjectInfo{Key: key, ModTime: info.ModTime()}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (f Filesystem) Fetch(fpath string) (io.ReadCloser, error) {
 	return os.Open(path.Join(f.Root, fpath))
 }
+
+// Stat gives the size and modification time of fpath, ErrNotFound if there is no such file.
+func (f Filesystem) Stat(fpath string) (ObjectInfo, error) {
+	info, err := os.Stat(path.Join(f.Root, fpath))
+	if os.IsNotExist(err) || err == nil && info.IsDir() {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	metadata, err := readMetadata(path.Join(f.Root, fpath))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:      strings.TrimLeft(fpath, "/"),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Metadata: metadata,
+	}, nil
+}
+
+// readMetadata reads what the file was saved with by SaveWithMetadata, nil if it was not.
+func readMetadata(fullpath string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(metadataPath(fullpath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal(b, &metadata); err != nil {
+		return nil, errors.New("Malformed metadata of " + fullpath + ": " + err.Error())
+	}
+	return metadata, nil
+}
+
+// FetchRange reads length bytes of fpath from offset, or up to its end when length is negative.
+func (f Filesystem) FetchRange(fpath string, offset, length int64) (io.ReadCloser, error) {
+	fd, err := os.Open(path.Join(f.Root, fpath))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return fd, nil
+	}
+	return readCloser{io.LimitReader(fd, length), fd}, nil
+}
+
+// readCloser reads from one stream and closes another, such as part of a file and the whole of it.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Delete removes the file at fpath along with its metadata.
+func (f Filesystem) Delete(fpath string) error {
+	fullpath := path.Join(f.Root, fpath)
+	if err := os.Remove(fullpath); err != nil {
+		return err
+	}
+	if err := os.Remove(metadataPath(fullpath)); !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ctxFile fails reads of a file once its context is done.
+// The file is not embedded, io.Copy would otherwise go around Read through its WriteTo.
+type ctxFile struct {
+	fd  *os.File
+	ctx context.Context
+}
+
+func (c ctxFile) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.fd.Read(p)
+}
+
+func (c ctxFile) Close() error {
+	return c.fd.Close()
+}
+
+// SaveContext is like Save, writes and Close fail with ctx.Err() once ctx is done,
+// leaving what was stored at fpath before untouched.
+func (f Filesystem) SaveContext(ctx context.Context, fpath string) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	w, err := f.Save(fpath)
+	if err != nil {
+		return nil, err
+	}
+	w.(*atomicFile).ctx = ctx
+	return w, nil
+}
+
+// FetchContext is like Fetch, reads fail with ctx.Err() once ctx is done.
+func (f Filesystem) FetchContext(ctx context.Context, fpath string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fd, err := os.Open(path.Join(f.Root, fpath))
+	if err != nil {
+		return nil, err
+	}
+	return ctxFile{fd, ctx}, nil
+}
+
+// WalkContext is like Walk, stopping with ctx.Err() once ctx is done.
+func (f Filesystem) WalkContext(ctx context.Context, p string, wfunc WalkFunc) error {
+	return f.Walk(p, func(fpath string, info ObjectInfo, err error) error {
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		return wfunc(fpath, info, err)
+	})
+}
+
+var errIterClosed = errors.New("Iterator closed")
+
+// walkIterator receives keys from a Walk running in its own goroutine.
+type walkIterator struct {
+	keys   chan string
+	done   chan struct{}
+	closed bool
+	key    string
+	err    error
+}
+
+// WalkIter returns an Iterator over the same keys Walk would visit, reading the tree as it goes.
+func (f Filesystem) WalkIter(p string) Iterator {
+	return walkIter(f.Walk, p)
+}
+
+// walkIter turns walk into an Iterator over the keys it visits below p.
+func walkIter(walk func(string, WalkFunc) error, p string) Iterator {
+	it := &walkIterator{keys: make(chan string), done: make(chan struct{})}
+	go func() {
+		err := walk(p, func(fpath string, _ ObjectInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			select {
+			case it.keys <- fpath:
+				return nil
+			case <-it.done:
+				return errIterClosed
+			}
+		})
+		if err != errIterClosed {
+			it.err = err
+		}
+		close(it.keys)
+	}()
+	return it
+}
+
+func (it *walkIterator) Next() bool {
+	if it.closed {
+		return false
+	}
+	key, ok := <-it.keys
+	it.key = key
+	return ok
+}
+
+func (it *walkIterator) Key() string {
+	return it.key
+}
+
+// Err must only be called once Next has returned false.
+func (it *walkIterator) Err() error {
+	return it.err
+}
+
+func (it *walkIterator) Close() error {
+	if !it.closed {
+		it.closed = true
+		close(it.done)
+	}
+	return nil
+}
@@ -2,13 +2,16 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var root = os.Getenv("TestRoot")
@@ -44,9 +47,11 @@ func TestFilesystem(t *testing.T) {
 			So(walker, ShouldNotBeNil)
 			Convey("A request to get list of objects should succeed", func() {
 				total := 0
-				err := walker.Walk(path.Dir(relative), func(p string, err error) error {
+				err := walker.Walk(path.Dir(relative), func(p string, info ObjectInfo, err error) error {
 					So(err, ShouldBeNil)
 					So(p, ShouldEqual, relative)
+					So(info.Key, ShouldEqual, relative)
+					So(info.Size, ShouldEqual, 3)
 					total++
 					return err
 				})
@@ -80,3 +85,427 @@ func shouldExistInFilesystem(filename interface{}, _ ...interface{}) string {
 	}
 	return ""
 }
+
+func TestFilesystemWalkIter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given a few objects on the filesystem", t, func() {
+		store := Filesystem{dir}
+		for _, name := range []string{"dump/a", "dump/b", "dump/c"} {
+			w, err := store.Save(name)
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+		}
+		it := store.WalkIter("dump")
+
+		Convey("Iterating should visit all of them", func() {
+			var visited []string
+			for it.Next() {
+				visited = append(visited, it.Key())
+			}
+			So(it.Err(), ShouldBeNil)
+			So(visited, ShouldResemble, []string{"dump/a", "dump/b", "dump/c"})
+		})
+		Convey("Closing early should stop the iteration", func() {
+			So(it.Next(), ShouldBeTrue)
+			So(it.Close(), ShouldBeNil)
+			So(it.Next(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestFilesystemContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given an object on the filesystem and a context", t, func() {
+		store := Filesystem{dir}
+		ctx, cancel := context.WithCancel(context.Background())
+		w, err := store.SaveContext(ctx, "dump/a")
+		So(err, ShouldBeNil)
+		_, err = w.Write([]byte("foo"))
+		So(err, ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+
+		Convey("It should be read back while the context is alive", func() {
+			r, err := store.FetchContext(ctx, "dump/a")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "foo")
+		})
+		Convey("Cancelling should fail reads in progress", func() {
+			r, err := store.FetchContext(ctx, "dump/a")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			cancel()
+			_, err = io.Copy(ioutil.Discard, r)
+			So(err, ShouldEqual, context.Canceled)
+		})
+		Convey("Cancelling should fail writes in progress", func() {
+			w, err := store.SaveContext(ctx, "dump/b")
+			So(err, ShouldBeNil)
+			defer w.Close()
+			cancel()
+			_, err = w.Write([]byte("foo"))
+			So(err, ShouldEqual, context.Canceled)
+		})
+		Convey("Cancelling should stop a walk", func() {
+			cancel()
+			err := store.WalkContext(ctx, "dump", func(string, ObjectInfo, error) error { return nil })
+			So(err, ShouldEqual, context.Canceled)
+		})
+	})
+}
+
+func TestFilesystemDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given an object on the filesystem", t, func() {
+		store := Filesystem{dir}
+		w, err := store.Save("dump/a")
+		So(err, ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+
+		Convey("Deleting it should remove it", func() {
+			So(store.Delete("dump/a"), ShouldBeNil)
+			_, err := store.Fetch("dump/a")
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+		Convey("Deleting a missing object should fail", func() {
+			So(store.Delete("dump/missing"), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFilesystemWalkInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Walking the filesystem should tell the size and modification time of objects", t, func() {
+		store := Filesystem{dir}
+		w, err := store.Save("dump/a")
+		So(err, ShouldBeNil)
+		w.Write([]byte("foo"))
+		So(w.Close(), ShouldBeNil)
+		var infos []ObjectInfo
+		err = store.Walk("dump", func(fpath string, info ObjectInfo, err error) error {
+			infos = append(infos, info)
+			return err
+		})
+		So(err, ShouldBeNil)
+		So(infos, ShouldHaveLength, 1)
+		So(infos[0].Key, ShouldEqual, "dump/a")
+		So(infos[0].Size, ShouldEqual, 3)
+		So(time.Since(infos[0].ModTime), ShouldBeLessThan, time.Minute)
+	})
+}
+
+func TestFilesystemWalkPrefixes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given dumps stored below host/db/timestamp", t, func() {
+		store := Filesystem{dir}
+		for _, name := range []string{"host/db/1/a", "host/db/1/b", "host/db/2/a", "host/db/notes"} {
+			w, err := store.Save(name)
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+		}
+		var visited []string
+		walkfn := func(fpath string, _ ObjectInfo, err error) error {
+			visited = append(visited, fpath)
+			return err
+		}
+
+		Convey("WalkPrefixes should only visit the directories right below the path", func() {
+			So(store.WalkPrefixes("host/db", walkfn), ShouldBeNil)
+			So(visited, ShouldResemble, []string{"host/db/1/", "host/db/2/"})
+		})
+		Convey("WalkPrefixes without a path should give the top level", func() {
+			So(store.WalkPrefixes("", walkfn), ShouldBeNil)
+			So(visited, ShouldResemble, []string{"host/"})
+		})
+		Convey("WalkPrefixes on a missing path should fail", func() {
+			So(store.WalkPrefixes("missing", walkfn), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFilesystemStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given an object on the filesystem", t, func() {
+		store := Filesystem{dir}
+		w, err := store.Save("dump/a.tar")
+		So(err, ShouldBeNil)
+		w.Write([]byte("foo"))
+		So(w.Close(), ShouldBeNil)
+
+		Convey("Stat should tell its size and modification time", func() {
+			info, err := store.Stat("dump/a.tar")
+			So(err, ShouldBeNil)
+			So(info.Key, ShouldEqual, "dump/a.tar")
+			So(info.Size, ShouldEqual, 3)
+			So(time.Since(info.ModTime), ShouldBeLessThan, time.Minute)
+		})
+		Convey("Stat of a missing object or a directory should give ErrNotFound", func() {
+			_, err := store.Stat("dump/missing.tar")
+			So(err, ShouldEqual, ErrNotFound)
+			_, err = store.Stat("dump")
+			So(err, ShouldEqual, ErrNotFound)
+		})
+	})
+}
+
+func TestFilesystemAtomicSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given an object being saved on the filesystem", t, func() {
+		store := Filesystem{dir}
+		w, err := store.Save("dump/a.tar")
+		So(err, ShouldBeNil)
+		_, err = w.Write([]byte("new"))
+		So(err, ShouldBeNil)
+
+		Convey("Nothing should be visible until Close returns", func() {
+			_, err := store.Fetch("dump/a.tar")
+			So(os.IsNotExist(err), ShouldBeTrue)
+			var visited []string
+			So(store.Walk("dump", func(fpath string, _ ObjectInfo, err error) error {
+				visited = append(visited, fpath)
+				return err
+			}), ShouldBeNil)
+			So(visited, ShouldBeEmpty)
+
+			So(w.Close(), ShouldBeNil)
+			b, err := ioutil.ReadFile(path.Join(dir, "dump/a.tar"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "new")
+			infos, err := ioutil.ReadDir(path.Join(dir, "dump"))
+			So(err, ShouldBeNil)
+			So(infos, ShouldHaveLength, 1)
+		})
+		Convey("A failed save should leave the previous object and no partial file", func() {
+			So(w.Close(), ShouldBeNil)
+			ctx, cancel := context.WithCancel(context.Background())
+			w, err := store.SaveContext(ctx, "dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("half"))
+			cancel()
+			So(w.Close(), ShouldEqual, context.Canceled)
+			b, err := ioutil.ReadFile(path.Join(dir, "dump/a.tar"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "new")
+			infos, err := ioutil.ReadDir(path.Join(dir, "dump"))
+			So(err, ShouldBeNil)
+			So(infos, ShouldHaveLength, 1)
+		})
+		Convey("A new file should get the mode os.Create gives, a replaced one should keep its own", func() {
+			So(w.Close(), ShouldBeNil)
+			created, err := os.Create(path.Join(dir, "created"))
+			So(err, ShouldBeNil)
+			created.Close()
+			want, err := os.Stat(path.Join(dir, "created"))
+			So(err, ShouldBeNil)
+			info, err := os.Stat(path.Join(dir, "dump/a.tar"))
+			So(err, ShouldBeNil)
+			So(info.Mode(), ShouldEqual, want.Mode())
+
+			So(os.Chmod(path.Join(dir, "dump/a.tar"), 0640), ShouldBeNil)
+			w, err := store.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			info, err = os.Stat(path.Join(dir, "dump/a.tar"))
+			So(err, ShouldBeNil)
+			So(info.Mode(), ShouldEqual, os.FileMode(0640))
+		})
+	})
+}
+
+func TestFilesystemMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given an object saved with metadata", t, func() {
+		store := Filesystem{dir}
+		w, err := store.SaveWithMetadata("dump/a.tar", map[string]string{"Host": "db1:27017"})
+		So(err, ShouldBeNil)
+		w.Write([]byte("foo"))
+		So(w.Close(), ShouldBeNil)
+
+		Convey("Stat should read the metadata back", func() {
+			info, err := store.Stat("dump/a.tar")
+			So(err, ShouldBeNil)
+			So(info.Metadata, ShouldResemble, map[string]string{"host": "db1:27017"})
+		})
+		Convey("Walk should not list where the metadata is kept", func() {
+			var keys []string
+			store.Walk("dump", func(fpath string, _ ObjectInfo, err error) error {
+				keys = append(keys, fpath)
+				return err
+			})
+			So(keys, ShouldResemble, []string{"dump/a.tar"})
+		})
+		Convey("Saving the object again without metadata should drop it", func() {
+			w, err := store.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			info, err := store.Stat("dump/a.tar")
+			So(err, ShouldBeNil)
+			So(info.Metadata, ShouldBeNil)
+		})
+		Convey("Delete should remove the metadata along with the object", func() {
+			So(store.Delete("dump/a.tar"), ShouldBeNil)
+			files, err := ioutil.ReadDir(path.Join(dir, "dump"))
+			So(err, ShouldBeNil)
+			So(files, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestFilesystemSaveNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given an object on the filesystem", t, func() {
+		store := Filesystem{dir}
+		w, err := store.Save("dump/a.tar")
+		So(err, ShouldBeNil)
+		w.Write([]byte("first"))
+		So(w.Close(), ShouldBeNil)
+		read := func() string {
+			b, _ := ioutil.ReadFile(path.Join(dir, "dump/a.tar"))
+			return string(b)
+		}
+
+		Convey("SaveNew should refuse to overwrite it", func() {
+			_, err := store.SaveNew("dump/a.tar")
+			So(err, ShouldEqual, ErrExists)
+			So(read(), ShouldEqual, "first")
+		})
+		Convey("SaveNew should refuse an object stored while it was being written", func() {
+			So(store.Delete("dump/a.tar"), ShouldBeNil)
+			w, err := store.SaveNew("dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("second"))
+			other, err := store.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			other.Write([]byte("third"))
+			So(other.Close(), ShouldBeNil)
+			So(w.Close(), ShouldEqual, ErrExists)
+			So(read(), ShouldEqual, "third")
+			files, _ := ioutil.ReadDir(path.Join(dir, "dump"))
+			So(files, ShouldHaveLength, 1)
+		})
+		Convey("SaveNew should store a new object", func() {
+			w, err := store.SaveNew("dump/b.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("new"))
+			So(w.Close(), ShouldBeNil)
+			b, err := ioutil.ReadFile(path.Join(dir, "dump/b.tar"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "new")
+		})
+		Convey("Save should still overwrite it", func() {
+			w, err := store.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("forced"))
+			So(w.Close(), ShouldBeNil)
+			So(read(), ShouldEqual, "forced")
+		})
+		Convey("Without hard links SaveNew should still store new objects and refuse existing ones", func() {
+			link = func(oldname, newname string) error {
+				return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+			}
+			defer func() { link = os.Link }()
+			w, err := store.SaveNew("dump/c.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("new"))
+			other, err := store.SaveNew("dump/a.tar")
+			So(err, ShouldEqual, ErrExists)
+			So(w.Close(), ShouldBeNil)
+			b, err := ioutil.ReadFile(path.Join(dir, "dump/c.tar"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "new")
+
+			So(store.Delete("dump/a.tar"), ShouldBeNil)
+			other, err = store.SaveNew("dump/a.tar")
+			So(err, ShouldBeNil)
+			w, err = store.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(other.Close(), ShouldEqual, ErrExists)
+			files, _ := ioutil.ReadDir(path.Join(dir, "dump"))
+			So(files, ShouldHaveLength, 3)
+		})
+	})
+}
+
+func TestFilesystemWalkRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given a filesystem rooted at a path ending with a slash", t, func() {
+		store := Filesystem{dir + "/"}
+		w, err := store.Save("dump/db/a.tar")
+		So(err, ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+		walk := func(p string) ([]string, error) {
+			var keys []string
+			err := store.Walk(p, func(fpath string, _ ObjectInfo, err error) error {
+				keys = append(keys, fpath)
+				return err
+			})
+			return keys, err
+		}
+
+		Convey("Walk should yield the keys Save and Fetch take", func() {
+			keys, err := walk("dump")
+			So(err, ShouldBeNil)
+			So(keys, ShouldResemble, []string{"dump/db/a.tar"})
+			_, err = store.Fetch(keys[0])
+			So(err, ShouldBeNil)
+		})
+		Convey("Walk of a prefix that does not exist should yield nothing", func() {
+			keys, err := walk("missing")
+			So(err, ShouldBeNil)
+			So(keys, ShouldBeEmpty)
+		})
+	})
+}
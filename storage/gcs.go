@@ -0,0 +1,597 @@
+package storage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsScope is the OAuth scope asked for, enough to read, write and delete objects.
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// GCSChunkAlign is what the chunks of a resumable upload have to be a multiple of.
+const GCSChunkAlign = 256 * KB
+
+// serviceAccount holds the fields of a service account JSON key needed to get access tokens.
+type serviceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// gcsTokens hands out OAuth access tokens of a service account, getting a new one before the last expires.
+type gcsTokens struct {
+	account serviceAccount
+	key     *rsa.PrivateKey
+	client  *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newGCSTokens(keyJSON []byte, client *http.Client) (*gcsTokens, error) {
+	var a serviceAccount
+	if err := json.Unmarshal(keyJSON, &a); err != nil {
+		return nil, errors.New("Invalid service account key: " + err.Error())
+	}
+	if a.ClientEmail == "" || a.PrivateKey == "" {
+		return nil, errors.New("Service account key is missing client_email or private_key")
+	}
+	if a.TokenURI == "" {
+		a.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(a.PrivateKey))
+	if block == nil {
+		return nil, errors.New("Service account private_key is not PEM encoded")
+	}
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("Service account private_key is not an RSA key")
+		}
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return nil, errors.New("Invalid service account private_key: " + err.Error())
+	}
+	return &gcsTokens{account: a, key: key, client: client}, nil
+}
+
+// Token returns an access token, valid for at least another minute.
+func (t *gcsTokens) Token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Now().Add(time.Minute).Before(t.expires) {
+		return t.token, nil
+	}
+	assertion, err := t.assertion(time.Now())
+	if err != nil {
+		return "", err
+	}
+	resp, err := t.client.PostForm(t.account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil {
+		return "", err
+	}
+	if code := resp.StatusCode; code != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("Could not get an access token for %s: %d\n%s", t.account.ClientEmail, code, string(body)))
+	}
+	result := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	t.token = result.AccessToken
+	t.expires = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return t.token, nil
+}
+
+// assertion is the JWT signed with the service account key that is exchanged for an access token.
+func (t *gcsTokens) assertion(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": t.account.PrivateKeyId})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   t.account.ClientEmail,
+		"scope": gcsScope,
+		"aud":   t.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, t.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// GCS implements the SaveFetcher for a Google Cloud Storage bucket, authenticating as a service account.
+type GCS struct {
+	// Bucket is the name of the bucket.
+	Bucket string
+	// Endpoint serves the JSON API, https://storage.googleapis.com unless pointed elsewhere.
+	Endpoint string
+	// ChunkSize switches an upload to a resumable one once it grows past this size, so large chunks
+	// are sent as they are written instead of being held in memory. It must be a multiple of GCSChunkAlign.
+	ChunkSize ByteSize
+	tokens    *gcsTokens
+	client    *http.Client
+}
+
+// NewGCS gives the bucket named bucket, key is the JSON key of the service account to use.
+func NewGCS(bucket string, key []byte) (*GCS, error) {
+	client := &http.Client{}
+	tokens, err := newGCSTokens(key, client)
+	if err != nil {
+		return nil, err
+	}
+	return &GCS{
+		Bucket:    bucket,
+		Endpoint:  "https://storage.googleapis.com",
+		ChunkSize: 8 * MB,
+		tokens:    tokens,
+		client:    client,
+	}, nil
+}
+
+// gcsName is the object name of path, which like S3 keys has no leading slash.
+func gcsName(path string) string {
+	return strings.TrimLeft(path, "/")
+}
+
+// request builds a request carrying an access token.
+func (g GCS) request(method, rawurl string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, rawurl, body)
+	if err != nil {
+		return nil, err
+	}
+	token, err := g.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
+
+func (g GCS) objectURL(name string) string {
+	return g.Endpoint + "/storage/v1/b/" + url.PathEscape(g.Bucket) + "/o/" + url.PathEscape(name)
+}
+
+func (g GCS) uploadURL(uploadType, name string) string {
+	return g.Endpoint + "/upload/storage/v1/b/" + url.PathEscape(g.Bucket) + "/o?uploadType=" + uploadType + "&name=" + url.QueryEscape(name)
+}
+
+func (g GCS) Save(path string) (io.WriteCloser, error) {
+	if g.ChunkSize%GCSChunkAlign != 0 {
+		return nil, errors.New(fmt.Sprintf("GCS chunk size must be a multiple of %d bytes", GCSChunkAlign))
+	}
+	return &gcsFileWriter{name: gcsName(path), g: g, chunkSize: int(g.ChunkSize)}, nil
+}
+
+// SaveNew is like Save but fails with ErrExists when an object exists at path. The upload is
+// conditional on there being no object, so one stored meanwhile by someone else is not replaced either.
+func (g GCS) SaveNew(path string) (io.WriteCloser, error) {
+	w, err := g.Save(path)
+	if err != nil {
+		return nil, err
+	}
+	w.(*gcsFileWriter).exclusive = true
+	return w, nil
+}
+
+func (g GCS) Fetch(path string) (io.ReadCloser, error) {
+	req, err := g.request("GET", g.objectURL(gcsName(path))+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		drain(resp.Body)
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, parseGCSError(resp, "Fetching "+path)
+	}
+	return &httpBody{ReadCloser: resp.Body, length: resp.ContentLength}, nil
+}
+
+// Stat asks GCS for the size, last modification and metadata of the object at path,
+// ErrNotFound if there is no such object.
+func (g GCS) Stat(path string) (ObjectInfo, error) {
+	name := gcsName(path)
+	req, err := g.request("GET", g.objectURL(name)+"?fields=name,size,updated,metadata", nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	switch code := resp.StatusCode; code {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ObjectInfo{}, ErrNotFound
+	default:
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return ObjectInfo{}, parseGCSError(resp, "Stating "+path)
+	}
+	var object struct {
+		gcsObject
+		Metadata map[string]string `json:"metadata"`
+	}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return ObjectInfo{}, errors.New("Invalid metadata for " + path + ": " + err.Error())
+	}
+	var metadata map[string]string
+	for k, v := range object.Metadata {
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[strings.ToLower(k)] = v
+	}
+	return ObjectInfo{Key: name, Size: object.Size, ModTime: object.Updated, Metadata: metadata}, nil
+}
+
+// gcsObject is an object in a listing, GCS gives its size as a string.
+type gcsObject struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size,string"`
+	Updated time.Time `json:"updated"`
+}
+
+// gcsList is one page of an object listing.
+type gcsList struct {
+	Items         []gcsObject `json:"items"`
+	Prefixes      []string    `json:"prefixes"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+func (g GCS) Walk(p string, walkfn WalkFunc) error {
+	// An empty prefix lists the whole bucket.
+	p = gcsName(p)
+	if p != "" && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	token := ""
+	for {
+		page, err := g.listPage(p, token, "")
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			if err := walkfn(item.Name, ObjectInfo{Key: item.Name, Size: item.Size, ModTime: item.Updated}, nil); err != nil {
+				return err
+			}
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		token = page.NextPageToken
+	}
+}
+
+// WalkPrefixes calls walkfn with every prefix one level below p, the way folders are listed.
+// The prefixes end with a slash.
+func (g GCS) WalkPrefixes(p string, walkfn WalkFunc) error {
+	p = gcsName(p)
+	if p != "" && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	token := ""
+	for {
+		page, err := g.listPage(p, token, "/")
+		if err != nil {
+			return err
+		}
+		for _, prefix := range page.Prefixes {
+			if err := walkfn(prefix, ObjectInfo{Key: prefix}, nil); err != nil {
+				return err
+			}
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		token = page.NextPageToken
+	}
+}
+
+// listPage fetches the listing of objects below prefix from where the page named by token begins.
+// Given a delimiter, objects sharing a prefix up to it are only listed once in Prefixes.
+func (g GCS) listPage(prefix, token, delimiter string) (*gcsList, error) {
+	params := url.Values{"fields": {"items(name,size,updated),prefixes,nextPageToken"}}
+	if prefix != "" {
+		params.Set("prefix", prefix)
+	}
+	if delimiter != "" {
+		params.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		params.Set("pageToken", token)
+	}
+	req, err := g.request("GET", g.Endpoint+"/storage/v1/b/"+url.PathEscape(g.Bucket)+"/o?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return nil, parseGCSError(resp, "Listing "+g.Bucket+"/"+prefix)
+	}
+	page := &gcsList{}
+	if err := json.Unmarshal(body, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (g GCS) WalkIter(p string) Iterator {
+	return walkIter(g.Walk, p)
+}
+
+// Delete removes the object at path from the bucket.
+func (g GCS) Delete(path string) error {
+	req, err := g.request("DELETE", g.objectURL(gcsName(path)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if code := resp.StatusCode; code == http.StatusOK || code == http.StatusNoContent {
+		return nil
+	}
+	e := parseGCSError(resp, "Deleting "+path)
+	if e.StatusCode == http.StatusForbidden {
+		e.hint = "Check the service account may delete objects"
+	}
+	return e
+}
+
+// gcsFileWriter buffers written data for one object, sending it in one request when it is small
+// or in chunks of a resumable upload once it grows past the chunk size.
+type gcsFileWriter struct {
+	buf       bytes.Buffer
+	name      string
+	g         GCS
+	chunkSize int
+	// session is where the chunks of a resumable upload are sent, empty until it is started.
+	session string
+	sent    int64
+	err     error
+	closed  bool
+	// exclusive only stores the object where there is none yet, see SaveNew.
+	exclusive bool
+}
+
+// uploadURL is where the upload of the object starts, with the precondition of SaveNew if it has one.
+func (w *gcsFileWriter) uploadURL(uploadType string) string {
+	u := w.g.uploadURL(uploadType, w.name)
+	if w.exclusive {
+		u += "&ifGenerationMatch=0"
+	}
+	return u
+}
+
+// Write buffers p, sending a chunk whenever a full one has been buffered.
+func (w *gcsFileWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, _ := w.buf.Write(p)
+	for w.chunkSize > 0 && w.buf.Len() >= w.chunkSize {
+		if err := w.sendChunk(w.buf.Next(w.chunkSize), false); err != nil {
+			w.fail(err)
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close sends what is left in the buffer, finishing the resumable upload if one was started.
+func (w *gcsFileWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+	if w.session != "" {
+		if err := w.sendChunk(w.buf.Bytes(), true); err != nil {
+			w.fail(err)
+			return err
+		}
+		return nil
+	}
+	req, err := w.g.request("POST", w.uploadURL("media"), bytes.NewReader(w.buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := w.g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return ErrExists
+	}
+	if resp.StatusCode != http.StatusOK {
+		return parseGCSError(resp, "Uploading "+w.name)
+	}
+	return nil
+}
+
+// start begins the resumable upload of the object.
+func (w *gcsFileWriter) start() error {
+	req, err := w.g.request("POST", w.uploadURL("resumable"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return ErrExists
+	}
+	if resp.StatusCode != http.StatusOK {
+		return parseGCSError(resp, "Starting resumable upload of "+w.name)
+	}
+	if w.session = resp.Header.Get("Location"); w.session == "" {
+		return errors.New("No session URI in response to starting resumable upload of " + w.name)
+	}
+	return nil
+}
+
+// sendChunk sends p as the next chunk of the resumable upload, starting it first if needed.
+// The last chunk carries the size of the whole object, which lets GCS finish the upload.
+// When GCS persisted only part of a chunk, the rest is sent again, failing once it persisted
+// nothing more maxStalls times in a row.
+func (w *gcsFileWriter) sendChunk(p []byte, last bool) error {
+	if w.session == "" {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	total := "*"
+	if last {
+		total = strconv.FormatInt(w.sent+int64(len(p)), 10)
+	}
+	for stalls := 0; ; {
+		contentRange := "bytes */" + total
+		if len(p) > 0 {
+			contentRange = fmt.Sprintf("bytes %d-%d/%s", w.sent, w.sent+int64(len(p))-1, total)
+		}
+		done, persisted, err := w.putChunk(p, contentRange, last)
+		if err != nil || done {
+			return err
+		}
+		if persisted < w.sent || persisted > w.sent+int64(len(p)) {
+			return errors.New(fmt.Sprintf("GCS persisted %d bytes of %s after %s was sent", persisted, w.name, contentRange))
+		}
+		if persisted > w.sent {
+			stalls = 0
+		} else if stalls++; stalls >= maxStalls {
+			return errors.New(fmt.Sprintf("GCS persisted nothing more of %s after %s was sent", w.name, contentRange))
+		}
+		p = p[persisted-w.sent:]
+		w.sent = persisted
+		if !last && len(p) == 0 {
+			return nil
+		}
+	}
+}
+
+// putChunk sends p as the bytes of contentRange. It tells if GCS stored the object, which only
+// the last chunk does, or else how many bytes of the upload GCS persisted so far.
+func (w *gcsFileWriter) putChunk(p []byte, contentRange string, last bool) (done bool, persisted int64, err error) {
+	req, err := w.g.request("PUT", w.session, bytes.NewReader(p))
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Content-Range", contentRange)
+	resp, err := w.g.client.Do(req)
+	if err != nil {
+		return false, 0, err
+	}
+	defer resp.Body.Close()
+	// GCS answers 308 to every chunk but the last, which gets 200 or 201 once the object is stored.
+	code := resp.StatusCode
+	if last && code == http.StatusPreconditionFailed {
+		return false, 0, ErrExists
+	}
+	if last && (code == http.StatusOK || code == http.StatusCreated) {
+		w.sent += int64(len(p))
+		return true, w.sent, nil
+	}
+	if code != http.StatusPermanentRedirect {
+		return false, 0, parseGCSError(resp, "Sending "+contentRange+" of "+w.name)
+	}
+	persisted, err = persistedRange(resp)
+	return false, persisted, err
+}
+
+// maxStalls is how many times sendChunk sends a chunk GCS persists none of.
+const maxStalls = 3
+
+// persistedRange returns how many bytes of a resumable upload GCS persisted, from the Range header
+// of a 308 response. There is none until the first byte is.
+func persistedRange(resp *http.Response) (int64, error) {
+	header := resp.Header.Get("Range")
+	if header == "" {
+		return 0, nil
+	}
+	var first, end int64
+	if _, err := fmt.Sscanf(header, "bytes=%d-%d", &first, &end); err != nil || first != 0 {
+		return 0, errors.New("Malformed Range in response to a resumable upload: " + header)
+	}
+	return end + 1, nil
+}
+
+// fail remembers err and cancels the resumable upload, so nothing is left half written.
+func (w *gcsFileWriter) fail(err error) {
+	w.err = err
+	if w.session == "" {
+		return
+	}
+	if req, rerr := w.g.request("DELETE", w.session, nil); rerr == nil {
+		if resp, rerr := w.g.client.Do(req); rerr == nil {
+			resp.Body.Close()
+		}
+	}
+	w.session = ""
+}
@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gcsServer is a fake GCS JSON API keeping just enough state for uploads, listings and deletes.
+type gcsServer struct {
+	mu       sync.Mutex
+	url      string
+	objects  map[string][]byte
+	session  []byte
+	requests []string
+	tokens   int
+	// drop has the next chunk persisted short of its last drop bytes, as GCS may, stall has
+	// none of any chunk persisted.
+	drop  int
+	stall bool
+}
+
+func (g *gcsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.URL.Path == "/token" {
+		g.tokens++
+		form, _ := url.ParseQuery(string(body))
+		if len(strings.Split(form.Get("assertion"), ".")) != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "tok", "expires_in": 3600, "token_type": "Bearer"}`)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer tok" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	object := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")
+	switch {
+	case r.Method == "POST" && q.Get("uploadType") == "media":
+		g.requests = append(g.requests, "upload")
+		if _, ok := g.objects[q.Get("name")]; ok && q.Get("ifGenerationMatch") == "0" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		g.objects[q.Get("name")] = body
+	case r.Method == "POST" && q.Get("uploadType") == "resumable":
+		g.requests = append(g.requests, "start")
+		g.session = nil
+		w.Header().Set("Location", g.url+"/session?name="+q.Get("name"))
+	case r.Method == "PUT" && r.URL.Path == "/session":
+		contentRange := r.Header.Get("Content-Range")
+		g.requests = append(g.requests, contentRange)
+		var start int
+		if _, err := fmt.Sscanf(contentRange, "bytes %d-", &start); err == nil {
+			if start > len(g.session) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !g.stall {
+				g.session = append(g.session[:start], body...)
+			}
+		}
+		if strings.HasSuffix(contentRange, "/*") {
+			if g.drop > 0 {
+				g.session = g.session[:len(g.session)-g.drop]
+				g.drop = 0
+			}
+			if len(g.session) > 0 {
+				w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(g.session)-1))
+			}
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		total, _ := strconv.Atoi(contentRange[strings.LastIndex(contentRange, "/")+1:])
+		if total != len(g.session) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		g.objects[q.Get("name")] = g.session
+	case r.Method == "DELETE" && r.URL.Path == "/session":
+		g.requests = append(g.requests, "cancel")
+		w.WriteHeader(499)
+	case r.Method == "GET" && r.URL.Path == "/storage/v1/b/bucket/o":
+		prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+		var names []string
+		seen := make(map[string]bool)
+		for name := range g.objects {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if i := strings.Index(name[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				name = name[:len(prefix)+i+len(delimiter)]
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		start, _ := strconv.Atoi(q.Get("pageToken"))
+		page := gcsList{}
+		for n := start; n < len(names) && n < start+2; n++ {
+			if delimiter != "" && strings.HasSuffix(names[n], delimiter) {
+				page.Prefixes = append(page.Prefixes, names[n])
+				continue
+			}
+			page.Items = append(page.Items, gcsObject{names[n], int64(len(g.objects[names[n]])), time.Now()})
+		}
+		if start+2 < len(names) {
+			page.NextPageToken = strconv.Itoa(start + 2)
+		}
+		g.requests = append(g.requests, "list")
+		json.NewEncoder(w).Encode(page)
+	case r.Method == "GET" && q.Get("alt") == "media":
+		b, ok := g.objects[object]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	case r.Method == "GET" && object != r.URL.Path:
+		b, ok := g.objects[object]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		g.requests = append(g.requests, "stat")
+		fmt.Fprintf(w, `{"name": %q, "size": "%d", "updated": "2014-06-01T12:00:00Z", "metadata": {"Host": "db1"}}`, object, len(b))
+	case r.Method == "DELETE" && object == "dump/forbidden":
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error": {"code": 403, "message": "No delete access", "errors": [{"reason": "forbidden"}]}}`)
+	case r.Method == "DELETE":
+		if _, ok := g.objects[object]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(g.objects, object)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// testServiceAccount makes a service account key getting its tokens from tokenURI.
+func testServiceAccount(tokenURI string) ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "mongotool@example.iam.gserviceaccount.com",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      tokenURI,
+	})
+}
+
+func TestGCS(t *testing.T) {
+	fake := &gcsServer{}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	fake.url = ts.URL
+	key, err := testServiceAccount(ts.URL + "/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given a GCS bucket sending chunks of 256 KB", t, func() {
+		fake.objects = make(map[string][]byte)
+		fake.requests = nil
+		fake.drop, fake.stall = 0, false
+		fake.tokens = 0
+		g, err := NewGCS("bucket", key)
+		So(err, ShouldBeNil)
+		g.Endpoint = ts.URL
+		g.ChunkSize = GCSChunkAlign
+
+		Convey("A small object should be uploaded in one request and fetched back", func() {
+			w, err := g.Save("/dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{"upload"})
+
+			r, err := g.Fetch("/dump/a.tar")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "foo")
+			So(fake.tokens, ShouldEqual, 1)
+		})
+		Convey("SaveNew should store a new object and refuse to replace it", func() {
+			w, err := g.SaveNew("dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldBeNil)
+			w, err = g.SaveNew("dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("bar"))
+			So(w.Close(), ShouldEqual, ErrExists)
+			So(string(fake.objects["dump/a.tar"]), ShouldEqual, "foo")
+		})
+		Convey("A large object should be sent in chunks of a resumable upload", func() {
+			content := bytes.Repeat([]byte("0123456789abcdef"), 16*1024*5/2)
+			w, err := g.Save("dump/large.tar")
+			So(err, ShouldBeNil)
+			for n := 0; n < len(content); n += 100000 {
+				end := n + 100000
+				if end > len(content) {
+					end = len(content)
+				}
+				_, err := w.Write(content[n:end])
+				So(err, ShouldBeNil)
+			}
+			So(w.Close(), ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{
+				"start", "bytes 0-262143/*", "bytes 262144-524287/*", "bytes 524288-655359/655360",
+			})
+			So(bytes.Equal(fake.objects["dump/large.tar"], content), ShouldBeTrue)
+		})
+		Convey("The part of a chunk GCS did not persist should be sent again", func() {
+			content := bytes.Repeat([]byte("0123456789abcdef"), 16*1024*5/2)
+			g.ChunkSize = 2 * GCSChunkAlign
+			fake.drop = int(GCSChunkAlign)
+			w, err := g.Save("dump/large.tar")
+			So(err, ShouldBeNil)
+			w.Write(content)
+			So(w.Close(), ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{
+				"start", "bytes 0-524287/*", "bytes 262144-524287/*", "bytes 524288-655359/655360",
+			})
+			So(bytes.Equal(fake.objects["dump/large.tar"], content), ShouldBeTrue)
+		})
+		Convey("A chunk GCS keeps persisting none of should fail the upload", func() {
+			fake.stall = true
+			w, err := g.Save("dump/large.tar")
+			So(err, ShouldBeNil)
+			_, err = w.Write(make([]byte, GCSChunkAlign))
+			So(err, ShouldNotBeNil)
+			So(w.Close(), ShouldNotBeNil)
+			So(fake.requests, ShouldResemble, []string{
+				"start", "bytes 0-262143/*", "bytes 0-262143/*", "bytes 0-262143/*", "cancel",
+			})
+			So(fake.objects, ShouldBeEmpty)
+		})
+		Convey("An object of whole chunks should be finished with an empty chunk", func() {
+			w, err := g.Save("dump/even.tar")
+			So(err, ShouldBeNil)
+			w.Write(make([]byte, 2*GCSChunkAlign))
+			So(w.Close(), ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{
+				"start", "bytes 0-262143/*", "bytes 262144-524287/*", "bytes */524288",
+			})
+			So(fake.objects["dump/even.tar"], ShouldHaveLength, 2*GCSChunkAlign)
+		})
+		Convey("A chunk size not aligned to 256 KB should be refused", func() {
+			g.ChunkSize = 100 * KB
+			_, err := g.Save("dump/a.tar")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Walk should visit every object below the prefix across pages", func() {
+			for _, name := range []string{"dump/a", "dump/b", "dump/c", "dump/d", "dump/e", "other/f"} {
+				fake.objects[name] = []byte("x")
+			}
+			var visited []string
+			err := g.Walk("/dump", func(fpath string, info ObjectInfo, err error) error {
+				visited = append(visited, fpath)
+				So(info.Size, ShouldEqual, 1)
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(visited, ShouldResemble, []string{"dump/a", "dump/b", "dump/c", "dump/d", "dump/e"})
+			So(fake.requests, ShouldResemble, []string{"list", "list", "list"})
+		})
+		Convey("WalkPrefixes should visit each folder below the prefix once across pages", func() {
+			for _, name := range []string{"host/db/1/a", "host/db/1/b", "host/db/2/a", "host/db/3/a", "host/db/notes"} {
+				fake.objects[name] = []byte("x")
+			}
+			var visited []string
+			err := g.WalkPrefixes("host/db", func(fpath string, _ ObjectInfo, err error) error {
+				visited = append(visited, fpath)
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(visited, ShouldResemble, []string{"host/db/1/", "host/db/2/", "host/db/3/"})
+			So(fake.requests, ShouldResemble, []string{"list", "list"})
+		})
+		Convey("Delete should remove an object and fail on a missing one", func() {
+			fake.objects["dump/a"] = []byte("x")
+			So(g.Delete("dump/a"), ShouldBeNil)
+			So(fake.objects, ShouldBeEmpty)
+			err := g.Delete("dump/a")
+			So(err, ShouldNotBeNil)
+			So(IsNotFound(err), ShouldBeTrue)
+		})
+		Convey("Errors should be structured, so the helpers shared with S3 tell them apart", func() {
+			err := g.Delete("dump/forbidden")
+			So(IsAccessDenied(err), ShouldBeTrue)
+			So(IsNotFound(err), ShouldBeFalse)
+			So(err.(*GCSError).Reason, ShouldEqual, "forbidden")
+			So(err.Error(), ShouldEqual, "Deleting dump/forbidden: Unexpected status code: 403 forbidden: No delete access. Check the service account may delete objects")
+			So(IsThrottled(&GCSError{StatusCode: http.StatusTooManyRequests}), ShouldBeTrue)
+		})
+		Convey("Stat should tell the size and metadata of an object without fetching it", func() {
+			fake.objects["dump/a.tar"] = []byte("foo")
+			info, err := g.Stat("/dump/a.tar")
+			So(err, ShouldBeNil)
+			So(info.Key, ShouldEqual, "dump/a.tar")
+			So(info.Size, ShouldEqual, 3)
+			So(info.ModTime.Equal(time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)), ShouldBeTrue)
+			So(info.Metadata, ShouldResemble, map[string]string{"host": "db1"})
+			So(fake.requests, ShouldResemble, []string{"stat"})
+
+			_, err = g.Stat("dump/missing")
+			So(err, ShouldEqual, ErrNotFound)
+		})
+		Convey("Fetching a missing object should fail with ErrNotFound", func() {
+			_, err := g.Fetch("dump/missing")
+			So(err, ShouldEqual, ErrNotFound)
+		})
+	})
+	Convey("A key without a private key should be refused", t, func() {
+		_, err := NewGCS("bucket", []byte(`{"client_email": "mongotool@example.iam.gserviceaccount.com"}`))
+		So(err, ShouldNotBeNil)
+	})
+}
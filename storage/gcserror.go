@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// GCSError is an error answered by GCS, with the reason and message of its JSON error document when
+// it had one, so the same IsNotFound, IsAccessDenied and IsThrottled as for S3 tell what went wrong.
+type GCSError struct {
+	StatusCode int
+	Reason     string
+	Message    string
+	// op tells what was being done, hint what to do about it.
+	op   string
+	hint string
+}
+
+func (e *GCSError) Error() string {
+	msg := fmt.Sprintf("Unexpected status code: %d", e.StatusCode)
+	if e.Reason != "" {
+		msg += " " + e.Reason
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.op != "" {
+		msg = e.op + ": " + msg
+	}
+	if e.hint != "" {
+		msg += ". " + e.hint
+	}
+	return msg
+}
+
+// parseGCSError reads the error document of a response failing to op, only the start of a body that
+// is not one is kept as Message.
+func parseGCSError(resp *http.Response, op string) *GCSError {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	doc := struct {
+		Error struct {
+			Message string
+			Errors  []struct {
+				Reason string
+			}
+		}
+	}{}
+	e := &GCSError{StatusCode: resp.StatusCode, op: op}
+	if json.Unmarshal(body, &doc) != nil || doc.Error.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+		return e
+	}
+	e.Message = doc.Error.Message
+	if len(doc.Error.Errors) > 0 {
+		e.Reason = doc.Error.Errors[0].Reason
+	}
+	return e
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IndexFile is the name of the index of the backups below a prefix, saved right below it where
+// ListBackups never takes it for part of a backup.
+const IndexFile = "index.json"
+
+// Index lists the complete backups below a prefix with what their manifests record, newest first,
+// so they can be looked up without reading every manifest. Dumps updating it at the same time may
+// lose an entry, such drift is healed by RebuildIndex.
+type Index struct {
+	Updated time.Time    `json:"updated"`
+	Backups []IndexEntry `json:"backups"`
+}
+
+// IndexEntry is one backup of an Index, Size is the sum of the sizes of its objects as stored.
+type IndexEntry struct {
+	Prefix        string            `json:"prefix"`
+	Completed     time.Time         `json:"completed"`
+	Size          int64             `json:"size"`
+	Objects       int               `json:"objects"`
+	ServerVersion string            `json:"server_version,omitempty"`
+	Compression   string            `json:"compression,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+// Find returns the backups carrying every one of labels and completed between since and until,
+// a zero time leaving that end open.
+func (i *Index) Find(labels map[string]string, since, until time.Time) []IndexEntry {
+	var found []IndexEntry
+	for _, e := range i.Backups {
+		if !since.IsZero() && e.Completed.Before(since) || !until.IsZero() && e.Completed.After(until) {
+			continue
+		}
+		matches := true
+		for k, v := range labels {
+			if value, ok := e.Labels[k]; !ok || value != v {
+				matches = false
+			}
+		}
+		if matches {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// indexEntry describes the backup at root from its manifest.
+func indexEntry(root string, manifest *Manifest) IndexEntry {
+	e := IndexEntry{
+		Prefix:        root,
+		Completed:     manifest.Completed,
+		Objects:       len(manifest.Objects),
+		ServerVersion: manifest.ServerVersion,
+		Compression:   manifest.Compression,
+		Labels:        manifest.Labels,
+	}
+	for _, o := range manifest.Objects {
+		e.Size += o.Size
+	}
+	return e
+}
+
+// ReadIndex fetches the index saved below prefix.
+func ReadIndex(s Fetcher, prefix string) (*Index, error) {
+	r, err := s.Fetch(path.Join(strings.Trim(prefix, "/"), IndexFile))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	index := &Index{}
+	if err := json.Unmarshal(b, index); err != nil {
+		return nil, errors.New("Malformed " + IndexFile + ": " + err.Error())
+	}
+	return index, nil
+}
+
+// saveIndex sorts the backups of index newest first and saves it below prefix.
+func saveIndex(s Saver, prefix string, index *Index) error {
+	sort.Slice(index.Backups, func(i, j int) bool {
+		if !index.Backups[i].Completed.Equal(index.Backups[j].Completed) {
+			return index.Backups[i].Completed.After(index.Backups[j].Completed)
+		}
+		return index.Backups[i].Prefix > index.Backups[j].Prefix
+	})
+	if index.Backups == nil {
+		index.Backups = []IndexEntry{}
+	}
+	index.Updated = time.Now().UTC()
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	w, err := s.Save(path.Join(strings.Trim(prefix, "/"), IndexFile))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// UpdateIndex adds the backup at root, read from its manifest, to the index below prefix,
+// replacing any entry it had. A missing index is started with it.
+func UpdateIndex(s SaveFetcher, prefix, root string) error {
+	manifest, err := ReadManifest(s, root)
+	if err != nil {
+		return err
+	}
+	index, err := ReadIndex(s, prefix)
+	if IsNotFound(err) {
+		index = &Index{}
+	} else if err != nil {
+		return err
+	}
+	root = strings.Trim(root, "/")
+	backups := []IndexEntry{indexEntry(root, manifest)}
+	for _, e := range index.Backups {
+		if e.Prefix != root {
+			backups = append(backups, e)
+		}
+	}
+	index.Backups = backups
+	return saveIndex(s, prefix, index)
+}
+
+// removeFromIndex drops the backups at roots from the index below prefix, if there is one.
+func removeFromIndex(s SaveFetcher, prefix string, roots map[string]bool) error {
+	index, err := ReadIndex(s, prefix)
+	if IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var backups []IndexEntry
+	for _, e := range index.Backups {
+		if !roots[e.Prefix] {
+			backups = append(backups, e)
+		}
+	}
+	index.Backups = backups
+	return saveIndex(s, prefix, index)
+}
+
+// RebuildIndex replaces the index below prefix with one read from the manifests of the complete
+// backups found by ListBackups. Complete backups without a manifest are left out.
+func RebuildIndex(s SaveFetcher, prefix string) (*Index, error) {
+	backups, err := ListBackups(s, prefix)
+	if err != nil {
+		return nil, err
+	}
+	index := &Index{}
+	for _, b := range backups {
+		if !b.Complete {
+			continue
+		}
+		manifest, err := ReadManifest(s, b.Prefix)
+		if IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		index.Backups = append(index.Backups, indexEntry(b.Prefix, manifest))
+	}
+	return index, saveIndex(s, prefix, index)
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	Convey("Given complete backups saved with manifests", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := Filesystem{dir}
+		backup := func(name, release string) string {
+			manifest := NewManifestSaveFetcher(store)
+			manifest.Labels = map[string]string{"release": release}
+			root := path.Join("host/db", name)
+			w, err := manifest.Save(path.Join(root, "chunk.tar"))
+			So(err, ShouldBeNil)
+			w.Write([]byte("chunk of " + name))
+			So(w.Close(), ShouldBeNil)
+			So(manifest.WriteManifest(root), ShouldBeNil)
+			w, err = store.Save(path.Join(root, CompleteMarker))
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			return root
+		}
+
+		Convey("UpdateIndex should add each new backup, newest first", func() {
+			So(UpdateIndex(store, "host/db", backup("1", "v2")), ShouldBeNil)
+			So(UpdateIndex(store, "host/db", backup("2", "v3")), ShouldBeNil)
+			index, err := ReadIndex(store, "host/db")
+			So(err, ShouldBeNil)
+			So(index.Backups, ShouldHaveLength, 2)
+			So(index.Backups[0].Prefix, ShouldEqual, "host/db/2")
+			So(index.Backups[0].Size, ShouldEqual, 10)
+			So(index.Backups[0].Objects, ShouldEqual, 1)
+			So(index.Backups[1].Labels, ShouldResemble, map[string]string{"release": "v2"})
+
+			So(UpdateIndex(store, "host/db", "host/db/1"), ShouldBeNil)
+			index, err = ReadIndex(store, "host/db")
+			So(err, ShouldBeNil)
+			So(index.Backups, ShouldHaveLength, 2)
+
+			backups, err := ListBackups(store, "host/db")
+			So(err, ShouldBeNil)
+			So(backups, ShouldHaveLength, 2)
+		})
+		Convey("Find should filter by labels and completion time", func() {
+			So(UpdateIndex(store, "host/db", backup("1", "v2")), ShouldBeNil)
+			So(UpdateIndex(store, "host/db", backup("2", "v3")), ShouldBeNil)
+			index, err := ReadIndex(store, "host/db")
+			So(err, ShouldBeNil)
+			v3 := index.Find(map[string]string{"release": "v3"}, time.Time{}, time.Time{})
+			So(v3, ShouldHaveLength, 1)
+			So(v3[0].Prefix, ShouldEqual, "host/db/2")
+			So(index.Find(nil, time.Now().Add(time.Hour), time.Time{}), ShouldBeEmpty)
+			So(index.Find(nil, time.Time{}, time.Now().Add(time.Hour)), ShouldHaveLength, 2)
+		})
+		Convey("RebuildIndex should reconstruct a lost or stale index from the manifests", func() {
+			backup("1", "v2")
+			So(UpdateIndex(store, "host/db", backup("2", "v3")), ShouldBeNil)
+			w, err := store.Save("host/db/3/chunk.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+
+			index, err := RebuildIndex(store, "host/db")
+			So(err, ShouldBeNil)
+			So(index.Backups, ShouldHaveLength, 2)
+			read, err := ReadIndex(store, "host/db")
+			So(err, ShouldBeNil)
+			So(read.Backups, ShouldHaveLength, 2)
+			So(read.Backups[0].Prefix, ShouldEqual, "host/db/2")
+			So(read.Backups[1].Prefix, ShouldEqual, "host/db/1")
+			So(read.Backups[1].Labels, ShouldResemble, map[string]string{"release": "v2"})
+		})
+		Convey("Prune should drop the backups it deletes from the index", func() {
+			backup("1", "v2")
+			backup("2", "v3")
+			old := time.Now().Add(-48 * time.Hour)
+			for _, object := range []string{"chunk.tar", ManifestFile, CompleteMarker} {
+				os.Chtimes(path.Join(dir, "host/db/1", object), old, old)
+			}
+			_, err := RebuildIndex(store, "host/db")
+			So(err, ShouldBeNil)
+			deleted, err := Prune(store, "host/db", PrunePolicy{KeepLast: 1})
+			So(err, ShouldBeNil)
+			So(deleted, ShouldHaveLength, 1)
+			index, err := ReadIndex(store, "host/db")
+			So(err, ShouldBeNil)
+			So(index.Backups, ShouldHaveLength, 1)
+			So(index.Backups[0].Prefix, ShouldEqual, "host/db/2")
+		})
+	})
+}
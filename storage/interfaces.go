@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"io"
+	"time"
 )
 
 type Filer interface {
@@ -23,6 +26,17 @@ type Fetcher interface {
 	Fetch(path string) (io.ReadCloser, error)
 }
 
+// RangeFetcher reads part of an object without fetching what comes before it.
+type RangeFetcher interface {
+	// FetchRange reads length bytes from offset, or up to the end when length is negative.
+	FetchRange(path string, offset, length int64) (io.ReadCloser, error)
+}
+
+// Deleter removes stored objects, for instance to rotate out old dumps found with Walk.
+type Deleter interface {
+	Delete(path string) error
+}
+
 type Pather interface {
 	Path() string
 }
@@ -35,4 +49,122 @@ type Walker interface {
 	Walk(path string, walkfn WalkFunc) error
 }
 
-type WalkFunc func(fpath string, err error) error
+// PrefixWalker lists the prefixes one level below a path, like folders, without visiting every key below them.
+type PrefixWalker interface {
+	WalkPrefixes(path string, walkfn WalkFunc) error
+}
+
+// WalkFunc is called with the key of every object visited by a Walk and what is known about it.
+type WalkFunc func(fpath string, info ObjectInfo, err error) error
+
+// ObjectInfo describes a stored object as found in a listing or by Stat.
+// ETag is only known to S3, it is the MD5 of objects not uploaded in parts nor encrypted with aws:kms.
+// Metadata is what the object was saved with through a MetadataSaver, it is only filled in by Stat.
+type ObjectInfo struct {
+	Key      string
+	Size     int64
+	ModTime  time.Time
+	ETag     string
+	Metadata map[string]string
+}
+
+// Stater tells what is known about a stored object without fetching it.
+type Stater interface {
+	Stat(path string) (ObjectInfo, error)
+}
+
+// errCannotStat is returned by decorators asked to Stat through a storage that cannot.
+var errCannotStat = errors.New("Storage cannot stat objects")
+
+// stat forwards Stat to s, failing with errCannotStat rather than panicking when s is no Stater.
+func stat(s interface{}, path string) (ObjectInfo, error) {
+	st, ok := s.(Stater)
+	if !ok {
+		return ObjectInfo{}, errCannotStat
+	}
+	return st.Stat(path)
+}
+
+// MetadataSaver saves objects along with user metadata, such as where and when a backup was taken.
+// Keys are case insensitive, Stat returns them in lower case.
+type MetadataSaver interface {
+	SaveWithMetadata(path string, metadata map[string]string) (io.WriteCloser, error)
+}
+
+// ErrNotFound is returned by Stat for an object that does not exist.
+var ErrNotFound = errors.New("Object not found")
+
+// ExclusiveSaver saves objects only where none exists yet, so two backups given the same key do not
+// silently replace one another. Save still overwrites.
+type ExclusiveSaver interface {
+	SaveNew(path string) (io.WriteCloser, error)
+}
+
+// ErrExists is returned by SaveNew, or by Close of what it returned, for an object that already exists.
+var ErrExists = errors.New("Object already exists")
+
+// errCannotSaveNew is returned by decorators asked to SaveNew through a storage that cannot.
+var errCannotSaveNew = errors.New("Storage cannot refuse to overwrite objects")
+
+// saveNewOf gives the SaveNew of s, or a func failing with errCannotSaveNew when s is no ExclusiveSaver.
+func saveNewOf(s interface{}) func(string) (io.WriteCloser, error) {
+	if es, ok := s.(ExclusiveSaver); ok {
+		return es.SaveNew
+	}
+	return func(string) (io.WriteCloser, error) {
+		return nil, errCannotSaveNew
+	}
+}
+
+// ContextSaveFetcher is a SaveFetcher whose operations can be cancelled or timed out through a context.
+type ContextSaveFetcher interface {
+	SaveContext(ctx context.Context, path string) (io.WriteCloser, error)
+	FetchContext(ctx context.Context, path string) (io.ReadCloser, error)
+	WalkContext(ctx context.Context, path string, walkfn WalkFunc) error
+}
+
+// IterWalker gives pull based access to the same keys Walk would visit.
+type IterWalker interface {
+	WalkIter(prefix string) Iterator
+}
+
+// Iterator yields keys one at a time, in the style of for it.Next() { it.Key() }.
+// Err reports what stopped the iteration early, Close releases it before it is exhausted.
+type Iterator interface {
+	Next() bool
+	Key() string
+	Err() error
+	Close() error
+}
+
+// Both backends implement the same interfaces, so callers can use either through them.
+var (
+	_ SaveFetcher  = Filesystem{}
+	_ Walker       = Filesystem{}
+	_ IterWalker   = Filesystem{}
+	_ Deleter      = Filesystem{}
+	_ PrefixWalker = Filesystem{}
+	_ RangeFetcher = Filesystem{}
+	_ Stater       = Filesystem{}
+	_ SaveFetcher  = (*S3)(nil)
+	_ Walker       = (*S3)(nil)
+	_ IterWalker   = (*S3)(nil)
+	_ Deleter      = (*S3)(nil)
+	_ PrefixWalker = (*S3)(nil)
+	_ RangeFetcher = (*S3)(nil)
+	_ Stater       = (*S3)(nil)
+	_ SaveFetcher  = (*GCS)(nil)
+	_ Walker       = (*GCS)(nil)
+	_ IterWalker   = (*GCS)(nil)
+	_ Deleter      = (*GCS)(nil)
+	_ PrefixWalker = (*GCS)(nil)
+	_ Stater       = (*GCS)(nil)
+
+	_ ContextSaveFetcher = Filesystem{}
+	_ ContextSaveFetcher = (*S3)(nil)
+	_ MetadataSaver      = Filesystem{}
+	_ MetadataSaver      = (*S3)(nil)
+	_ ExclusiveSaver     = Filesystem{}
+	_ ExclusiveSaver     = (*S3)(nil)
+	_ ExclusiveSaver     = (*GCS)(nil)
+)
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// lifecycleConfiguration is the part of a bucket lifecycle configuration that can expire objects.
+type lifecycleConfiguration struct {
+	Rules []struct {
+		ID     string
+		Status string
+		// Prefix is where older configurations put the filter.
+		Prefix string
+		Filter struct {
+			Prefix string
+			And    struct {
+				Prefix string
+			}
+		}
+		Expiration struct {
+			Days int
+			Date string
+		}
+	} `xml:"Rule"`
+}
+
+// LifecycleWarnings reads the lifecycle configuration of the bucket and describes every enabled rule
+// that would expire objects below prefix before keep has passed. A zero keep means backups are
+// expected to be kept forever, so any expiring rule is reported.
+func (s S3) LifecycleWarnings(prefix string, keep time.Duration) ([]string, error) {
+	if err := s.checkAwsKeys(); err != nil {
+		return nil, err
+	}
+	resp, err := s.send(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", strings.TrimRight(s.redirected(s.Bucket), "/")+"/?lifecycle", nil)
+		if err != nil {
+			return nil, err
+		}
+		return req, s.sign(req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	switch code := resp.StatusCode; {
+	case code == http.StatusNotFound && strings.Contains(string(body), "NoSuchLifecycleConfiguration"):
+		return nil, nil
+	case code != http.StatusOK:
+		e := s3ErrorOf(code, body)
+		e.op = "Reading lifecycle configuration"
+		return nil, e
+	}
+
+	config := lifecycleConfiguration{}
+	if err := xml.Unmarshal(body, &config); err != nil {
+		return nil, err
+	}
+
+	prefix = strings.TrimLeft(prefix, "/")
+	var warnings []string
+	for _, rule := range config.Rules {
+		if rule.Status != "Enabled" {
+			continue
+		}
+		rulePrefix := rule.Prefix + rule.Filter.Prefix + rule.Filter.And.Prefix
+		// The rule matters if it covers any of the objects below prefix.
+		if !strings.HasPrefix(prefix, rulePrefix) && !strings.HasPrefix(rulePrefix, prefix) {
+			continue
+		}
+		if days := rule.Expiration.Days; days > 0 {
+			if keep == 0 || time.Duration(days)*24*time.Hour < keep {
+				warnings = append(warnings, fmt.Sprintf(
+					"Lifecycle rule %q expires objects below %q after %d days", rule.ID, rulePrefix, days))
+			}
+		}
+		if date := rule.Expiration.Date; date != "" {
+			if t, err := time.Parse(time.RFC3339, date); err != nil || keep == 0 || t.Before(time.Now().Add(keep)) {
+				warnings = append(warnings, fmt.Sprintf(
+					"Lifecycle rule %q expires objects below %q on %s", rule.ID, rulePrefix, date))
+			}
+		}
+	}
+	return warnings, nil
+}
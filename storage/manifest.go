@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManifestFile is the name of the listing written by ManifestSaveFetcher.WriteManifest.
+const ManifestFile = "MANIFEST.json"
+
+// Manifest lists every object of a backup as it was stored, once the backup has completed.
+// ServerVersion, Compression and Labels are left out when the backup did not record them.
+type Manifest struct {
+	Completed     time.Time         `json:"completed"`
+	ServerVersion string            `json:"server_version,omitempty"`
+	Compression   string            `json:"compression,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Objects       []ManifestEntry   `json:"objects"`
+}
+
+// ManifestEntry describes one object of a Manifest, Key is relative to the directory of the manifest.
+type ManifestEntry struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	MD5  string `json:"md5"`
+}
+
+// manifestWriteCloser hashes and counts everything written, recording it once the object is stored.
+type manifestWriteCloser struct {
+	io.WriteCloser
+	hash  hash.Hash
+	size  int64
+	path  string
+	store *ManifestSaveFetcher
+}
+
+func (m *manifestWriteCloser) Write(p []byte) (int, error) {
+	m.hash.Write(p)
+	m.size += int64(len(p))
+	return m.WriteCloser.Write(p)
+}
+
+func (m *manifestWriteCloser) Close() error {
+	if err := m.WriteCloser.Close(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	m.store.objects[m.path] = ManifestEntry{Size: m.size, MD5: hex.EncodeToString(m.hash.Sum(nil))}
+	m.store.mu.Unlock()
+	return nil
+}
+
+// ManifestSaveFetcher wraps another SaveFetcher to remember the size and MD5 of every object saved on it,
+// so a manifest of the backup can be written once it is complete and checked with Verify later on.
+type ManifestSaveFetcher struct {
+	// ServerVersion, Compression and Labels are written to the manifest as they are.
+	ServerVersion string
+	Compression   string
+	Labels        map[string]string
+
+	s       SaveFetcher
+	mu      sync.Mutex
+	objects map[string]ManifestEntry
+}
+
+func NewManifestSaveFetcher(s SaveFetcher) *ManifestSaveFetcher {
+	return &ManifestSaveFetcher{s: s, objects: make(map[string]ManifestEntry)}
+}
+
+func (m *ManifestSaveFetcher) Save(path string) (io.WriteCloser, error) {
+	return m.save(path, m.s.Save)
+}
+
+func (m *ManifestSaveFetcher) SaveNew(path string) (io.WriteCloser, error) {
+	return m.save(path, saveNewOf(m.s))
+}
+
+func (m *ManifestSaveFetcher) save(path string, open func(string) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	w, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &manifestWriteCloser{WriteCloser: w, hash: md5.New(), path: path, store: m}, nil
+}
+
+func (m *ManifestSaveFetcher) Fetch(path string) (io.ReadCloser, error) {
+	return m.s.Fetch(path)
+}
+
+func (m *ManifestSaveFetcher) Walk(path string, walkfn WalkFunc) error {
+	w := m.s.(Walker)
+	return w.Walk(path, walkfn)
+}
+
+func (m *ManifestSaveFetcher) WalkIter(path string) Iterator {
+	w := m.s.(IterWalker)
+	return w.WalkIter(path)
+}
+
+func (m *ManifestSaveFetcher) WalkPrefixes(path string, walkfn WalkFunc) error {
+	w := m.s.(PrefixWalker)
+	return w.WalkPrefixes(path, walkfn)
+}
+
+func (m *ManifestSaveFetcher) Stat(path string) (ObjectInfo, error) {
+	return stat(m.s, path)
+}
+
+// Delete removes the object and forgets it, so it is not listed by WriteManifest.
+func (m *ManifestSaveFetcher) Delete(path string) error {
+	d := m.s.(Deleter)
+	if err := d.Delete(path); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.objects, path)
+	m.mu.Unlock()
+	return nil
+}
+
+// WriteManifest saves the manifest of the objects saved below dir at dir, marking it completed now.
+func (m *ManifestSaveFetcher) WriteManifest(dir string) error {
+	manifest := Manifest{
+		Completed:     time.Now().UTC(),
+		ServerVersion: m.ServerVersion,
+		Compression:   m.Compression,
+		Labels:        m.Labels,
+		Objects:       []ManifestEntry{},
+	}
+	m.mu.Lock()
+	for fpath, entry := range m.objects {
+		if rel, ok := relativeTo(dir, fpath); ok {
+			entry.Key = rel
+			manifest.Objects = append(manifest.Objects, entry)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(manifest.Objects, func(i, j int) bool {
+		return manifest.Objects[i].Key < manifest.Objects[j].Key
+	})
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	w, err := m.s.Save(path.Join(dir, ManifestFile))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// ReadManifest fetches the manifest saved at dir.
+func ReadManifest(s Fetcher, dir string) (*Manifest, error) {
+	r, err := s.Fetch(path.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, errors.New("Malformed " + ManifestFile + ": " + err.Error())
+	}
+	return manifest, nil
+}
+
+// ManifestError tells what Verify found wrong with a backup, keyed by the full path of each object.
+type ManifestError struct {
+	Missing []string
+	Corrupt map[string]string
+}
+
+func (e *ManifestError) Error() string {
+	var msgs []string
+	for _, fpath := range e.Missing {
+		msgs = append(msgs, fpath+": missing")
+	}
+	corrupt := make([]string, 0, len(e.Corrupt))
+	for fpath := range e.Corrupt {
+		corrupt = append(corrupt, fpath)
+	}
+	sort.Strings(corrupt)
+	for _, fpath := range corrupt {
+		msgs = append(msgs, fpath+": "+e.Corrupt[fpath])
+	}
+	return "Backup does not match its manifest: " + strings.Join(msgs, "; ")
+}
+
+// Verify checks the backup at dir against its manifest: every object listed has to be stored with
+// the listed size, and its stored bytes have to hash to the listed MD5. Sizes are taken from a Walk
+// of dir, so missing objects are found without fetching anything. It returns a *ManifestError
+// listing the missing and corrupt objects, or the error reading the manifest when a backup has none,
+// which is the case of one that was interrupted or taken without it.
+func Verify(s SaveFetcher, dir string) error {
+	_, err := verify(s, dir, nil, nil)
+	return err
+}
+
+// VerifyCheckpoint is Verify keeping the keys which passed in the local file checkpoint, one per
+// line, so a run that was interrupted resumes where it stopped. Objects listed there are still
+// checked to be stored with their size but not fetched again. It returns how many objects were
+// skipped that way, and removes checkpoint once the whole backup passed.
+func VerifyCheckpoint(s SaveFetcher, dir, checkpoint string) (skipped int, err error) {
+	passed := make(map[string]bool)
+	if b, err := ioutil.ReadFile(checkpoint); err == nil {
+		for _, key := range strings.Split(string(b), "\n") {
+			if key != "" {
+				passed[key] = true
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	f, err := os.OpenFile(checkpoint, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	var writeErr error
+	skipped, err = verify(s, dir, passed, func(fpath string) {
+		if _, err := fmt.Fprintln(f, fpath); err != nil && writeErr == nil {
+			writeErr = err
+		}
+	})
+	if cerr := f.Close(); writeErr == nil {
+		writeErr = cerr
+	}
+	if err != nil {
+		return skipped, err
+	}
+	if writeErr != nil {
+		return skipped, errors.New(fmt.Sprintf("Saving verification checkpoint %s: %v", checkpoint, writeErr))
+	}
+	return skipped, os.Remove(checkpoint)
+}
+
+// verify checks dir against its manifest, not fetching the objects in passed and calling record
+// for each object that passed, when they are set. It returns how many objects were not fetched.
+func verify(s SaveFetcher, dir string, passed map[string]bool, record func(fpath string)) (skipped int, err error) {
+	manifest, err := ReadManifest(s, dir)
+	if err != nil {
+		return 0, err
+	}
+	sizes := make(map[string]int64)
+	err = s.(Walker).Walk(dir, func(fpath string, info ObjectInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		sizes[strings.TrimLeft(fpath, "/")] = info.Size
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	problems := &ManifestError{Corrupt: make(map[string]string)}
+	for _, entry := range manifest.Objects {
+		fpath := path.Join(dir, entry.Key)
+		size, ok := sizes[strings.TrimLeft(fpath, "/")]
+		if !ok {
+			problems.Missing = append(problems.Missing, fpath)
+			continue
+		}
+		if size != entry.Size {
+			problems.Corrupt[fpath] = fmt.Sprintf("size %d, expected %d", size, entry.Size)
+			continue
+		}
+		if passed[fpath] {
+			skipped++
+			continue
+		}
+		sum, err := md5Of(s, fpath)
+		if err != nil {
+			problems.Corrupt[fpath] = err.Error()
+		} else if sum != entry.MD5 {
+			problems.Corrupt[fpath] = fmt.Sprintf("MD5 %s, expected %s", sum, entry.MD5)
+		} else if record != nil {
+			record(fpath)
+		}
+	}
+	if len(problems.Missing) == 0 && len(problems.Corrupt) == 0 {
+		return skipped, nil
+	}
+	return skipped, problems
+}
+
+// md5Of fetches the object at fpath and returns the hex MD5 of it.
+func md5Of(s Fetcher, fpath string) (string, error) {
+	r, err := s.Fetch(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	Convey("Given a backup saved with a manifest", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := NewManifestSaveFetcher(Filesystem{dir})
+		store.ServerVersion, store.Compression = "4.4.6", "gzip"
+		for _, name := range []string{"dump/a.tar", "dump/b.tar", "other/c.tar"} {
+			w, err := store.Save(name)
+			So(err, ShouldBeNil)
+			w.Write([]byte("content of " + name))
+			So(w.Close(), ShouldBeNil)
+		}
+		So(store.WriteManifest("dump"), ShouldBeNil)
+
+		Convey("The manifest should list the objects below its directory", func() {
+			manifest, err := ReadManifest(store, "dump")
+			So(err, ShouldBeNil)
+			So(manifest.Completed.IsZero(), ShouldBeFalse)
+			So(manifest.ServerVersion, ShouldEqual, "4.4.6")
+			So(manifest.Compression, ShouldEqual, "gzip")
+			sum := md5.Sum([]byte("content of dump/a.tar"))
+			So(manifest.Objects, ShouldHaveLength, 2)
+			So(manifest.Objects[0], ShouldResemble, ManifestEntry{"a.tar", 21, hex.EncodeToString(sum[:])})
+			So(manifest.Objects[1].Key, ShouldEqual, "b.tar")
+		})
+		Convey("Verify should pass on an intact backup", func() {
+			So(Verify(store, "dump"), ShouldBeNil)
+		})
+		Convey("Verify should report a missing object", func() {
+			So(os.Remove(path.Join(dir, "dump/a.tar")), ShouldBeNil)
+			err := Verify(store, "dump")
+			So(err, ShouldNotBeNil)
+			problems, ok := err.(*ManifestError)
+			So(ok, ShouldBeTrue)
+			So(problems.Missing, ShouldResemble, []string{"dump/a.tar"})
+			So(problems.Corrupt, ShouldBeEmpty)
+		})
+		Convey("Verify should report objects of another size or content", func() {
+			So(ioutil.WriteFile(path.Join(dir, "dump/a.tar"), []byte("short"), 0600), ShouldBeNil)
+			So(ioutil.WriteFile(path.Join(dir, "dump/b.tar"), []byte("CONTENT OF dump/b.tar"), 0600), ShouldBeNil)
+			err := Verify(store, "dump")
+			So(err, ShouldNotBeNil)
+			problems := err.(*ManifestError)
+			So(problems.Missing, ShouldBeEmpty)
+			So(problems.Corrupt["dump/a.tar"], ShouldContainSubstring, "size 5")
+			So(problems.Corrupt["dump/b.tar"], ShouldContainSubstring, "MD5")
+		})
+		Convey("Verify should fail on a backup without a manifest", func() {
+			So(Verify(store, "other"), ShouldNotBeNil)
+		})
+	})
+}
+
+// interruptedStorage fails every Fetch after the first few, as if the run was stopped there.
+type interruptedStorage struct {
+	Filesystem
+	fetched []string
+	limit   int
+}
+
+func (s *interruptedStorage) Fetch(fpath string) (io.ReadCloser, error) {
+	if path.Base(fpath) != ManifestFile {
+		if len(s.fetched) >= s.limit {
+			return nil, errors.New("interrupted")
+		}
+		s.fetched = append(s.fetched, fpath)
+	}
+	return s.Filesystem.Fetch(fpath)
+}
+
+func TestVerifyCheckpoint(t *testing.T) {
+	Convey("Given a backup of four objects with a manifest", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := NewManifestSaveFetcher(Filesystem{dir})
+		for _, name := range []string{"a.tar", "b.tar", "c.tar", "d.tar"} {
+			w, err := store.Save("dump/" + name)
+			So(err, ShouldBeNil)
+			w.Write([]byte(name))
+			So(w.Close(), ShouldBeNil)
+		}
+		So(store.WriteManifest("dump"), ShouldBeNil)
+		checkpoint := path.Join(dir, "verify.checkpoint")
+
+		Convey("A resumed run should only fetch the objects left", func() {
+			s := &interruptedStorage{Filesystem: Filesystem{dir}, limit: 2}
+			skipped, err := VerifyCheckpoint(s, "dump", checkpoint)
+			So(err, ShouldNotBeNil)
+			So(skipped, ShouldEqual, 0)
+			So(s.fetched, ShouldResemble, []string{"dump/a.tar", "dump/b.tar"})
+
+			s = &interruptedStorage{Filesystem: Filesystem{dir}, limit: 10}
+			skipped, err = VerifyCheckpoint(s, "dump", checkpoint)
+			So(err, ShouldBeNil)
+			So(skipped, ShouldEqual, 2)
+			So(s.fetched, ShouldResemble, []string{"dump/c.tar", "dump/d.tar"})
+			_, err = os.Stat(checkpoint)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+		Convey("An object replaced since it passed should still be found by its size", func() {
+			s := &interruptedStorage{Filesystem: Filesystem{dir}, limit: 1}
+			VerifyCheckpoint(s, "dump", checkpoint)
+			So(ioutil.WriteFile(path.Join(dir, "dump/a.tar"), []byte("longer"), 0644), ShouldBeNil)
+			_, err := VerifyCheckpoint(Filesystem{dir}, "dump", checkpoint)
+			So(err, ShouldNotBeNil)
+			So(err.(*ManifestError).Corrupt["dump/a.tar"], ShouldContainSubstring, "size 6")
+		})
+	})
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/smartystreets/go-aws-auth"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// containerEndpoint serves the task role credentials on ECS at AWS_CONTAINER_CREDENTIALS_RELATIVE_URI.
+	containerEndpoint = "http://169.254.170.2"
+	metadataTokenPath = "/latest/api/token"
+	metadataRolePath  = "/latest/meta-data/iam/security-credentials/"
+	metadataTokenTTL  = "21600"
+)
+
+// InstanceMetadata fetches temporary role credentials from the EC2 instance metadata service,
+// or from the ECS container credentials endpoint when running as an ECS task.
+// IMDSv2 is used, a session token is requested first and sent along with every metadata request.
+type InstanceMetadata struct {
+	// Endpoint of the metadata service.
+	// Example: http://169.254.169.254
+	Endpoint string
+	// ContainerURI is where the ECS task role credentials are read from instead, when set.
+	// ContainerToken is sent as Authorization header to it, as ECS asks for with a full URI.
+	ContainerURI   string
+	ContainerToken string
+	// AllowIMDSv1 permits falling back to plain GETs when no session token could be obtained.
+	AllowIMDSv1 bool
+	client      *http.Client
+
+	mu    sync.Mutex
+	creds *awsauth.Credentials
+}
+
+func NewInstanceMetadata() *InstanceMetadata {
+	m := &InstanceMetadata{
+		Endpoint: "http://169.254.169.254",
+		// The service is link local, anything slower than this means we are not on EC2.
+		client: &http.Client{Timeout: 2 * time.Second},
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		m.ContainerURI = containerEndpoint + uri
+	} else if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		m.ContainerURI = uri
+		m.ContainerToken = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	}
+	return m
+}
+
+// Credentials returns the role credentials, fetching new ones when they are about to expire.
+func (m *InstanceMetadata) Credentials() (awsauth.Credentials, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.creds != nil && time.Now().Add(5*time.Minute).Before(m.creds.Expiration) {
+		return *m.creds, nil
+	}
+	creds, err := m.fetch()
+	if err != nil {
+		return awsauth.Credentials{}, err
+	}
+	m.creds = &creds
+	return creds, nil
+}
+
+// token requests an IMDSv2 session token.
+func (m *InstanceMetadata) token() (string, error) {
+	req, err := http.NewRequest("PUT", m.Endpoint+metadataTokenPath, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", metadataTokenTTL)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if code := resp.StatusCode; code != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("Unexpected status code requesting metadata token: %d\n%s", code, string(b)))
+	}
+	return string(b), nil
+}
+
+// get reads one metadata path, authenticated with token unless it is empty.
+func (m *InstanceMetadata) get(path, token string) ([]byte, error) {
+	req, err := http.NewRequest("GET", m.Endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if code := resp.StatusCode; code != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Unexpected status code reading metadata %s: %d\n%s", path, code, string(b)))
+	}
+	return b, nil
+}
+
+// roleCredentials is how both the instance metadata service and ECS describe role credentials.
+type roleCredentials struct {
+	Code            string
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (c roleCredentials) credentials() awsauth.Credentials {
+	return awsauth.Credentials{
+		AccessKeyID:     c.AccessKeyId,
+		SecretAccessKey: c.SecretAccessKey,
+		SecurityToken:   c.Token,
+		Expiration:      c.Expiration,
+	}
+}
+
+// fetchContainer reads the task role credentials from the ECS endpoint, which has no Code to check.
+func (m *InstanceMetadata) fetchContainer() (awsauth.Credentials, error) {
+	req, err := http.NewRequest("GET", m.ContainerURI, nil)
+	if err != nil {
+		return awsauth.Credentials{}, err
+	}
+	if m.ContainerToken != "" {
+		req.Header.Set("Authorization", m.ContainerToken)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return awsauth.Credentials{}, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return awsauth.Credentials{}, err
+	}
+	if code := resp.StatusCode; code != http.StatusOK {
+		return awsauth.Credentials{}, errors.New(fmt.Sprintf("Unexpected status code reading container credentials: %d\n%s", code, string(b)))
+	}
+	var c roleCredentials
+	if err := json.Unmarshal(b, &c); err != nil {
+		return awsauth.Credentials{}, err
+	}
+	return c.credentials(), nil
+}
+
+func (m *InstanceMetadata) fetch() (awsauth.Credentials, error) {
+	if m.ContainerURI != "" {
+		return m.fetchContainer()
+	}
+	token, err := m.token()
+	if err != nil {
+		if !m.AllowIMDSv1 {
+			return awsauth.Credentials{}, err
+		}
+		token = ""
+	}
+
+	b, err := m.get(metadataRolePath, token)
+	if err != nil {
+		return awsauth.Credentials{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(b), "\n", 2)[0])
+	if role == "" {
+		return awsauth.Credentials{}, errors.New("No IAM role attached to instance")
+	}
+
+	b, err = m.get(metadataRolePath+role, token)
+	if err != nil {
+		return awsauth.Credentials{}, err
+	}
+	var c roleCredentials
+	if err := json.Unmarshal(b, &c); err != nil {
+		return awsauth.Credentials{}, err
+	}
+	if c.Code != "Success" {
+		return awsauth.Credentials{}, errors.New("Instance credentials not available: " + c.Code)
+	}
+	return c.credentials(), nil
+}
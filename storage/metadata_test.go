@@ -0,0 +1,164 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// metadataServer stubs the instance metadata service, only answering requests carrying the IMDSv2 token.
+func metadataServer(requireToken bool) *httptest.Server {
+	const token = "secret-session-token"
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == metadataTokenPath {
+			if r.Method != "PUT" || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !requireToken {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(token))
+			return
+		}
+		if requireToken && r.Header.Get("X-aws-ec2-metadata-token") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case metadataRolePath:
+			w.Write([]byte("backup-role"))
+		case metadataRolePath + "backup-role":
+			w.Write([]byte(`{
+				"Code": "Success",
+				"AccessKeyId": "AKIDEXAMPLE",
+				"SecretAccessKey": "secret",
+				"Token": "session",
+				"Expiration": "` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"
+			}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestInstanceMetadata(t *testing.T) {
+	Convey("Given a metadata service requiring IMDSv2 tokens", t, func() {
+		ts := metadataServer(true)
+		defer ts.Close()
+		m := NewInstanceMetadata()
+		m.Endpoint = ts.URL
+
+		Convey("Role credentials should be fetched using the session token", func() {
+			creds, err := m.Credentials()
+			So(err, ShouldBeNil)
+			So(creds.AccessKeyID, ShouldEqual, "AKIDEXAMPLE")
+			So(creds.SecretAccessKey, ShouldEqual, "secret")
+			So(creds.SecurityToken, ShouldEqual, "session")
+		})
+	})
+	Convey("Given a metadata service only speaking IMDSv1", t, func() {
+		ts := metadataServer(false)
+		defer ts.Close()
+		m := NewInstanceMetadata()
+		m.Endpoint = ts.URL
+
+		Convey("Fetching credentials should fail by default", func() {
+			_, err := m.Credentials()
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Fetching credentials should succeed when IMDSv1 is allowed", func() {
+			m.AllowIMDSv1 = true
+			creds, err := m.Credentials()
+			So(err, ShouldBeNil)
+			So(creds.AccessKeyID, ShouldEqual, "AKIDEXAMPLE")
+		})
+	})
+}
+
+func TestContainerCredentials(t *testing.T) {
+	Convey("Given an ECS endpoint handing out credentials about to expire", t, func() {
+		fetches := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v2/credentials/task" || r.Header.Get("Authorization") != "task-token" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fetches++
+			w.Write([]byte(`{
+				"AccessKeyId": "AKIDTASK",
+				"SecretAccessKey": "secret",
+				"Token": "session",
+				"Expiration": "` + time.Now().Add(time.Minute).UTC().Format(time.RFC3339) + `"
+			}`))
+		}))
+		defer ts.Close()
+		m := NewInstanceMetadata()
+		m.ContainerURI = ts.URL + "/v2/credentials/task"
+		m.ContainerToken = "task-token"
+
+		Convey("Task role credentials should be read from it", func() {
+			creds, err := m.Credentials()
+			So(err, ShouldBeNil)
+			So(creds.AccessKeyID, ShouldEqual, "AKIDTASK")
+			So(creds.SecurityToken, ShouldEqual, "session")
+		})
+		Convey("They should be fetched again before they expire", func() {
+			m.Credentials()
+			m.Credentials()
+			So(fetches, ShouldEqual, 2)
+		})
+	})
+}
+
+func TestSignWhileFetchingCredentials(t *testing.T) {
+	Convey("Given a metadata service slow to answer", t, func() {
+		started, release := make(chan bool, 1), make(chan bool)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case started <- true:
+			default:
+			}
+			<-release
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer ts.Close()
+		defer close(release)
+		key, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		defer os.Setenv("AWS_ACCESS_KEY_ID", key)
+		defer os.Setenv("AWS_SECRET_ACCESS_KEY", secret)
+
+		slow := NewS3("https://bucket.s3.amazonaws.com")
+		slow.Instance = NewInstanceMetadata()
+		slow.Instance.Endpoint = ts.URL
+		slow.Instance.ContainerURI = ""
+
+		Convey("Other requests should be signed without waiting for it", func() {
+			go func() {
+				req, _ := http.NewRequest("GET", "https://bucket.s3.amazonaws.com/a", nil)
+				slow.sign(req)
+			}()
+			<-started
+
+			s := NewS3("https://bucket.s3.amazonaws.com")
+			s.Credentials = &Credentials{AccessKey: "AKIDEXAMPLE", SecretKey: "secret"}
+			signed := make(chan error, 1)
+			go func() {
+				req, _ := http.NewRequest("GET", "https://bucket.s3.amazonaws.com/b", nil)
+				signed <- s.sign(req)
+			}()
+			select {
+			case err := <-signed:
+				So(err, ShouldBeNil)
+			case <-time.After(time.Second):
+				So("signing waited for the metadata service", ShouldBeEmpty)
+			}
+		})
+	})
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MinPartSize is the smallest part S3 accepts in a multipart upload, except for the last one.
+const MinPartSize = 5 * MB
+
+// DefaultPartSize is the PartSize of NewS3, large enough that a 10000 part upload holds about 160GB.
+const DefaultPartSize = 16 * MB
+
+// s3Part is an uploaded part as listed in CompleteMultipartUpload.
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// multipartReq builds a request for the multipart upload of the writer, query is appended to its path.
+// Once the upload has an id, the requests are on the upload rather than on the object.
+func (sf *s3FileWriter) multipartReq(method, query string, body []byte) (*http.Request, error) {
+	part := sf.uploadId != ""
+	if body == nil {
+		return sf.builder(method, sf.bucket, sf.path+"?"+query, part, nil)
+	}
+	return sf.builder(method, sf.bucket, sf.path+"?"+query, part, bytes.NewReader(body))
+}
+
+// send does the request for the multipart upload, failing unless S3 answers 200 OK, and returns the response body.
+func (sf *s3FileWriter) send(method, query string, content []byte) (*http.Response, []byte, error) {
+	resp, err := sf.do(func() (*http.Request, error) {
+		return sf.multipartReq(method, query, content)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil, nil, ErrExists
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, parseS3Error(resp, "Multipart upload of "+sf.path)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// initiate starts the multipart upload.
+func (sf *s3FileWriter) initiate() error {
+	_, body, err := sf.send("POST", "uploads", nil)
+	if err != nil {
+		return err
+	}
+	result := struct {
+		UploadId string
+	}{}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return err
+	}
+	if result.UploadId == "" {
+		return errors.New("No UploadId in response to initiating multipart upload of " + sf.path)
+	}
+	sf.uploadId = result.UploadId
+	return nil
+}
+
+// listedPart is a part S3 already holds for an upload in progress, as listed by ListParts.
+type listedPart struct {
+	PartNumber int
+	ETag       string
+	Size       int
+}
+
+// findUpload looks for a multipart upload of the same key left in progress, the most recently
+// initiated one when there are several, and lists its parts so uploadPart can skip those S3 holds.
+func (sf *s3FileWriter) findUpload() error {
+	key := strings.TrimLeft(sf.path, "/")
+	resp, err := sf.do(func() (*http.Request, error) {
+		return sf.builder("GET", sf.bucket, "?uploads&prefix="+url.QueryEscape(key), false, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return parseS3Error(resp, "Listing multipart uploads of "+sf.path)
+	}
+	uploads := struct {
+		Upload []struct {
+			Key       string
+			UploadId  string
+			Initiated string
+		}
+	}{}
+	if err := xml.NewDecoder(resp.Body).Decode(&uploads); err != nil {
+		return err
+	}
+	var uploadId, initiated string
+	for _, u := range uploads.Upload {
+		// Initiated is an ISO 8601 time, later ones sort after.
+		if u.Key == key && u.Initiated >= initiated {
+			uploadId, initiated = u.UploadId, u.Initiated
+		}
+	}
+	if uploadId == "" {
+		return nil
+	}
+
+	listed := make(map[int]listedPart)
+	marker := ""
+	for {
+		query := "uploadId=" + url.QueryEscape(uploadId)
+		if marker != "" {
+			query += "&part-number-marker=" + marker
+		}
+		_, body, err := sf.send("GET", query, nil)
+		if err != nil {
+			return err
+		}
+		page := struct {
+			Part                 []listedPart
+			IsTruncated          bool
+			NextPartNumberMarker string
+		}{}
+		if err := xml.Unmarshal(body, &page); err != nil {
+			return err
+		}
+		for _, p := range page.Part {
+			listed[p.PartNumber] = p
+		}
+		if !page.IsTruncated || page.NextPartNumberMarker == "" {
+			break
+		}
+		marker = page.NextPartNumberMarker
+	}
+	sf.uploadId, sf.listed = uploadId, listed
+	return nil
+}
+
+// uploadPart sends p as the next part, starting the multipart upload first if needed. A part that an
+// upload being resumed already holds with the same size and MD5 is not sent again.
+func (sf *s3FileWriter) uploadPart(p []byte) error {
+	if sf.uploadId == "" && sf.resume {
+		if err := sf.findUpload(); err != nil {
+			return err
+		}
+	}
+	if sf.uploadId == "" {
+		if err := sf.initiate(); err != nil {
+			return err
+		}
+	}
+	number := len(sf.parts) + 1
+	if listed, ok := sf.listed[number]; ok && listed.Size == len(p) {
+		sum := md5.Sum(p)
+		if strings.Trim(listed.ETag, `"`) == hex.EncodeToString(sum[:]) {
+			sf.parts = append(sf.parts, s3Part{number, listed.ETag})
+			return nil
+		}
+	}
+	query := fmt.Sprintf("partNumber=%d&uploadId=%s", number, url.QueryEscape(sf.uploadId))
+	resp, _, err := sf.send("PUT", query, p)
+	if err != nil {
+		return err
+	}
+	// The ETag of the whole object is not an MD5, so each part is checked as it is sent.
+	if err := sf.checkETag(resp, p); err != nil {
+		return err
+	}
+	sf.parts = append(sf.parts, s3Part{number, resp.Header.Get("ETag")})
+	return nil
+}
+
+// complete assembles the uploaded parts into the object.
+func (sf *s3FileWriter) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: sf.parts})
+	if err != nil {
+		return err
+	}
+	_, resp, err := sf.send("POST", "uploadId="+url.QueryEscape(sf.uploadId), body)
+	if err != nil {
+		return err
+	}
+	// S3 may report a failure to complete after it already answered 200 OK.
+	if failure := s3ErrorOf(http.StatusOK, resp); failure.Code != "" {
+		failure.op = "Completing multipart upload of " + sf.path
+		return failure
+	}
+	return nil
+}
+
+// fail remembers err and aborts the multipart upload, so no parts are left to pay for.
+func (sf *s3FileWriter) fail(err error) {
+	sf.err = err
+	if sf.uploadId == "" {
+		return
+	}
+	req, rerr := sf.multipartReq("DELETE", "uploadId="+url.QueryEscape(sf.uploadId), nil)
+	if rerr != nil {
+		return
+	}
+	// Not sf.do, the abort has to go through when the context of the upload was cancelled.
+	if resp, rerr := do(sf.client, sf.limit, req); rerr == nil {
+		drain(resp.Body)
+	}
+	sf.uploadId = ""
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// multipartServer is a fake S3 keeping just enough state for multipart uploads.
+type multipartServer struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	parts    map[int][]byte
+	requests []string
+	failPart int
+	aborted  bool
+	// inProgress is the key of an upload up+1 already holding parts, listed by ListMultipartUploads.
+	inProgress string
+	// classes holds the storage class header of each request.
+	classes []string
+}
+
+func (m *multipartServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	q := r.URL.Query()
+	m.classes = append(m.classes, r.Header.Get("x-amz-storage-class"))
+	switch {
+	case r.Method == "POST" && r.URL.RawQuery == "uploads":
+		m.requests = append(m.requests, "initiate")
+		m.parts = make(map[int][]byte)
+		fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>up+1</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == "GET" && strings.HasPrefix(r.URL.RawQuery, "uploads"):
+		m.requests = append(m.requests, "list uploads")
+		fmt.Fprint(w, "<ListMultipartUploadsResult>")
+		fmt.Fprint(w, "<Upload><Key>dump/other.tar</Key><UploadId>other</UploadId><Initiated>2026-10-02T10:00:00.000Z</Initiated></Upload>")
+		if m.inProgress != "" && strings.HasPrefix(m.inProgress, q.Get("prefix")) {
+			fmt.Fprintf(w, "<Upload><Key>%s</Key><UploadId>up+1</UploadId><Initiated>2026-10-01T10:00:00.000Z</Initiated></Upload>", m.inProgress)
+		}
+		fmt.Fprint(w, "</ListMultipartUploadsResult>")
+	case r.Method == "GET" && q.Get("uploadId") == "up+1":
+		m.requests = append(m.requests, "list parts")
+		var numbers []int
+		for n := range m.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		fmt.Fprint(w, "<ListPartsResult>")
+		for _, n := range numbers {
+			fmt.Fprintf(w, `<Part><PartNumber>%d</PartNumber><ETag>"%x"</ETag><Size>%d</Size></Part>`, n, md5.Sum(m.parts[n]), len(m.parts[n]))
+		}
+		fmt.Fprint(w, "</ListPartsResult>")
+	case r.Method == "PUT" && q.Get("uploadId") == "up+1":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		m.requests = append(m.requests, fmt.Sprintf("part %d", n))
+		if n == m.failPart {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		m.parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case r.Method == "POST" && q.Get("uploadId") == "up+1":
+		m.requests = append(m.requests, "complete")
+		complete := struct {
+			Parts []s3Part `xml:"Part"`
+		}{}
+		xml.Unmarshal(body, &complete)
+		var numbers []int
+		for _, p := range complete.Parts {
+			numbers = append(numbers, p.PartNumber)
+		}
+		sort.Ints(numbers)
+		var object []byte
+		for _, n := range numbers {
+			object = append(object, m.parts[n]...)
+		}
+		m.objects[r.URL.Path] = object
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "DELETE" && q.Get("uploadId") == "up+1":
+		m.requests = append(m.requests, "abort")
+		m.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		m.requests = append(m.requests, "put")
+		m.objects[r.URL.Path] = body
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	setTestAwsKeys()
+	Convey("Given an S3 bucket switching to multipart above 10 bytes", t, func() {
+		fake := &multipartServer{objects: make(map[string][]byte)}
+		ts := httptest.NewServer(fake)
+		defer ts.Close()
+		s := NewS3(ts.URL)
+		So(s.PartSize, ShouldEqual, DefaultPartSize)
+		s.PartSize = 10
+
+		Convey("A small object should be sent in one PUT", func() {
+			w, err := s.Save("dump/small.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{"put"})
+			So(string(fake.objects["/dump/small.tar"]), ShouldEqual, "foo")
+		})
+		Convey("A large object should be sent in parts while it is written", func() {
+			w, err := s.Save("dump/large.tar")
+			So(err, ShouldBeNil)
+			content := strings.Repeat("0123456789abcdef", 4)
+			for n := 0; n < len(content); n += 7 {
+				end := n + 7
+				if end > len(content) {
+					end = len(content)
+				}
+				_, err := w.Write([]byte(content[n:end]))
+				So(err, ShouldBeNil)
+				So(w.(*s3FileWriter).Len(), ShouldBeLessThan, 10)
+			}
+			So(w.Close(), ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{
+				"initiate", "part 1", "part 2", "part 3", "part 4", "part 5", "part 6", "part 7", "complete",
+			})
+			So(len(fake.parts[1]), ShouldEqual, 10)
+			So(len(fake.parts[7]), ShouldEqual, 4)
+			So(string(fake.objects["/dump/large.tar"]), ShouldEqual, content)
+		})
+		Convey("A failing part should abort the upload", func() {
+			fake.failPart = 2
+			s.MaxRetries = 0
+			w, err := s.Save("dump/large.tar")
+			So(err, ShouldBeNil)
+			_, err = w.Write(bytes.Repeat([]byte("x"), 25))
+			So(err, ShouldNotBeNil)
+			So(w.Close(), ShouldNotBeNil)
+			So(fake.aborted, ShouldBeTrue)
+			So(fake.requests, ShouldResemble, []string{"initiate", "part 1", "part 2", "abort"})
+			So(fake.objects, ShouldBeEmpty)
+		})
+		Convey("Cancelling the context mid-upload should abort it", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			w, err := s.SaveContext(ctx, "dump/large.tar")
+			So(err, ShouldBeNil)
+			_, err = w.Write(bytes.Repeat([]byte("x"), 15))
+			So(err, ShouldBeNil)
+			cancel()
+			_, err = w.Write([]byte("x"))
+			So(err, ShouldEqual, context.Canceled)
+			So(w.Close(), ShouldEqual, context.Canceled)
+			So(fake.requests, ShouldResemble, []string{"initiate", "part 1", "abort"})
+			So(fake.objects, ShouldBeEmpty)
+		})
+		Convey("Headers describing the object should go on the object requests only, whatever its key", func() {
+			s.StorageClass = "STANDARD_IA"
+			w, err := s.Save("dump/uploadId=1.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldBeNil)
+			w, err = s.Save("dump/uploadId=2.tar")
+			So(err, ShouldBeNil)
+			w.Write(bytes.Repeat([]byte("x"), 15))
+			So(w.Close(), ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{"put", "initiate", "part 1", "part 2", "complete"})
+			So(fake.classes, ShouldResemble, []string{"STANDARD_IA", "STANDARD_IA", "", "", ""})
+		})
+		Convey("With ResumeUploads an upload left in progress should carry on, sending only the parts S3 lacks", func() {
+			s.ResumeUploads = true
+			fake.inProgress = "dump/large.tar"
+			fake.parts = map[int][]byte{1: []byte("0123456789"), 2: []byte("stale part")}
+			content := "0123456789abcdefghij01234"
+			w, err := s.Save("dump/large.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte(content))
+			So(w.Close(), ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{"list uploads", "list parts", "part 2", "part 3", "complete"})
+			So(string(fake.objects["/dump/large.tar"]), ShouldEqual, content)
+		})
+		Convey("With ResumeUploads an upload of another key should not be resumed", func() {
+			s.ResumeUploads = true
+			w, err := s.Save("dump/large.tar")
+			So(err, ShouldBeNil)
+			w.Write(bytes.Repeat([]byte("x"), 15))
+			So(w.Close(), ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{"list uploads", "initiate", "part 1", "part 2", "complete"})
+		})
+	})
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"errors"
+	"path"
+	"time"
+)
+
+// Orphans lists the objects below prefix which no complete backup refers to, in the backups found by
+// ListBackups: every object of an incomplete backup, and the objects of a complete backup which its
+// manifest does not list. A complete backup without a manifest, taken before dumps wrote one, refers
+// to every object below it. Its MANIFEST.json, SHA256SUMS and markers are never orphans, and
+// objects right below prefix are left alone as Prune does.
+// A dump still running is incomplete as well, so backups modified within minAge are skipped.
+func Orphans(s SaveFetcher, prefix string, minAge time.Duration) ([]string, error) {
+	backups, err := ListBackups(s, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	now := time.Now()
+	for _, b := range backups {
+		if now.Sub(b.ModTime) < minAge {
+			continue
+		}
+		if !b.Complete {
+			orphans = append(orphans, b.Keys...)
+			continue
+		}
+		manifest, err := ReadManifest(s, b.Prefix)
+		if IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		listed := make(map[string]bool)
+		for _, entry := range manifest.Objects {
+			listed[path.Join(b.Prefix, entry.Key)] = true
+		}
+		for _, key := range b.Keys {
+			switch path.Base(key) {
+			case CompleteMarker, ManifestFile, ChecksumFile, PruneMarker, ProtectedMarker:
+				continue
+			}
+			if !listed[key] {
+				orphans = append(orphans, key)
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// DeleteOrphans deletes the keys returned by Orphans, stopping at the first error. Nothing asks for
+// confirmation here, callers should show the list first.
+func DeleteOrphans(s SaveFetcher, orphans []string) error {
+	deleter, ok := s.(Deleter)
+	if !ok {
+		return errors.New("Storage cannot delete objects to remove orphans")
+	}
+	for _, key := range orphans {
+		if err := deleter.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOrphans(t *testing.T) {
+	Convey("Given backups with a planted orphan, a failed dump and a running one", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := Filesystem{dir}
+		save := func(s Saver, key string) {
+			w, err := s.Save(key)
+			So(err, ShouldBeNil)
+			w.Write([]byte(key))
+			So(w.Close(), ShouldBeNil)
+		}
+		age := func(key string, days int) {
+			modified := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+			So(os.Chtimes(path.Join(dir, key), modified, modified), ShouldBeNil)
+		}
+
+		manifest := NewManifestSaveFetcher(store)
+		save(manifest, "host/db/1/chunk.tar")
+		So(manifest.WriteManifest("host/db/1"), ShouldBeNil)
+		save(store, "host/db/1/"+CompleteMarker)
+		save(store, "host/db/1/stray.tar")
+		save(store, "host/db/2/chunk.tar")
+		save(store, "host/db/3/chunk.tar")
+		save(store, "host/db/3/"+CompleteMarker)
+		save(store, "host/db/4/chunk.tar")
+		save(store, "host/db/notes")
+		for _, key := range []string{"1/chunk.tar", "1/" + ManifestFile, "1/" + CompleteMarker, "1/stray.tar"} {
+			age("host/db/"+key, 1)
+		}
+		age("host/db/2/chunk.tar", 2)
+		age("host/db/3/chunk.tar", 3)
+		age("host/db/3/"+CompleteMarker, 3)
+
+		orphans, err := Orphans(store, "host/db", time.Hour)
+		So(err, ShouldBeNil)
+		sort.Strings(orphans)
+
+		Convey("Objects no complete backup refers to should be reported", func() {
+			So(orphans, ShouldResemble, []string{"host/db/1/stray.tar", "host/db/2/chunk.tar"})
+		})
+		Convey("Finding orphans should not delete them", func() {
+			for _, key := range orphans {
+				_, err := store.Stat(key)
+				So(err, ShouldBeNil)
+			}
+		})
+		Convey("Deleting them should leave every other object in place", func() {
+			So(DeleteOrphans(store, orphans), ShouldBeNil)
+			for _, key := range orphans {
+				_, err := store.Stat(key)
+				So(IsNotFound(err), ShouldBeTrue)
+			}
+			for _, key := range []string{"host/db/1/chunk.tar", "host/db/3/chunk.tar", "host/db/4/chunk.tar", "host/db/notes"} {
+				_, err := store.Stat(key)
+				So(err, ShouldBeNil)
+			}
+		})
+	})
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// ProgressFunc is told how far the transfer of path has come, total is -1 while it is not known.
+type ProgressFunc func(path string, done, total int64)
+
+// progress counts the bytes of one transfer, reporting them at most once per interval.
+type progress struct {
+	path     string
+	done     int64
+	total    int64
+	fn       ProgressFunc
+	interval time.Duration
+	last     time.Time
+}
+
+// add counts n more bytes, final reports them whatever the time since the last report.
+func (p *progress) add(n int, final bool) {
+	p.done += int64(n)
+	if p.fn == nil {
+		return
+	}
+	if final || time.Since(p.last) >= p.interval {
+		p.last = time.Now()
+		p.fn(p.path, p.done, p.total)
+	}
+}
+
+type progressReadCloser struct {
+	io.ReadCloser
+	p *progress
+}
+
+func (r *progressReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.p.add(n, err == io.EOF)
+	return n, err
+}
+
+type progressWriteCloser struct {
+	io.WriteCloser
+	p *progress
+}
+
+func (w *progressWriteCloser) Write(b []byte) (int, error) {
+	n, err := w.WriteCloser.Write(b)
+	w.p.add(n, false)
+	return n, err
+}
+
+// Close reports the final size once the object is stored.
+func (w *progressWriteCloser) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w.p.total = w.p.done
+	w.p.add(0, true)
+	return nil
+}
+
+// ProgressSaveFetcher wraps another SaveFetcher to report how far each save and fetch has come.
+// Put it below a GzipSaveFetcher to count the stored bytes, which are what the totals refer to.
+type ProgressSaveFetcher struct {
+	s  SaveFetcher
+	fn ProgressFunc
+	// Interval is the least time between two reports of a transfer, the last one is always made.
+	Interval time.Duration
+}
+
+func NewProgressSaveFetcher(s SaveFetcher, fn ProgressFunc) *ProgressSaveFetcher {
+	return &ProgressSaveFetcher{s: s, fn: fn, Interval: time.Second}
+}
+
+// Save reports the bytes written so far, the total is known once the writer is closed.
+func (p *ProgressSaveFetcher) Save(path string) (io.WriteCloser, error) {
+	return p.save(path, p.s.Save)
+}
+
+func (p *ProgressSaveFetcher) SaveNew(path string) (io.WriteCloser, error) {
+	return p.save(path, saveNewOf(p.s))
+}
+
+func (p *ProgressSaveFetcher) save(path string, open func(string) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	w, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &progressWriteCloser{w, &progress{path: path, total: -1, fn: p.fn, interval: p.Interval}}, nil
+}
+
+// Fetch reports the bytes read so far, out of the size of the file or the Content-Length from S3.
+func (p *ProgressSaveFetcher) Fetch(path string) (io.ReadCloser, error) {
+	r, err := p.s.Fetch(path)
+	if err != nil {
+		return nil, err
+	}
+	return &progressReadCloser{r, &progress{path: path, total: length(r), fn: p.fn, interval: p.Interval}}, nil
+}
+
+func (p *ProgressSaveFetcher) Walk(path string, walkfn WalkFunc) error {
+	w := p.s.(Walker)
+	return w.Walk(path, walkfn)
+}
+
+func (p *ProgressSaveFetcher) WalkIter(path string) Iterator {
+	w := p.s.(IterWalker)
+	return w.WalkIter(path)
+}
+
+func (p *ProgressSaveFetcher) WalkPrefixes(path string, walkfn WalkFunc) error {
+	w := p.s.(PrefixWalker)
+	return w.WalkPrefixes(path, walkfn)
+}
+
+func (p *ProgressSaveFetcher) Stat(path string) (ObjectInfo, error) {
+	return stat(p.s, path)
+}
+
+func (p *ProgressSaveFetcher) Delete(path string) error {
+	d := p.s.(Deleter)
+	return d.Delete(path)
+}
+
+// length tells the size of what r will read, -1 when it is not known.
+func length(r io.ReadCloser) int64 {
+	switch r := r.(type) {
+	case interface {
+		Length() int64
+	}:
+		return r.Length()
+	case *os.File:
+		if info, err := r.Stat(); err == nil {
+			return info.Size()
+		}
+	}
+	return -1
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestProgressSaveFetcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given a ProgressSaveFetcher over the filesystem reporting every transfer", t, func() {
+		var reports []string
+		p := NewProgressSaveFetcher(Filesystem{dir}, func(path string, done, total int64) {
+			reports = append(reports, fmt.Sprintf("%s %d/%d", path, done, total))
+		})
+		p.Interval = 0
+
+		Convey("Saving should report the bytes written and the total once closed", func() {
+			w, err := p.Save("dump/a")
+			So(err, ShouldBeNil)
+			w.Write([]byte("abc"))
+			w.Write([]byte("def"))
+			So(w.Close(), ShouldBeNil)
+			So(reports, ShouldResemble, []string{"dump/a 3/-1", "dump/a 6/-1", "dump/a 6/6"})
+		})
+		Convey("Fetching should report the bytes read out of the file size", func() {
+			So(ioutil.WriteFile(dir+"/b", []byte("abcdef"), 0600), ShouldBeNil)
+			r, err := p.Fetch("b")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "abcdef")
+			So(reports[len(reports)-1], ShouldEqual, "b 6/6")
+		})
+		Convey("A nil callback should be left alone", func() {
+			p := NewProgressSaveFetcher(Filesystem{dir}, nil)
+			w, err := p.Save("dump/c")
+			So(err, ShouldBeNil)
+			w.Write([]byte("abc"))
+			So(w.Close(), ShouldBeNil)
+		})
+	})
+}
+
+func TestS3FetchProgress(t *testing.T) {
+	setTestAwsKeys()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Foo"))
+	}))
+	defer ts.Close()
+
+	Convey("Fetching from S3 should report progress out of the Content-Length", t, func() {
+		var last string
+		p := NewProgressSaveFetcher(NewS3(ts.URL), func(path string, done, total int64) {
+			last = fmt.Sprintf("%d/%d", done, total)
+		})
+		r, err := p.Fetch("object")
+		So(err, ShouldBeNil)
+		defer r.Close()
+		ioutil.ReadAll(r)
+		So(last, ShouldEqual, "3/3")
+	})
+}
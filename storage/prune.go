@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CompleteMarker is saved below the root of a dump once all of its chunks have been stored.
+const CompleteMarker = "COMPLETE"
+
+// PruneMarker is saved below a backup by a Prune with a Grace, holding when it may be deleted.
+// Deleting it cancels the deletion. ProtectedMarker, saved by hand, exempts a backup from Prune.
+const (
+	PruneMarker     = "PRUNE_AFTER"
+	ProtectedMarker = "PROTECTED"
+)
+
+// PrunePolicy tells which backups Prune keeps. A backup is deleted when it falls outside every rule
+// that is set, so KeepLast and MaxAge together delete old backups but never the last few.
+type PrunePolicy struct {
+	// KeepLast keeps this many of the most recent complete backups, zero does not keep any by count.
+	// Incomplete backups, failed or still running, do not count towards it and are only deleted
+	// by MaxAge, so a failed dump never pushes out the last good one.
+	KeepLast int
+	// MaxAge keeps the backups modified within it, zero does not keep any by age.
+	MaxAge time.Duration
+	// DryRun only reports what would be deleted.
+	DryRun bool
+	// Labels restricts Prune to the complete backups whose manifest carries all of them. The others are
+	// neither deleted nor counted, so backups of one release can be kept longer by a policy of their own.
+	Labels map[string]string
+	// Grace has an expired backup marked with a PruneMarker instead of being deleted, and only
+	// deleted by a later Prune once Grace has passed and it is still expired.
+	Grace time.Duration
+}
+
+// Backup is one dump found by ListBackups, every object below one directory right under the prefix.
+type Backup struct {
+	Prefix string
+	// ModTime is when the most recent object of the backup was modified.
+	ModTime time.Time
+	Keys    []string
+	// Size is the sum of the stored sizes of its objects as listed, compressed when the dump was.
+	Size int64
+	// Complete tells if the backup has its COMPLETE marker.
+	Complete bool
+	// Labels are read from the manifest by Labeled, they are nil until then.
+	Labels map[string]string
+	// Protected is set by a ProtectedMarker, Prune never deletes such a backup nor counts it.
+	Protected bool
+	// PruneAfter is when a backup marked by Prune may be deleted, zero unless Prune returned it.
+	PruneAfter time.Time
+}
+
+// marker returns the key of the object named name in b, empty when it has none.
+func (b *Backup) marker(name string) string {
+	for _, key := range b.Keys {
+		if path.Base(key) == name {
+			return key
+		}
+	}
+	return ""
+}
+
+// ListBackups groups the objects below prefix into one backup per directory right under it, such as
+// host/db/<timestamp> for a prefix of host/db, newest first. Objects right below prefix are not part
+// of any backup and are not listed. Sizes come from the listing itself, so S3 sends no HEAD requests.
+func ListBackups(s SaveFetcher, prefix string) ([]Backup, error) {
+	backups, _, err := listBackups(s, prefix)
+	return backups, err
+}
+
+// listBackups is ListBackups also telling if an index was listed right below prefix.
+func listBackups(s SaveFetcher, prefix string) (backups []Backup, indexed bool, err error) {
+	walker, ok := s.(Walker)
+	if !ok {
+		return nil, false, errors.New("Storage cannot list its objects to find backups")
+	}
+	prefix = strings.Trim(prefix, "/")
+	groups := make(map[string]*Backup)
+	err = walker.Walk(prefix, func(fpath string, info ObjectInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, ok := relativeTo(prefix, fpath)
+		if !ok {
+			return nil
+		}
+		i := strings.Index(rel, "/")
+		if i < 0 {
+			indexed = indexed || rel == IndexFile
+			return nil
+		}
+		name := path.Join(prefix, rel[:i])
+		b, ok := groups[name]
+		if !ok {
+			b = &Backup{Prefix: name}
+			groups[name] = b
+		}
+		b.Keys = append(b.Keys, fpath)
+		b.Size += info.Size
+		switch path.Base(fpath) {
+		case CompleteMarker:
+			b.Complete = true
+		case ProtectedMarker:
+			b.Protected = true
+			return nil
+		case PruneMarker:
+			// Marking a backup does not make it any newer.
+			return nil
+		}
+		if info.ModTime.After(b.ModTime) {
+			b.ModTime = info.ModTime
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Newest first, ties broken by name so the result does not depend on listing order.
+	backups = make([]Backup, 0, len(groups))
+	for _, b := range groups {
+		backups = append(backups, *b)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].ModTime.Equal(backups[j].ModTime) {
+			return backups[i].ModTime.After(backups[j].ModTime)
+		}
+		return backups[i].Prefix > backups[j].Prefix
+	})
+	return backups, indexed, nil
+}
+
+// NthBackup returns the n-th most recent complete backup found by ListBackups below prefix,
+// 0 being the latest, so the one before a suspect backup can be restored instead.
+func NthBackup(s SaveFetcher, prefix string, n int) (Backup, error) {
+	backups, err := ListBackups(s, prefix)
+	if err != nil {
+		return Backup{}, err
+	}
+	complete := 0
+	for _, b := range backups {
+		if !b.Complete {
+			continue
+		}
+		if complete == n {
+			return b, nil
+		}
+		complete++
+	}
+	return Backup{}, errors.New(fmt.Sprintf("Only %d complete backups below %s, there is no backup %d", complete, prefix, n))
+}
+
+// Labeled returns the backups whose manifest carries every one of labels, with their Labels set.
+// Incomplete backups and those without a manifest have no labels, so any label leaves them out.
+func Labeled(s Fetcher, backups []Backup, labels map[string]string) ([]Backup, error) {
+	var labeled []Backup
+	for _, b := range backups {
+		if !b.Complete {
+			continue
+		}
+		manifest, err := ReadManifest(s, b.Prefix)
+		if IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		b.Labels = manifest.Labels
+		matches := true
+		for k, v := range labels {
+			if value, ok := b.Labels[k]; !ok || value != v {
+				matches = false
+			}
+		}
+		if matches {
+			labeled = append(labeled, b)
+		}
+	}
+	return labeled, nil
+}
+
+// Prune deletes the backups found by ListBackups below prefix which fall outside policy, oldest
+// first. The COMPLETE marker of a backup is deleted before its other objects, so a backup that could
+// only be partly deleted is not mistaken for a complete one. It returns the backups deleted,
+// or that would be deleted on a dry run. With a Grace the ones returned with a PruneAfter still
+// to come were only marked. A backup kept again after a change of policy has its mark removed.
+// The backups deleted are dropped from the index below prefix, if there is one.
+func Prune(s SaveFetcher, prefix string, policy PrunePolicy) ([]Backup, error) {
+	if policy.KeepLast <= 0 && policy.MaxAge <= 0 {
+		return nil, errors.New("Prune policy must set KeepLast or MaxAge, it would delete every backup")
+	}
+	if _, ok := s.(Walker); !ok {
+		return nil, errors.New("Storage cannot list its objects to prune them")
+	}
+	deleter, ok := s.(Deleter)
+	if !ok && !policy.DryRun {
+		return nil, errors.New("Storage cannot delete objects to prune them")
+	}
+	backups, indexed, err := listBackups(s, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(policy.Labels) > 0 {
+		if backups, err = Labeled(s, backups, policy.Labels); err != nil {
+			return nil, err
+		}
+	}
+
+	keep := make([]bool, len(backups))
+	complete := 0
+	now := time.Now()
+	for n, b := range backups {
+		if b.Protected {
+			keep[n] = true
+			continue
+		}
+		if b.Complete {
+			complete++
+			keep[n] = policy.KeepLast > 0 && complete <= policy.KeepLast
+		} else {
+			keep[n] = policy.MaxAge <= 0
+		}
+		if policy.MaxAge > 0 && now.Sub(b.ModTime) <= policy.MaxAge {
+			keep[n] = true
+		}
+	}
+	var expired []Backup
+	for n := len(backups) - 1; n >= 0; n-- {
+		b := backups[n]
+		if keep[n] {
+			if key := b.marker(PruneMarker); key != "" && !policy.DryRun {
+				if err := deleter.Delete(key); err != nil {
+					return expired, err
+				}
+			}
+			continue
+		}
+		if policy.Grace > 0 {
+			if b.PruneAfter, err = markExpired(s, b, now.Add(policy.Grace), policy.DryRun); err != nil {
+				return expired, err
+			}
+		}
+		expired = append(expired, b)
+	}
+	if policy.DryRun {
+		return expired, nil
+	}
+
+	deleted := make(map[string]bool)
+	for n, b := range expired {
+		if b.PruneAfter.After(now) {
+			continue
+		}
+		keys := append([]string{}, b.Keys...)
+		for i, key := range keys {
+			if path.Base(key) == CompleteMarker {
+				keys[0], keys[i] = keys[i], keys[0]
+			}
+		}
+		for _, key := range keys {
+			if err := deleter.Delete(key); err != nil {
+				return expired[:n], err
+			}
+		}
+		deleted[b.Prefix] = true
+	}
+	if indexed && len(deleted) > 0 {
+		if err := removeFromIndex(s, prefix, deleted); err != nil {
+			return expired, err
+		}
+	}
+	return expired, nil
+}
+
+// markExpired returns when b may be deleted, as read from its PruneMarker. A backup without one is
+// marked to be deleted after due, unless dryRun is set.
+func markExpired(s SaveFetcher, b Backup, due time.Time, dryRun bool) (time.Time, error) {
+	if key := b.marker(PruneMarker); key != "" {
+		r, err := s.Fetch(key)
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer r.Close()
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return time.Time{}, err
+		}
+		due, err := time.Parse(time.RFC3339, strings.TrimSpace(string(content)))
+		if err != nil {
+			return time.Time{}, errors.New(fmt.Sprintf("Malformed %s: %v", key, err))
+		}
+		return due, nil
+	}
+	due = due.UTC().Truncate(time.Second)
+	if dryRun {
+		return due, nil
+	}
+	w, err := s.Save(path.Join(b.Prefix, PruneMarker))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, err := fmt.Fprintln(w, due.Format(time.RFC3339)); err != nil {
+		w.Close()
+		return time.Time{}, err
+	}
+	return due, w.Close()
+}
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	Convey("Given four backups of a day, 2, 10 and 20 days ago", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := Filesystem{dir}
+		ages := map[string]int{"1": 20, "2": 10, "3": 2, "4": 1}
+		for name, days := range ages {
+			for _, object := range []string{"chunk1.tar", "chunk2.tar", CompleteMarker} {
+				key := path.Join("host/db", name, object)
+				w, err := store.Save(key)
+				So(err, ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+				modified := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+				So(os.Chtimes(path.Join(dir, key), modified, modified), ShouldBeNil)
+			}
+		}
+		w, err := store.Save("host/db/notes")
+		So(err, ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+
+		// remaining lists the backups which still have objects, deleting them leaves empty directories behind.
+		remaining := func() []string {
+			var names []string
+			store.Walk("host/db", func(fpath string, _ ObjectInfo, err error) error {
+				if dir := path.Dir(fpath); dir != "host/db" && (len(names) == 0 || names[len(names)-1] != dir) {
+					names = append(names, dir)
+				}
+				return err
+			})
+			return names
+		}
+		prefixes := func(backups []Backup) []string {
+			names := make([]string, len(backups))
+			for n, b := range backups {
+				names[n] = b.Prefix
+			}
+			return names
+		}
+
+		Convey("Keeping the last two should delete the oldest two with all of their objects", func() {
+			deleted, err := Prune(store, "host/db", PrunePolicy{KeepLast: 2})
+			So(err, ShouldBeNil)
+			So(prefixes(deleted), ShouldResemble, []string{"host/db/1", "host/db/2"})
+			So(deleted[0].Keys, ShouldHaveLength, 3)
+			So(remaining(), ShouldResemble, []string{"host/db/3", "host/db/4"})
+			_, err = store.Fetch("host/db/notes")
+			So(err, ShouldBeNil)
+		})
+		Convey("A maximum age should delete the backups older than it", func() {
+			deleted, err := Prune(store, "host/db", PrunePolicy{MaxAge: 5 * 24 * time.Hour})
+			So(err, ShouldBeNil)
+			So(prefixes(deleted), ShouldResemble, []string{"host/db/1", "host/db/2"})
+		})
+		Convey("Both rules should keep the last backups however old", func() {
+			deleted, err := Prune(store, "host/db", PrunePolicy{KeepLast: 3, MaxAge: time.Hour})
+			So(err, ShouldBeNil)
+			So(prefixes(deleted), ShouldResemble, []string{"host/db/1"})
+		})
+		Convey("A dry run should only tell what would be deleted", func() {
+			deleted, err := Prune(store, "host/db", PrunePolicy{KeepLast: 1, DryRun: true})
+			So(err, ShouldBeNil)
+			So(prefixes(deleted), ShouldResemble, []string{"host/db/1", "host/db/2", "host/db/3"})
+			So(remaining(), ShouldHaveLength, 4)
+		})
+		Convey("A failed newest dump should not count towards KeepLast", func() {
+			w, err := store.Save("host/db/5/chunk1.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+
+			deleted, err := Prune(store, "host/db", PrunePolicy{KeepLast: 1})
+			So(err, ShouldBeNil)
+			So(prefixes(deleted), ShouldResemble, []string{"host/db/1", "host/db/2", "host/db/3"})
+			So(remaining(), ShouldResemble, []string{"host/db/4", "host/db/5"})
+		})
+		Convey("An incomplete dump should only be deleted by MaxAge", func() {
+			w, err := store.Save("host/db/0/chunk1.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			modified := time.Now().Add(-30 * 24 * time.Hour)
+			So(os.Chtimes(path.Join(dir, "host/db/0/chunk1.tar"), modified, modified), ShouldBeNil)
+
+			deleted, err := Prune(store, "host/db", PrunePolicy{KeepLast: 3, DryRun: true})
+			So(err, ShouldBeNil)
+			So(prefixes(deleted), ShouldResemble, []string{"host/db/1"})
+			deleted, err = Prune(store, "host/db", PrunePolicy{KeepLast: 3, MaxAge: 5 * 24 * time.Hour, DryRun: true})
+			So(err, ShouldBeNil)
+			So(prefixes(deleted), ShouldResemble, []string{"host/db/0", "host/db/1"})
+		})
+		Convey("A policy keeping nothing should be refused", func() {
+			_, err := Prune(store, "host/db", PrunePolicy{})
+			So(err, ShouldNotBeNil)
+			So(remaining(), ShouldHaveLength, 4)
+		})
+	})
+}
+
+func TestPruneLabels(t *testing.T) {
+	Convey("Given complete backups of two releases, one without a manifest", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := Filesystem{dir}
+		releases := map[string]string{"1": "v2", "2": "v3", "3": "v2", "4": "v3", "5": ""}
+		for name, release := range releases {
+			manifest := NewManifestSaveFetcher(store)
+			if release != "" {
+				manifest.Labels = map[string]string{"release": release, "app": "web"}
+			}
+			root := path.Join("host/db", name)
+			for _, object := range []string{"chunk.tar", CompleteMarker} {
+				w, err := manifest.Save(path.Join(root, object))
+				So(err, ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+			}
+			if release != "" {
+				So(manifest.WriteManifest(root), ShouldBeNil)
+			}
+			days, _ := strconv.Atoi(name)
+			modified := time.Now().Add(-time.Duration(10-days) * 24 * time.Hour)
+			for _, object := range []string{"chunk.tar", CompleteMarker, ManifestFile} {
+				os.Chtimes(path.Join(dir, root, object), modified, modified)
+			}
+		}
+
+		Convey("The labels should be persisted in the manifest", func() {
+			manifest, err := ReadManifest(store, "host/db/2")
+			So(err, ShouldBeNil)
+			So(manifest.Labels, ShouldResemble, map[string]string{"release": "v3", "app": "web"})
+		})
+		Convey("Listing should filter the backups by every label given", func() {
+			backups, err := ListBackups(store, "host/db")
+			So(err, ShouldBeNil)
+			So(backups, ShouldHaveLength, 5)
+			v3, err := Labeled(store, backups, map[string]string{"release": "v3", "app": "web"})
+			So(err, ShouldBeNil)
+			So(v3, ShouldHaveLength, 2)
+			So(v3[0].Prefix, ShouldEqual, "host/db/4")
+			So(v3[1].Prefix, ShouldEqual, "host/db/2")
+			So(v3[0].Labels["release"], ShouldEqual, "v3")
+			none, err := Labeled(store, backups, map[string]string{"release": "v3", "app": "api"})
+			So(err, ShouldBeNil)
+			So(none, ShouldBeEmpty)
+		})
+		Convey("Pruning by label should only consider the backups carrying it", func() {
+			deleted, err := Prune(store, "host/db", PrunePolicy{KeepLast: 1, Labels: map[string]string{"release": "v2"}})
+			So(err, ShouldBeNil)
+			So(deleted, ShouldHaveLength, 1)
+			So(deleted[0].Prefix, ShouldEqual, "host/db/1")
+			backups, err := ListBackups(store, "host/db")
+			So(err, ShouldBeNil)
+			So(backups, ShouldHaveLength, 4)
+		})
+	})
+}
+
+func TestListBackupSizes(t *testing.T) {
+	setTestAwsKeys()
+	keys := []string{
+		"host/db/1/COMPLETE", "host/db/1/a.tar", "host/db/1/b.tar", "host/db/2/a.tar", "host/db/index.json", "other/db/1/a.tar",
+	}
+	lists := 0
+	ts := listingServer(keys, 2, &lists)
+	defer ts.Close()
+
+	Convey("Given a bucket holding two backups below a prefix", t, func() {
+		backups, err := ListBackups(NewS3(ts.URL), "host/db")
+		So(err, ShouldBeNil)
+
+		Convey("Each backup should total the sizes of its objects from the listing alone", func() {
+			So(backups, ShouldHaveLength, 2)
+			sizes := map[string]int64{}
+			for _, b := range backups {
+				sizes[b.Prefix] = b.Size
+			}
+			So(sizes, ShouldResemble, map[string]int64{"host/db/1": 9, "host/db/2": 3})
+			So(lists, ShouldEqual, 3)
+		})
+	})
+}
+
+func TestPruneGrace(t *testing.T) {
+	Convey("Given three complete backups of 3, 2 and 1 days ago", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := Filesystem{dir}
+		save := func(key, content string) {
+			w, err := store.Save(key)
+			So(err, ShouldBeNil)
+			w.Write([]byte(content))
+			So(w.Close(), ShouldBeNil)
+		}
+		for name, days := range map[string]int{"1": 3, "2": 2, "3": 1} {
+			for _, object := range []string{"chunk.tar", CompleteMarker} {
+				key := path.Join("host/db", name, object)
+				save(key, "")
+				modified := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+				So(os.Chtimes(path.Join(dir, key), modified, modified), ShouldBeNil)
+			}
+		}
+		exists := func(key string) bool {
+			_, err := store.Stat(key)
+			return err == nil
+		}
+		policy := PrunePolicy{KeepLast: 1, Grace: 24 * time.Hour}
+
+		Convey("Backups within the grace window should be marked but not deleted", func() {
+			expired, err := Prune(store, "host/db", policy)
+			So(err, ShouldBeNil)
+			So(expired, ShouldHaveLength, 2)
+			So(expired[0].PruneAfter.After(time.Now().Add(23*time.Hour)), ShouldBeTrue)
+			So(exists("host/db/1/chunk.tar"), ShouldBeTrue)
+			So(exists("host/db/1/"+PruneMarker), ShouldBeTrue)
+			So(exists("host/db/2/"+PruneMarker), ShouldBeTrue)
+			So(exists("host/db/3/"+PruneMarker), ShouldBeFalse)
+
+			Convey("Marking them should not make them any newer", func() {
+				backups, err := ListBackups(store, "host/db")
+				So(err, ShouldBeNil)
+				So(backups[2].Prefix, ShouldEqual, "host/db/1")
+				So(time.Since(backups[2].ModTime), ShouldBeGreaterThan, 47*time.Hour)
+			})
+			Convey("A second run before the window has passed should leave them alone", func() {
+				_, err := Prune(store, "host/db", policy)
+				So(err, ShouldBeNil)
+				So(exists("host/db/1/chunk.tar"), ShouldBeTrue)
+			})
+			Convey("Once the window has passed they should be deleted", func() {
+				save("host/db/1/"+PruneMarker, time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+				_, err := Prune(store, "host/db", policy)
+				So(err, ShouldBeNil)
+				So(exists("host/db/1/chunk.tar"), ShouldBeFalse)
+				So(exists("host/db/1/"+PruneMarker), ShouldBeFalse)
+				So(exists("host/db/2/chunk.tar"), ShouldBeTrue)
+			})
+			Convey("A backup kept again should lose its mark", func() {
+				_, err := Prune(store, "host/db", PrunePolicy{KeepLast: 2, Grace: time.Hour})
+				So(err, ShouldBeNil)
+				So(exists("host/db/2/"+PruneMarker), ShouldBeFalse)
+				So(exists("host/db/1/"+PruneMarker), ShouldBeTrue)
+			})
+		})
+		Convey("A protected backup should never be deleted nor counted", func() {
+			save("host/db/1/"+ProtectedMarker, "")
+			expired, err := Prune(store, "host/db", PrunePolicy{MaxAge: time.Hour})
+			So(err, ShouldBeNil)
+			So(expired, ShouldHaveLength, 2)
+			So(exists("host/db/1/chunk.tar"), ShouldBeTrue)
+			So(exists("host/db/1/"+PruneMarker), ShouldBeFalse)
+			So(exists("host/db/2/chunk.tar"), ShouldBeFalse)
+
+			_, err = Prune(store, "host/db", PrunePolicy{KeepLast: 1})
+			So(err, ShouldBeNil)
+			So(exists("host/db/1/chunk.tar"), ShouldBeTrue)
+		})
+	})
+}
+
+func TestNthBackup(t *testing.T) {
+	Convey("Given three complete backups and a newer failed one", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := Filesystem{dir}
+		for name, days := range map[string]int{"1": 3, "2": 2, "3": 1, "4": 0} {
+			objects := []string{"chunk.tar", CompleteMarker}
+			if name == "4" {
+				objects = objects[:1]
+			}
+			for _, object := range objects {
+				key := path.Join("host/db", name, object)
+				w, err := store.Save(key)
+				So(err, ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+				modified := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+				So(os.Chtimes(path.Join(dir, key), modified, modified), ShouldBeNil)
+			}
+		}
+
+		Convey("Counting should start at the latest complete backup", func() {
+			for n, want := range []string{"host/db/3", "host/db/2", "host/db/1"} {
+				b, err := NthBackup(store, "/host/db", n)
+				So(err, ShouldBeNil)
+				So(b.Prefix, ShouldEqual, want)
+			}
+		})
+		Convey("Asking past the oldest should tell how many there are", func() {
+			_, err := NthBackup(store, "host/db", 3)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Only 3 complete backups")
+		})
+	})
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// FetchRange reads length bytes of the object at path from offset, or up to its end when length
+// is negative, so a download that failed part way can carry on where it stopped.
+func (s S3) FetchRange(path string, offset, length int64) (io.ReadCloser, error) {
+	if err := s.checkAwsKeys(); err != nil {
+		return nil, err
+	}
+	return s.fetchRange(context.Background(), path, offset, length, "")
+}
+
+// fetchRange requests a range of the object, only from the version with etag unless it is empty.
+func (s S3) fetchRange(ctx context.Context, path string, offset, length int64, etag string) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid offset %d fetching %s", offset, path))
+	}
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	spec := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		spec += strconv.FormatInt(offset+length-1, 10)
+	}
+	resp, err := s.get(ctx, path, func(req *http.Request) {
+		req.Header.Set("Range", spec)
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		drain(resp.Body)
+		return nil, errors.New(fmt.Sprintf("Expected 206 Partial Content fetching %s, got: %d", path, resp.StatusCode))
+	}
+	first, last, err := parseContentRange(resp.Header.Get("Content-Range"))
+	// The last byte may come before the requested one when the object is shorter.
+	if err == nil && (first != offset || length > 0 && last > offset+length-1) {
+		err = errors.New(fmt.Sprintf("Content-Range %s does not match the requested %s", resp.Header.Get("Content-Range"), spec))
+	}
+	if err != nil {
+		drain(resp.Body)
+		return nil, err
+	}
+	return &httpBody{ReadCloser: s.Throttle.readCloser(resp.Body), length: last - first + 1}, nil
+}
+
+// parseContentRange reads the first and last byte of a "bytes first-last/size" Content-Range.
+func parseContentRange(h string) (first, last int64, err error) {
+	var size string
+	if _, err := fmt.Sscanf(h, "bytes %d-%d/%s", &first, &last, &size); err != nil || last < first {
+		return 0, 0, errors.New("Invalid Content-Range: " + h)
+	}
+	return first, last, nil
+}
+
+// FetchParallel downloads the object at path as parts byte ranges, up to concurrency of them at the
+// same time, and reads them back in order as one stream, much like aws s3 cp does for large objects.
+// A part is held in memory from when it is requested until it has been read, so at most concurrency
+// parts of the object are buffered. Parts are only fetched from the version of the object found by
+// the Stat, a part failing for more than MaxRetries fails reading.
+func (s S3) FetchParallel(path string, parts, concurrency int) (io.ReadCloser, error) {
+	info, err := s.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if parts < 1 {
+		parts = 1
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	partSize := (info.Size + int64(parts) - 1) / int64(parts)
+	if partSize == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	parts = int((info.Size + partSize - 1) / partSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &parallelBody{
+		results: make([]chan partResult, parts),
+		slots:   make(chan struct{}, concurrency),
+		cancel:  cancel,
+		length:  info.Size,
+	}
+	for n := range b.results {
+		b.results[n] = make(chan partResult, 1)
+	}
+	etag := ""
+	if info.ETag != "" {
+		etag = `"` + info.ETag + `"`
+	}
+	go func() {
+		for n := 0; n < parts; n++ {
+			select {
+			case b.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			offset := int64(n) * partSize
+			length := partSize
+			if offset+length > info.Size {
+				length = info.Size - offset
+			}
+			go func(result chan partResult) {
+				data, err := s.fetchPart(ctx, path, offset, length, etag)
+				result <- partResult{data, err}
+			}(b.results[n])
+		}
+	}()
+	return b, nil
+}
+
+// fetchPart reads a range of the object to memory, resuming it where it stopped as Fetch does.
+// Without an etag another version of the object could be resumed into this one, so it is not.
+func (s S3) fetchPart(ctx context.Context, path string, offset, length int64, etag string) ([]byte, error) {
+	r, err := s.fetchRange(ctx, path, offset, length, etag)
+	if err != nil {
+		return nil, err
+	}
+	b := r.(*httpBody)
+	defer b.Close()
+	if etag != "" {
+		b.retries = s.MaxRetries
+		b.resume = func(read int64) (io.ReadCloser, error) {
+			return s.fetchRange(ctx, path, offset+read, length-read, etag)
+		}
+	}
+	return ioutil.ReadAll(b)
+}
+
+type partResult struct {
+	data []byte
+	err  error
+}
+
+// parallelBody reads the parts of FetchParallel in order, a slot is given back once a part is read.
+type parallelBody struct {
+	results []chan partResult
+	next    int
+	part    *bytes.Reader
+	err     error
+	slots   chan struct{}
+	cancel  context.CancelFunc
+	length  int64
+}
+
+func (b *parallelBody) Read(p []byte) (int, error) {
+	for b.err == nil {
+		if b.part != nil && b.part.Len() > 0 {
+			return b.part.Read(p)
+		}
+		if b.part != nil {
+			b.part = nil
+			<-b.slots
+		}
+		if b.next == len(b.results) {
+			return 0, io.EOF
+		}
+		result := <-b.results[b.next]
+		if result.err != nil {
+			b.err = errors.New(fmt.Sprintf("Fetching part %d of %d: %v", b.next+1, len(b.results), result.err))
+			b.cancel()
+			break
+		}
+		b.next++
+		b.part = bytes.NewReader(result.data)
+	}
+	return 0, b.err
+}
+
+// Length is the size of the whole object.
+func (b *parallelBody) Length() int64 {
+	return b.length
+}
+
+// Close stops fetching the parts not read yet.
+func (b *parallelBody) Close() error {
+	b.cancel()
+	return nil
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// rangeServer serves one object honouring Range and If-Match, dropping the connection part way
+// through a whole object when drop is set.
+type rangeServer struct {
+	content  []byte
+	etag     string
+	drop     bool
+	badRange bool
+	// fail answers a server error to requests for this range.
+	fail     string
+	mu       sync.Mutex
+	requests []string
+}
+
+func (rs *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	spec := r.Header.Get("Range")
+	rs.mu.Lock()
+	rs.requests = append(rs.requests, strings.TrimSpace(r.Method+" "+spec))
+	rs.mu.Unlock()
+	if spec != "" && spec == rs.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if m := r.Header.Get("If-Match"); m != "" && m != rs.etag {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	w.Header().Set("ETag", rs.etag)
+	w.Header().Set("Last-Modified", "Sun, 01 Jun 2014 12:00:00 GMT")
+	if spec == "" {
+		w.Header().Set("Content-Length", fmt.Sprint(len(rs.content)))
+		if !rs.drop {
+			w.Write(rs.content)
+			return
+		}
+		w.Write(rs.content[:300])
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+		return
+	}
+	var first, last int
+	if n, _ := fmt.Sscanf(spec, "bytes=%d-%d", &first, &last); n == 1 || last >= len(rs.content) {
+		last = len(rs.content) - 1
+	}
+	if first >= len(rs.content) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if rs.badRange {
+		first++
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(rs.content)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(rs.content[first : last+1])
+}
+
+func TestS3FetchRange(t *testing.T) {
+	setTestAwsKeys()
+	rs := &rangeServer{}
+	ts := httptest.NewServer(rs)
+	defer ts.Close()
+
+	Convey("Given an object of 1000 bytes", t, func() {
+		rs.content = bytes.Repeat([]byte("0123456789"), 100)
+		rs.etag = `"v1"`
+		rs.drop, rs.badRange, rs.fail, rs.requests = false, false, "", nil
+		s := NewS3(ts.URL)
+
+		Convey("FetchRange should give the requested bytes only", func() {
+			r, err := s.FetchRange("dump/a.tar", 105, 50)
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, string(rs.content[105:155]))
+			So(r.(*httpBody).Length(), ShouldEqual, 50)
+			So(rs.requests, ShouldResemble, []string{"GET bytes=105-154"})
+		})
+		Convey("FetchRange without a length should read up to the end", func() {
+			r, err := s.FetchRange("dump/a.tar", 900, -1)
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, string(rs.content[900:]))
+		})
+		Convey("A Content-Range not matching the request should fail", func() {
+			rs.badRange = true
+			_, err := s.FetchRange("dump/a.tar", 100, 10)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "does not match")
+		})
+		Convey("A range past the end should fail", func() {
+			_, err := s.FetchRange("dump/a.tar", 1000, -1)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "past the end")
+		})
+		Convey("Fetch should resume a dropped connection from the last byte read", func() {
+			rs.drop = true
+			r, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(b, rs.content), ShouldBeTrue)
+			So(rs.requests, ShouldResemble, []string{"GET", "GET bytes=300-"})
+		})
+		Convey("Fetch should not resume into another version of the object", func() {
+			rs.drop = true
+			r, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			rs.etag = `"v2"`
+			_, err = ioutil.ReadAll(r)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Fetch should not resume without retries", func() {
+			rs.drop = true
+			s.MaxRetries = 0
+			r, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			_, err = ioutil.ReadAll(r)
+			So(err, ShouldNotBeNil)
+			So(rs.requests, ShouldHaveLength, 1)
+		})
+	})
+}
+
+func TestS3FetchParallel(t *testing.T) {
+	setTestAwsKeys()
+	rs := &rangeServer{}
+	ts := httptest.NewServer(rs)
+	defer ts.Close()
+
+	Convey("Given an object of 1000 bytes", t, func() {
+		rs.content = bytes.Repeat([]byte("0123456789"), 100)
+		rs.etag = `"v1"`
+		rs.fail, rs.requests = "", nil
+		s := NewS3(ts.URL)
+
+		Convey("FetchParallel should read the parts back in order", func() {
+			r, err := s.FetchParallel("dump/a.tar", 7, 3)
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(b, rs.content), ShouldBeTrue)
+			So(r.(*parallelBody).Length(), ShouldEqual, 1000)
+			So(rs.requests[0], ShouldEqual, "HEAD")
+			So(rs.requests, ShouldHaveLength, 8)
+			So(rs.requests, ShouldContain, "GET bytes=858-999")
+		})
+		Convey("A part failing should fail reading", func() {
+			s.MaxRetries = 0
+			rs.fail = "bytes=500-749"
+			r, err := s.FetchParallel("dump/a.tar", 4, 2)
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "part 3 of 4")
+			So(string(b), ShouldEqual, string(rs.content[:500]))
+		})
+		Convey("Closing early should not wait for the other parts", func() {
+			r, err := s.FetchParallel("dump/a.tar", 10, 2)
+			So(err, ShouldBeNil)
+			buf := make([]byte, 10)
+			_, err = r.Read(buf)
+			So(err, ShouldBeNil)
+			So(r.Close(), ShouldBeNil)
+		})
+	})
+}
+
+func TestFilesystemFetchRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given an object on the filesystem", t, func() {
+		store := Filesystem{dir}
+		w, err := store.Save("dump/a.tar")
+		So(err, ShouldBeNil)
+		w.Write([]byte("0123456789"))
+		So(w.Close(), ShouldBeNil)
+
+		Convey("FetchRange should give the requested bytes only", func() {
+			r, err := store.FetchRange("dump/a.tar", 3, 4)
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "3456")
+		})
+		Convey("FetchRange without a length should read up to the end", func() {
+			r, err := store.FetchRange("dump/a.tar", 7, -1)
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "789")
+		})
+	})
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// bucketRedirects remembers the endpoints S3 redirected a bucket to, by the host it was first asked on.
+type bucketRedirects struct {
+	mu    sync.Mutex
+	hosts map[string]string
+}
+
+func newBucketRedirects() *bucketRedirects {
+	return &bucketRedirects{hosts: make(map[string]string)}
+}
+
+// redirected returns the bucket URL with its host replaced by the one S3 redirected it to, if any.
+func (s S3) redirected(bucket string) string {
+	if s.redirects == nil {
+		return bucket
+	}
+	u, err := url.Parse(bucket)
+	if err != nil {
+		return bucket
+	}
+	s.redirects.mu.Lock()
+	host, ok := s.redirects.hosts[u.Host]
+	s.redirects.mu.Unlock()
+	if !ok {
+		return bucket
+	}
+	u.Host = host
+	return u.String()
+}
+
+// learnRedirect tells if resp sends the bucket to another endpoint, a bucket in another region than
+// the one asked, and remembers the endpoint so the request can be made again there. The body of any
+// other response is left as it was.
+func (s S3) learnRedirect(resp *http.Response) bool {
+	if s.redirects == nil || resp.Request == nil ||
+		resp.StatusCode != http.StatusMovedPermanently && resp.StatusCode != http.StatusTemporaryRedirect {
+		return false
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	resp.Body = readCloser{io.MultiReader(bytes.NewReader(msg), resp.Body), resp.Body}
+	from := resp.Request.URL.Host
+	to := redirectHost(resp, msg)
+	if to == "" || to == from {
+		return false
+	}
+	s.redirects.mu.Lock()
+	defer s.redirects.mu.Unlock()
+	for first, host := range s.redirects.hosts {
+		if host == from {
+			s.redirects.hosts[first] = to
+		}
+	}
+	s.redirects.hosts[from] = to
+	return true
+}
+
+// redirectHost finds the endpoint a redirect points to, from the Endpoint of its error document,
+// its Location or the region in its x-amz-bucket-region header, in that order.
+func redirectHost(resp *http.Response, body []byte) string {
+	var doc struct {
+		Endpoint string
+	}
+	host := ""
+	if xml.Unmarshal(body, &doc) == nil && doc.Endpoint != "" {
+		host = doc.Endpoint
+	} else if loc, err := resp.Location(); err == nil {
+		host = loc.Host
+	} else if region := resp.Header.Get("x-amz-bucket-region"); region != "" {
+		return regionHost(resp.Request.URL.Host, region)
+	}
+	// Endpoints name the bucket as a subdomain, even when it is addressed by path.
+	bucket := strings.SplitN(strings.TrimLeft(resp.Request.URL.Path, "/"), "/", 2)[0] + "."
+	if bucket != "." && strings.HasPrefix(host, bucket) && !strings.HasPrefix(resp.Request.URL.Host, bucket) {
+		host = strings.TrimPrefix(host, bucket)
+	}
+	return host
+}
+
+// s3Host matches the S3 endpoint part of a host, with or without a region.
+var s3Host = regexp.MustCompile(`(^|\.)s3([.-][a-z0-9-]+)?\.amazonaws\.com$`)
+
+// regionHost gives the host of the S3 endpoint of region in place of the one of host,
+// empty if host is not on AWS.
+func regionHost(host, region string) string {
+	if !s3Host.MatchString(host) {
+		return ""
+	}
+	return s3Host.ReplaceAllString(host, "${1}s3."+region+".amazonaws.com")
+}
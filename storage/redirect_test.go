@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestS3Redirect(t *testing.T) {
+	setTestAwsKeys()
+	var wrong, right []string
+	regional := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		right = append(right, r.Method+" "+r.URL.Path)
+		w.Write([]byte("Foo"))
+	}))
+	defer regional.Close()
+	host := strings.TrimPrefix(regional.URL, "http://")
+	permanent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrong = append(wrong, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusMovedPermanently)
+		fmt.Fprintf(w, "<Error><Code>PermanentRedirect</Code><Endpoint>%s</Endpoint></Error>", host)
+	}))
+	defer permanent.Close()
+	temporary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrong = append(wrong, r.Method+" "+r.URL.Path)
+		w.Header().Set("Location", regional.URL+r.URL.Path)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer temporary.Close()
+
+	Convey("Given a bucket S3 redirects to another region", t, func() {
+		wrong, right = nil, nil
+		s := NewS3(permanent.URL)
+
+		Convey("Fetch should follow the endpoint of the redirect", func() {
+			r, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			b, _ := ioutil.ReadAll(r)
+			r.Close()
+			So(string(b), ShouldEqual, "Foo")
+			So(wrong, ShouldResemble, []string{"GET /dump/a.tar"})
+			So(right, ShouldResemble, []string{"GET /dump/a.tar"})
+		})
+		Convey("Later requests should go straight to the endpoint", func() {
+			r, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			r.Close()
+			w, err := s.Save("dump/b.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("Bar"))
+			So(w.Close(), ShouldBeNil)
+			So(wrong, ShouldHaveLength, 1)
+			So(right, ShouldResemble, []string{"GET /dump/a.tar", "PUT /dump/b.tar"})
+		})
+		Convey("Save should follow the redirect as well", func() {
+			w, err := s.Save("dump/b.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("Bar"))
+			So(w.Close(), ShouldBeNil)
+			So(wrong, ShouldResemble, []string{"PUT /dump/b.tar"})
+			So(right, ShouldResemble, []string{"PUT /dump/b.tar"})
+		})
+		Convey("A temporary redirect should be followed to its Location", func() {
+			s := NewS3(temporary.URL)
+			r, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			r.Close()
+			So(wrong, ShouldResemble, []string{"GET /dump/a.tar"})
+			So(right, ShouldResemble, []string{"GET /dump/a.tar"})
+		})
+	})
+}
+
+func TestRegionHost(t *testing.T) {
+	Convey("The host of a bucket in another region should be derived from the region", t, func() {
+		So(regionHost("mongotool.s3.amazonaws.com", "eu-west-1"), ShouldEqual, "mongotool.s3.eu-west-1.amazonaws.com")
+		So(regionHost("mongotool.s3-us-west-2.amazonaws.com", "eu-west-1"), ShouldEqual, "mongotool.s3.eu-west-1.amazonaws.com")
+		So(regionHost("s3.us-east-2.amazonaws.com", "ap-south-1"), ShouldEqual, "s3.ap-south-1.amazonaws.com")
+		So(regionHost("minio.example.com", "eu-west-1"), ShouldEqual, "")
+	})
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// retryPolicy tells how often and how fast a request failing in a transient way is sent again.
+type retryPolicy struct {
+	max   int
+	delay time.Duration
+}
+
+// idempotent tells if a request can be sent again without changing the outcome.
+func idempotent(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "PUT" || method == "DELETE"
+}
+
+// transient tells if a request failed in a way worth trying again, such as a reset connection,
+// or an error document isTransient tells is. Other errors will fail the same way again.
+func transient(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if resp.StatusCode < 400 {
+		return false
+	}
+	return isTransient(peekS3Error(resp))
+}
+
+// peekS3Error parses the error document of resp, leaving its body to be read again by the caller.
+func peekS3Error(resp *http.Response) *S3Error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	return s3ErrorOf(resp.StatusCode, body)
+}
+
+// backoff returns how long to wait before retry n, counting from zero.
+// The delay doubles with each retry and up to as much again is added at random,
+// so writers throttled together don't all come back at the same time.
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.delay << uint(n)
+	return d + time.Duration(rand.Int63n(int64(d)+1))
+}
+
+// send does the request made by build, making and doing it again while it fails in a transient way.
+// It is rebuilt for every attempt, so it gets signed again and has a fresh body.
+// The last response is returned as it is, for the caller to report.
+func (p retryPolicy) send(build func() (*http.Request, error), do func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	for n := 0; ; n++ {
+		req, err := build()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := do(req)
+		ctx := req.Context()
+		if n >= p.max || !idempotent(req.Method) || !transient(resp, err) || ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil {
+			drain(resp.Body)
+		}
+		select {
+		case <-time.After(p.backoff(n)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
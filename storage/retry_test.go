@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first requests with status, then answers 200 OK.
+type flakyServer struct {
+	mu       sync.Mutex
+	failures int
+	status   int
+	requests []string
+	bodies   []string
+	signed   int
+	// document is the error document of the failures.
+	document string
+}
+
+func (f *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	f.requests = append(f.requests, r.Method)
+	f.bodies = append(f.bodies, string(body))
+	if r.Header.Get("Authorization") != "" {
+		f.signed++
+	}
+	if f.failures != 0 {
+		f.failures--
+		w.WriteHeader(f.status)
+		w.Write([]byte(f.document))
+		return
+	}
+	w.Write([]byte("Foo"))
+}
+
+func TestS3Retry(t *testing.T) {
+	setTestAwsKeys()
+	Convey("Given a bucket failing now and then", t, func() {
+		fake := &flakyServer{}
+		ts := httptest.NewServer(fake)
+		defer ts.Close()
+		s := NewS3(ts.URL)
+		s.RetryDelay = time.Millisecond
+
+		Convey("Fetch should be retried on a 503 until it succeeds", func() {
+			fake.failures, fake.status = 2, http.StatusServiceUnavailable
+			r, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, _ := ioutil.ReadAll(r)
+			So(string(b), ShouldEqual, "Foo")
+			So(fake.requests, ShouldResemble, []string{"GET", "GET", "GET"})
+			So(fake.signed, ShouldEqual, 3)
+		})
+		Convey("Fetch should give up after MaxRetries", func() {
+			fake.failures, fake.status = -1, http.StatusInternalServerError
+			_, err := s.Fetch("dump/a.tar")
+			So(err, ShouldNotBeNil)
+			So(len(fake.requests), ShouldEqual, 1+s.MaxRetries)
+		})
+		Convey("A 403 should fail at once", func() {
+			fake.failures, fake.status = 1, http.StatusForbidden
+			_, err := s.Fetch("dump/a.tar")
+			So(err, ShouldNotBeNil)
+			So(fake.requests, ShouldResemble, []string{"GET"})
+		})
+		Convey("A 400 RequestTimeout should be retried", func() {
+			fake.failures, fake.status = 1, http.StatusBadRequest
+			fake.document = "<Error><Code>RequestTimeout</Code></Error>"
+			_, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{"GET", "GET"})
+		})
+		Convey("Another 400 should fail at once with its error document", func() {
+			fake.failures, fake.status = 1, http.StatusBadRequest
+			fake.document = "<Error><Code>InvalidArgument</Code><Message>Bad range</Message></Error>"
+			_, err := s.Fetch("dump/a.tar")
+			So(err, ShouldNotBeNil)
+			So(err.(*S3Error).Code, ShouldEqual, "InvalidArgument")
+			So(err.(*S3Error).Message, ShouldEqual, "Bad range")
+			So(fake.requests, ShouldResemble, []string{"GET"})
+		})
+		Convey("A PUT should be sent again with all of its body", func() {
+			fake.failures, fake.status = 1, http.StatusInternalServerError
+			w, err := s.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{"PUT", "PUT"})
+			So(fake.bodies, ShouldResemble, []string{"foo", "foo"})
+		})
+		Convey("Initiating a multipart upload should not be retried", func() {
+			fake.failures, fake.status = 1, http.StatusInternalServerError
+			s.PartSize = 2
+			w, err := s.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			_, err = w.Write(bytes.Repeat([]byte("x"), 3))
+			So(err, ShouldNotBeNil)
+			So(fake.requests, ShouldResemble, []string{"POST"})
+		})
+		Convey("Cancelling the context should stop waiting for the next attempt", func() {
+			fake.failures, fake.status = -1, http.StatusInternalServerError
+			s.RetryDelay = time.Hour
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := s.FetchContext(ctx, "dump/a.tar")
+			So(err, ShouldEqual, context.DeadlineExceeded)
+			So(fake.requests, ShouldResemble, []string{"GET"})
+		})
+	})
+}
@@ -2,14 +2,21 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/smartystreets/go-aws-auth"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,76 +24,400 @@ import (
 
 var signMu sync.Mutex
 
-// requestBuilder is something that can sign and return a http.Request for S3.
-type requestBuilder func(method, bucket, path string, body io.Reader) (req *http.Request, err error)
+// maxErrorBody is how much of an unexpected response is included in an error.
+const maxErrorBody = 4 * 1024
 
-// s3FileWriter takes care of buffering all written data for one S3 object until ready to be sent.
+// maxDrain is how much of an unread response body is read away when closing it, so its connection
+// can be reused. The connection is dropped instead when more is left.
+const maxDrain = 64 * 1024
+
+// drain reads what is left of body up to maxDrain and closes it.
+func drain(body io.ReadCloser) error {
+	io.Copy(ioutil.Discard, io.LimitReader(body, maxDrain))
+	return body.Close()
+}
+
+// requestBuilder is something that can sign and return a http.Request for S3, part tells a request
+// on a multipart upload in progress, such as sending a part or completing it, from one on the object.
+type requestBuilder func(method, bucket, path string, part bool, body io.Reader) (req *http.Request, err error)
+
+// s3FileWriter takes care of buffering written data for one S3 object until ready to be sent.
+// Objects growing past partSize are sent as a multipart upload, one part at a time, so at most
+// one part is held in memory.
 type s3FileWriter struct {
-	bytes.Buffer
+	buf     bytes.Buffer
 	path    string
 	bucket  string
 	builder requestBuilder
-	closed  bool
+	limit   *AdaptiveLimit
+	client  *http.Client
+	// throttle bounds the bandwidth of the bodies sent, nil does not.
+	throttle *Throttle
+	// skipEmpty stores nothing when nothing was written.
+	skipEmpty bool
+	// partSize is how much to buffer before starting a multipart upload, zero never does.
+	partSize int
+	uploadId string
+	parts    []s3Part
+	// resume looks for an upload of the same key in progress before initiating one, listed holds
+	// the parts S3 listed for it.
+	resume bool
+	listed map[int]listedPart
+	retry  retryPolicy
+	// md5ETag is set when S3 answers uploads with the MD5 of what it stored, which it does not for aws:kms.
+	md5ETag bool
+	// ctx cancels the requests of the upload, nil never does.
+	ctx context.Context
+	// redirect tells if a response moved the bucket to another endpoint, which builder then asks.
+	redirect func(resp *http.Response) bool
+	err      error
+	closed   bool
 }
 
-func news3FileWriter(bucket, path string, builder requestBuilder) *s3FileWriter {
+func news3FileWriter(bucket, path string, builder requestBuilder, client *http.Client) *s3FileWriter {
 	sf := s3FileWriter{
 		bucket:  bucket,
 		path:    path,
 		builder: builder,
+		client:  client,
 	}
 	return &sf
 }
 
-// Close will send the buffered data to S3 using the requestBuilder.
+// Write buffers p, sending a part whenever a full one has been buffered.
+func (sf *s3FileWriter) Write(p []byte) (int, error) {
+	if sf.err != nil {
+		return 0, sf.err
+	}
+	if sf.ctx != nil && sf.ctx.Err() != nil {
+		sf.fail(sf.ctx.Err())
+		return 0, sf.err
+	}
+	n, _ := sf.buf.Write(p)
+	for sf.partSize > 0 && sf.buf.Len() >= sf.partSize {
+		if err := sf.uploadPart(sf.buf.Next(sf.partSize)); err != nil {
+			sf.fail(err)
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Len is the number of buffered bytes not yet sent.
+func (sf *s3FileWriter) Len() int {
+	return sf.buf.Len()
+}
+
+// Close will send the buffered data to S3 using the requestBuilder, closing again returns the same error.
 func (sf *s3FileWriter) Close() error {
 	if sf.closed {
-		return nil
+		return sf.err
 	}
 	sf.closed = true
-
-	req, err := sf.builder("PUT", sf.bucket, sf.path, bytes.NewReader(sf.Bytes()))
-	if err != nil {
-		return err
+	if sf.err != nil {
+		return sf.err
 	}
-	client := http.DefaultClient
+	if sf.uploadId != "" {
+		if sf.buf.Len() > 0 {
+			if err := sf.uploadPart(sf.buf.Bytes()); err != nil {
+				sf.fail(err)
+				return err
+			}
+		}
+		if err := sf.complete(); err != nil {
+			sf.fail(err)
+			return err
+		}
+		return nil
+	}
+	if sf.buf.Len() == 0 && sf.skipEmpty {
+		return nil
+	}
+	sf.err = sf.put()
+	return sf.err
+}
 
-	resp, err := client.Do(req)
+// put sends the whole object in a single PUT, with the Content-Length of what was buffered.
+func (sf *s3FileWriter) put() error {
+	resp, err := sf.do(func() (*http.Request, error) {
+		return sf.builder("PUT", sf.bucket, sf.path, false, bytes.NewReader(sf.buf.Bytes()))
+	})
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer drain(resp.Body)
 
-	if code := resp.StatusCode; code != 200 {
-		msg, _ := ioutil.ReadAll(resp.Body)
-		return errors.New(
-			fmt.Sprintf("Expected 200 OK, got: (%d)\n%s", code, string(msg)),
-		)
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return ErrExists
 	}
+	if resp.StatusCode != http.StatusOK {
+		return parseS3Error(resp, "Saving "+sf.path)
+	}
+
+	return sf.checkETag(resp, sf.buf.Bytes())
+}
 
+// checkETag compares the ETag S3 answered an upload of sent with against its MD5.
+func (sf *s3FileWriter) checkETag(resp *http.Response, sent []byte) error {
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if !sf.md5ETag || etag == "" {
+		return nil
+	}
+	if sum := md5.Sum(sent); etag != hex.EncodeToString(sum[:]) {
+		return errors.New(fmt.Sprintf("Stored object differs from what was sent: %s, ETag %s but MD5 %x", sf.path, etag, sum))
+	}
 	return nil
 }
 
+// do sends the request made by build through the client of the writer, retrying it as configured
+// and cancelling it along with the context of the writer. A redirected request is sent again once.
+func (sf *s3FileWriter) do(build func() (*http.Request, error)) (*http.Response, error) {
+	resp, err := sf.sendOnce(build)
+	if err == nil && sf.redirect != nil && sf.redirect(resp) {
+		drain(resp.Body)
+		return sf.sendOnce(build)
+	}
+	return resp, err
+}
+
+// sendOnce is do without following a redirect.
+func (sf *s3FileWriter) sendOnce(build func() (*http.Request, error)) (*http.Response, error) {
+	if sf.ctx == nil {
+		return sf.retry.send(build, sf.doOnce)
+	}
+	if err := sf.ctx.Err(); err != nil {
+		return nil, err
+	}
+	resp, err := sf.retry.send(func() (*http.Request, error) {
+		req, err := build()
+		if err != nil {
+			return nil, err
+		}
+		return req.WithContext(sf.ctx), nil
+	}, sf.doOnce)
+	if err != nil && sf.ctx.Err() != nil {
+		return nil, sf.ctx.Err()
+	}
+	return resp, err
+}
+
+func (sf *s3FileWriter) doOnce(req *http.Request) (*http.Response, error) {
+	// An empty body stays http.NoBody, anything else would be sent chunked.
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = sf.throttle.readCloser(req.Body)
+	}
+	return do(sf.client, sf.limit, req)
+}
+
 // S3 implements the SaveFetcher for Amazon S3.
 type S3 struct {
 	// The full path to the bucket host.
 	// Example: https://mongotool.s3.amazonaws.com
 	Bucket string
-	client *http.Client
+	// ReadBucket optionally points Fetch and Walk to another host serving the same bucket,
+	// such as an accelerated endpoint, while Save keeps writing to Bucket.
+	ReadBucket string
+	// ObjectLockMode sets S3 Object Lock retention on saved objects, either GOVERNANCE or COMPLIANCE.
+	// The bucket must have Object Lock enabled and ObjectLockRetainUntil must be set as well.
+	ObjectLockMode        string
+	ObjectLockRetainUntil time.Time
+	// LegalHold places an Object Lock legal hold on saved objects.
+	LegalHold bool
+	// ServerSideEncryption has S3 encrypt saved objects at rest, either AES256 or aws:kms.
+	// SSEKMSKeyId optionally names the KMS key to use with aws:kms instead of the default one.
+	ServerSideEncryption string
+	SSEKMSKeyId          string
+	// StorageClass stores saved objects in another class than STANDARD, one of REDUCED_REDUNDANCY,
+	// STANDARD_IA, ONEZONE_IA, INTELLIGENT_TIERING, GLACIER_IR, GLACIER or DEEP_ARCHIVE.
+	// Objects in GLACIER or DEEP_ARCHIVE have to be restored before they can be fetched.
+	StorageClass string
+	// ContentEncoding is stored with uploaded objects, set it to "gzip" when saving through
+	// a GzipSaveFetcher to let other S3 clients decompress the objects transparently.
+	// Fetch always returns the stored bytes, so ranges refer to the compressed data.
+	ContentEncoding string
+	// ContentType forces the Content-Type of uploaded objects. Otherwise it is looked up by the suffix
+	// of their path in ContentTypes, then in DefaultContentTypes, application/octet-stream when unknown.
+	ContentType  string
+	ContentTypes map[string]string
+	// Tagging tags every uploaded object, so lifecycle rules can tell dumps apart.
+	Tagging map[string]string
+	// SkipEmpty has Close store no object at all when nothing was written, rather than an empty one.
+	SkipEmpty bool
+	// PartSize switches an upload to multipart once it grows past this size, so large chunks are
+	// sent as they are written instead of being held in memory, an upload failing part way is aborted
+	// so its parts are not left behind. Zero sends every object in one PUT.
+	PartSize ByteSize
+	// ResumeUploads has an upload going multipart first look for one of the same key that was left in
+	// progress, by a process that died for example, and carry on with it. Parts S3 lists with the size
+	// and MD5 of the part about to be sent are not sent again, any other is replaced. Parts encrypted
+	// with aws:kms have no MD5 for an ETag, so they are all sent again.
+	ResumeUploads bool
+	// Limit optionally bounds the requests in flight, backing off when S3 throttles us.
+	Limit *AdaptiveLimit
+	// Throttle optionally bounds the bandwidth of uploads and downloads, across every transfer sharing it.
+	Throttle *Throttle
+	// ListRate optionally bounds the LIST and DELETE requests sent per second, one token each, so
+	// enumerating and pruning a large bucket does not use up the request rate of the account.
+	// It is separate from Throttle, NewThrottle(5) allows five such requests per second.
+	ListRate *Throttle
+	// MaxRetries is how many times a GET, HEAD, PUT or DELETE failing with a 5xx or a network error
+	// is sent again, waiting RetryDelay before the first retry and twice as long before each next one.
+	MaxRetries int
+	RetryDelay time.Duration
+	// Credentials are used instead of the environment variables or Instance when set,
+	// so buckets with different keys can be used in one process.
+	Credentials *Credentials
+	// Instance provides role credentials when the environment variables are not set.
+	Instance *InstanceMetadata
+	// Client sends every request to S3, set it to share a tuned transport with other code.
+	// When nil a client with DefaultConnectTimeout and DefaultRequestTimeout is used.
+	// It should not follow redirects, which S3 answers a bucket of another region with.
+	Client *http.Client
+	// metadata is sent as x-amz-meta- headers with uploads, see SaveWithMetadata.
+	metadata map[string]string
+	// exclusive makes uploads conditional on no object existing yet, see SaveNew.
+	exclusive bool
+	// redirects points requests to the region S3 redirected the bucket to, shared by copies of s.
+	redirects *bucketRedirects
+}
+
+// Timeouts of the client used when S3.Client is not set, see SetTimeouts.
+const (
+	DefaultConnectTimeout = 30 * time.Second
+	DefaultRequestTimeout = 5 * time.Minute
+)
+
+var defaultClient = &http.Client{
+	Transport: newS3Transport(DefaultConnectTimeout, DefaultRequestTimeout),
+	// Redirects are followed by S3.send, the signature of the request is only valid for its own host.
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
 }
 
 func NewS3(bucket string) *S3 {
 	return &S3{
-		bucket,
-		&http.Client{
-			// For some reason S3 will mess up subsequent GET's if keep alive.
-			Transport: &http.Transport{DisableKeepAlives: true},
-		},
+		Bucket:     bucket,
+		PartSize:   DefaultPartSize,
+		MaxRetries: 3,
+		RetryDelay: 100 * time.Millisecond,
+		Instance:   NewInstanceMetadata(),
+		redirects:  newBucketRedirects(),
 	}
 }
 
-// checkAwsKeys will look for they environment variables implicitly used by go-aws-auth
-func (s S3) checkAwsKeys() error {
+// S3Config describes a bucket on AWS or on another S3 compatible store such as MinIO.
+type S3Config struct {
+	// Endpoint is the scheme and host of the store, for example https://minio.example.com:9000.
+	// When empty the AWS endpoint of Region is used.
+	Endpoint string
+	// Bucket is the name of the bucket.
+	Bucket string
+	// Region is where an AWS bucket lives, us-east-1 when empty. Requests are signed for the
+	// region go-aws-auth derives from the endpoint host, which the AWS endpoint of Region names.
+	// It has no say on a custom Endpoint, which is signed for us-east-1, so any other is refused.
+	Region string
+	// PathStyle addresses objects as endpoint/bucket/key instead of bucket.endpoint/key,
+	// as most S3 compatible stores expect.
+	PathStyle bool
+}
+
+// NewS3WithConfig is like NewS3 for a bucket described by c.
+func NewS3WithConfig(c S3Config) (*S3, error) {
+	if c.Bucket == "" {
+		return nil, errors.New("Missing bucket name")
+	}
+	if c.Endpoint != "" && c.Region != "" && c.Region != "us-east-1" {
+		return nil, errors.New(fmt.Sprintf("Region %s cannot be signed for on the custom endpoint %s, only us-east-1 can", c.Region, c.Endpoint))
+	}
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+		if c.Region != "" && c.Region != "us-east-1" {
+			endpoint = "https://s3." + c.Region + ".amazonaws.com"
+		}
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("Endpoint must include scheme and host: " + endpoint)
+	}
+	if c.PathStyle {
+		return NewS3(u.Scheme + "://" + u.Host + "/" + c.Bucket), nil
+	}
+	return NewS3(u.Scheme + "://" + c.Bucket + "." + u.Host), nil
+}
+
+// newS3Transport gives the transport used towards S3, zero timeouts wait forever.
+// The connect timeout covers both dialing and the TLS handshake, while the request timeout is
+// how long to wait for S3 to start answering, so a slow but steady transfer is never cut off.
+// Connections are kept alive, every response body is drained before it is closed so they get reused.
+func newS3Transport(connect, request time.Duration) *http.Transport {
+	dialer := &net.Dialer{Timeout: connect}
+	return &http.Transport{
+		Dial:                  dialer.Dial,
+		TLSHandshakeTimeout:   connect,
+		ResponseHeaderTimeout: request,
+		// Compression is left to GzipSaveFetcher, never decompress objects stored with a Content-Encoding.
+		DisableCompression: true,
+	}
+}
+
+// SetTimeouts sets how long to wait for a connection to S3 and for S3 to answer a request.
+// It replaces the transport of Client with a copy, a client shared with other code is left alone.
+func (s *S3) SetTimeouts(connect, request time.Duration) {
+	c := *s.httpClient()
+	c.Transport = newS3Transport(connect, request)
+	s.Client = &c
+}
+
+func (s S3) httpClient() *http.Client {
+	if s.Client == nil {
+		return defaultClient
+	}
+	return s.Client
+}
+
+// send does the request made by build, retrying it as configured. A bucket redirected to
+// another region is asked again there, build has to make the request for s.redirected hosts.
+func (s S3) send(build func() (*http.Request, error)) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		return s.retry().send(build, func(req *http.Request) (*http.Response, error) {
+			return do(s.httpClient(), s.Limit, req)
+		})
+	}
+	resp, err := send()
+	if err == nil && s.learnRedirect(resp) {
+		drain(resp.Body)
+		return send()
+	}
+	return resp, err
+}
+
+func (s S3) retry() retryPolicy {
+	return retryPolicy{s.MaxRetries, s.RetryDelay}
+}
+
+// readBucket returns the bucket host used for reading.
+func (s S3) readBucket() string {
+	if s.ReadBucket != "" {
+		return s.ReadBucket
+	}
+	return s.Bucket
+}
+
+// Credentials are AWS keys given explicitly rather than through the environment.
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+	// SessionToken is only set for temporary credentials.
+	SessionToken string
+}
+
+// envAwsKeys will look for the AWS key environment variables
+func envAwsKeys() error {
 	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
 		return errors.New("Missing AWS_ACCESS_KEY_ID environment variable")
 	}
@@ -96,94 +427,669 @@ func (s S3) checkAwsKeys() error {
 	return nil
 }
 
+// checkAwsKeys makes sure we have credentials, either from the environment or the instance role.
+func (s S3) checkAwsKeys() error {
+	if c := s.Credentials; c != nil {
+		if c.AccessKey == "" || c.SecretKey == "" {
+			return errors.New("Credentials must have both an access key and a secret key")
+		}
+		return nil
+	}
+	err := envAwsKeys()
+	if err != nil && s.Instance != nil {
+		if _, ierr := s.Instance.Credentials(); ierr != nil {
+			return errors.New(err.Error() + " and no instance credentials: " + ierr.Error())
+		}
+		return nil
+	}
+	return err
+}
+
+// sign signs req with Credentials, the environment keys or the instance role credentials, whichever is found first.
+// Only signing holds signMu, getting role credentials can take a few requests to the metadata service.
+func (s S3) sign(req *http.Request) error {
+	creds, err := s.credentials()
+	if err != nil {
+		return err
+	}
+	signMu.Lock()
+	defer signMu.Unlock()
+	awsauth.Sign4(req, creds)
+	return nil
+}
+
+// credentials picks what sign signs with.
+func (s S3) credentials() (awsauth.Credentials, error) {
+	if c := s.Credentials; c != nil {
+		return awsauth.Credentials{
+			AccessKeyID:     c.AccessKey,
+			SecretAccessKey: c.SecretKey,
+			SecurityToken:   c.SessionToken,
+		}, nil
+	}
+	if envAwsKeys() != nil && s.Instance != nil {
+		return s.Instance.Credentials()
+	}
+	return envCredentials(), nil
+}
+
+// envCredentials reads the keys from the environment, with the session token of temporary credentials
+// from AWS_SESSION_TOKEN or the older AWS_SECURITY_TOKEN. The token is signed along with the request.
+func envCredentials() awsauth.Credentials {
+	token := os.Getenv("AWS_SESSION_TOKEN")
+	if token == "" {
+		token = os.Getenv("AWS_SECURITY_TOKEN")
+	}
+	return awsauth.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SecurityToken:   token,
+	}
+}
+
+// objectReq is a requestBuilder signing with the credentials of s.
+func (s S3) objectReq(method, bucket, path string, part bool, body io.Reader) (req *http.Request, err error) {
+	if req, err = http.NewRequest(method, fullPath(s.redirected(bucket), path), body); err != nil {
+		return
+	}
+	// Headers describing the object go on a single PUT or on initiating a multipart upload, not on its parts.
+	if (method == "PUT" || method == "POST") && !part {
+		if s.ContentEncoding != "" {
+			req.Header.Set("Content-Encoding", s.ContentEncoding)
+		}
+		req.Header.Set("Content-Type", s.contentType(path))
+		for k, v := range s.metadata {
+			req.Header.Set(metadataHeader+k, v)
+		}
+		if len(s.Tagging) > 0 {
+			tags := url.Values{}
+			for k, v := range s.Tagging {
+				tags.Set(k, v)
+			}
+			req.Header.Set("x-amz-tagging", tags.Encode())
+		}
+		if err = s.encryptionHeaders(req); err != nil {
+			return
+		}
+		if s.StorageClass != "" {
+			if !storageClasses[s.StorageClass] {
+				return nil, errors.New("Invalid storage class: " + s.StorageClass)
+			}
+			req.Header.Set("x-amz-storage-class", s.StorageClass)
+		}
+		if err = s.objectLockHeaders(req); err != nil {
+			return
+		}
+	}
+	// The object only appears once written in one PUT or once its multipart upload completes.
+	if s.exclusive && (method == "PUT" && !part || method == "POST" && part) {
+		req.Header.Set("If-None-Match", "*")
+	}
+	// S3 refuses a body not matching its Content-MD5, and Object Lock uploads without one.
+	if method == "PUT" {
+		if err = contentMD5(req); err != nil {
+			return
+		}
+		// A buffered body is never sent chunked, the header only adds its length to the signature,
+		// the transport writes it from req.ContentLength.
+		if req.GetBody != nil {
+			req.Header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+		}
+	}
+	err = s.sign(req)
+	return
+}
+
+// metadataHeader prefixes the headers of user metadata.
+const metadataHeader = "X-Amz-Meta-"
+
+// SaveWithMetadata is like Save, the object is stored with metadata as x-amz-meta- headers.
+func (s S3) SaveWithMetadata(path string, metadata map[string]string) (io.WriteCloser, error) {
+	s.metadata = metadata
+	return s.Save(path)
+}
+
+// SaveNew is like Save but fails with ErrExists when an object exists at path. The upload is
+// conditional as well, so an object stored meanwhile by someone else is not replaced either.
+func (s S3) SaveNew(path string) (io.WriteCloser, error) {
+	if _, err := s.Stat(path); err == nil {
+		return nil, ErrExists
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+	s.exclusive = true
+	return s.Save(path)
+}
+
+// userMetadata reads the user metadata headers of a response, keyed in lower case.
+func userMetadata(h http.Header) map[string]string {
+	var metadata map[string]string
+	for k := range h {
+		if strings.HasPrefix(k, metadataHeader) {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			metadata[strings.ToLower(strings.TrimPrefix(k, metadataHeader))] = h.Get(k)
+		}
+	}
+	return metadata
+}
+
+// DefaultContentTypes maps path suffixes to the Content-Type of uploaded objects, the longest matching suffix wins.
+var DefaultContentTypes = map[string]string{
+	".json": "application/json",
+	".gz":   "application/gzip",
+	".tar":  "application/x-tar",
+	".bson": "application/bson",
+}
+
+// contentType gives the Content-Type of an upload to path.
+func (s S3) contentType(path string) string {
+	if s.ContentType != "" {
+		return s.ContentType
+	}
+	if n := strings.Index(path, "?"); n >= 0 {
+		path = path[:n]
+	}
+	for _, types := range []map[string]string{s.ContentTypes, DefaultContentTypes} {
+		match := ""
+		for suffix := range types {
+			if strings.HasSuffix(path, suffix) && len(suffix) > len(match) {
+				match = suffix
+			}
+		}
+		if match != "" {
+			return types[match]
+		}
+	}
+	return "application/octet-stream"
+}
+
+// storageClasses are the values accepted for S3.StorageClass.
+var storageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER_IR":          true,
+	"GLACIER":             true,
+	"DEEP_ARCHIVE":        true,
+}
+
+// encryptionHeaders adds the server-side encryption headers to an upload request, they need to be set before signing.
+// Parts of a multipart upload are encrypted as asked for when it was initiated, S3 refuses the headers on them.
+func (s S3) encryptionHeaders(req *http.Request) error {
+	if s.SSEKMSKeyId != "" && s.ServerSideEncryption != "aws:kms" {
+		return errors.New("A KMS key id requires aws:kms server-side encryption")
+	}
+	switch s.ServerSideEncryption {
+	case "":
+		return nil
+	case "AES256":
+	case "aws:kms":
+		if s.SSEKMSKeyId != "" {
+			req.Header.Set("x-amz-server-side-encryption-aws-kms-key-id", s.SSEKMSKeyId)
+		}
+	default:
+		return errors.New("Invalid server-side encryption: " + s.ServerSideEncryption)
+	}
+	req.Header.Set("x-amz-server-side-encryption", s.ServerSideEncryption)
+	return nil
+}
+
+// objectLockHeaders adds the Object Lock headers to an upload request, they need to be set before signing.
+func (s S3) objectLockHeaders(req *http.Request) error {
+	if s.ObjectLockMode == "" && !s.LegalHold {
+		return nil
+	}
+	if s.ObjectLockMode != "" {
+		if s.ObjectLockMode != "GOVERNANCE" && s.ObjectLockMode != "COMPLIANCE" {
+			return errors.New("Invalid object lock mode: " + s.ObjectLockMode)
+		}
+		if s.ObjectLockRetainUntil.IsZero() {
+			return errors.New("Object lock mode requires a retain until date")
+		}
+		req.Header.Set("x-amz-object-lock-mode", s.ObjectLockMode)
+		req.Header.Set("x-amz-object-lock-retain-until-date", s.ObjectLockRetainUntil.UTC().Format(time.RFC3339))
+	}
+	if s.LegalHold {
+		req.Header.Set("x-amz-object-lock-legal-hold", "ON")
+	}
+	return nil
+}
+
+// contentMD5 sets the Content-MD5 header of a request with a body.
+func contentMD5(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return err
+	}
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	return nil
+}
+
 func (s S3) Save(path string) (io.WriteCloser, error) {
+	return s.SaveContext(context.Background(), path)
+}
+
+// SaveContext is like Save, cancelling ctx aborts the upload and Close returns ctx.Err().
+func (s S3) SaveContext(ctx context.Context, path string) (io.WriteCloser, error) {
 	if err := s.checkAwsKeys(); err != nil {
 		return nil, err
 	}
-	return news3FileWriter(s.Bucket, path, S3ObjectReq), nil
+	w := news3FileWriter(s.Bucket, path, s.objectReq, s.httpClient())
+	w.limit = s.Limit
+	w.throttle = s.Throttle
+	w.skipEmpty = s.SkipEmpty
+	w.partSize = int(s.PartSize)
+	w.resume = s.ResumeUploads
+	w.retry = s.retry()
+	w.md5ETag = s.ServerSideEncryption != "aws:kms"
+	w.ctx = ctx
+	w.redirect = s.learnRedirect
+	return w, nil
 }
 
 func (s S3) Walk(p string, walkfn WalkFunc) error {
+	return s.WalkContext(context.Background(), p, walkfn)
+}
+
+// WalkContext is like Walk, the listing requests are cancelled with ctx.
+func (s S3) WalkContext(ctx context.Context, p string, walkfn WalkFunc) error {
 	if err := s.checkAwsKeys(); err != nil {
 		return err
 	}
-	p = strings.TrimLeft(p, "/")
-	if string(p[0]) != "/" {
-		p += "/"
+	p = listPrefix(p)
+	// Each listing holds at most 1000 keys, follow up requests continue after the last one.
+	marker := ""
+	for {
+		bucketlist, err := s.listPage(ctx, p, marker, "")
+		if err != nil {
+			return err
+		}
+		for _, entry := range bucketlist.Contents {
+			info := ObjectInfo{
+				Key:     entry.Key,
+				Size:    entry.Size,
+				ModTime: entry.LastModified,
+				ETag:    strings.Trim(entry.ETag, `"`),
+			}
+			if err := walkfn(entry.Key, info, nil); err != nil {
+				return err
+			}
+		}
+		if !bucketlist.IsTruncated || len(bucketlist.Contents) == 0 {
+			return nil
+		}
+		// NextMarker is only returned when listing with a delimiter.
+		if marker = bucketlist.NextMarker; marker == "" {
+			marker = bucketlist.Contents[len(bucketlist.Contents)-1].Key
+		}
 	}
-	req, err := http.NewRequest("GET", s.Bucket, nil)
-	if err != nil {
+}
+
+// WalkPrefixes calls walkfn with every common prefix one level below p, the way folders are listed,
+// without visiting the keys below them. The prefixes end with a slash.
+func (s S3) WalkPrefixes(p string, walkfn WalkFunc) error {
+	if err := s.checkAwsKeys(); err != nil {
 		return err
 	}
-	params := req.URL.Query()
-	params.Set("prefix", p)
-	req.URL.RawQuery = params.Encode()
+	p = listPrefix(p)
+	marker := ""
+	for {
+		bucketlist, err := s.listPage(context.Background(), p, marker, "/")
+		if err != nil {
+			return err
+		}
+		for _, common := range bucketlist.CommonPrefixes {
+			if err := walkfn(common.Prefix, ObjectInfo{Key: common.Prefix}, nil); err != nil {
+				return err
+			}
+		}
+		if !bucketlist.IsTruncated {
+			return nil
+		}
+		// Like Walk, carry on after the last key or prefix listed when S3 returns no NextMarker.
+		if marker = bucketlist.NextMarker; marker == "" {
+			marker = lastListed(bucketlist)
+		}
+		if marker == "" {
+			return nil
+		}
+	}
+}
 
-	signMu.Lock()
-	awsauth.Sign4(req)
-	signMu.Unlock()
+// lastListed is the last key or common prefix of a page, whichever sorts after the other.
+func lastListed(bucketlist *bucketList) string {
+	last := ""
+	if n := len(bucketlist.Contents); n > 0 {
+		last = bucketlist.Contents[n-1].Key
+	}
+	if n := len(bucketlist.CommonPrefixes); n > 0 && bucketlist.CommonPrefixes[n-1].Prefix > last {
+		last = bucketlist.CommonPrefixes[n-1].Prefix
+	}
+	return last
+}
 
-	resp, err := s.client.Do(req)
+// listPrefix turns a path into the prefix of the keys below it, an empty one lists the whole bucket.
+func listPrefix(p string) string {
+	p = strings.TrimLeft(p, "/")
+	if p != "" && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p
+}
+
+// bucketList is one page of a bucket listing.
+type bucketList struct {
+	IsTruncated bool
+	NextMarker  string
+	Contents    []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+		ETag         string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// listPage requests one page of at most 1000 keys below prefix, starting after marker.
+// Given a delimiter, keys sharing a prefix up to it are only listed once in CommonPrefixes.
+func (s S3) listPage(ctx context.Context, prefix, marker, delimiter string) (*bucketList, error) {
+	s.ListRate.Wait(1)
+	resp, err := s.send(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", s.redirected(s.readBucket()), nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		params := req.URL.Query()
+		if prefix != "" {
+			params.Set("prefix", prefix)
+		}
+		if marker != "" {
+			params.Set("marker", marker)
+		}
+		if delimiter != "" {
+			params.Set("delimiter", delimiter)
+		}
+		req.URL.RawQuery = params.Encode()
+		return req, s.sign(req)
+	})
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	respBody, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if code := resp.StatusCode; code != http.StatusOK {
-		return errors.New(fmt.Sprintf("Unexpected status code: %d\n%s", code, string(respBody)))
+		e := s3ErrorOf(code, respBody)
+		e.op = "Listing " + prefix
+		return nil, e
 	}
 
-	// FIXME: Limited to returning 1000 objects, the rest has to be iterated in follow up requests
-	bucketlist := struct {
-		Contents []struct {
-			Key          string
-			LastModified time.Time
-			Size         int64
-		}
-	}{}
+	bucketlist := &bucketList{}
+	if err := xml.Unmarshal(respBody, bucketlist); err != nil {
+		return nil, err
+	}
+	return bucketlist, nil
+}
 
-	err = xml.Unmarshal(respBody, &bucketlist)
-	if err != nil {
-		return err
+// s3Iterator lazily pages through a bucket listing, holding one page at a time.
+type s3Iterator struct {
+	s      S3
+	prefix string
+	marker string
+	more   bool
+	keys   []string
+	key    string
+	err    error
+}
+
+// WalkIter returns an Iterator over the keys below prefix, requesting pages as they are needed.
+func (s S3) WalkIter(prefix string) Iterator {
+	it := &s3Iterator{s: s, more: true}
+	if err := s.checkAwsKeys(); err != nil {
+		it.err = err
+		return it
 	}
-	for _, entry := range bucketlist.Contents {
-		walkfn(entry.Key, nil)
+	it.prefix = listPrefix(prefix)
+	return it
+}
+
+func (it *s3Iterator) Next() bool {
+	for len(it.keys) == 0 {
+		if !it.more || it.err != nil {
+			return false
+		}
+		page, err := it.s.listPage(context.Background(), it.prefix, it.marker, "")
+		if err != nil {
+			it.err = err
+			return false
+		}
+		for _, entry := range page.Contents {
+			it.keys = append(it.keys, entry.Key)
+		}
+		it.more = page.IsTruncated
+		// NextMarker is only returned when listing with a delimiter.
+		if it.marker = page.NextMarker; it.marker == "" && len(it.keys) > 0 {
+			it.marker = it.keys[len(it.keys)-1]
+		}
 	}
+	it.key, it.keys = it.keys[0], it.keys[1:]
+	return true
+}
+
+func (it *s3Iterator) Key() string {
+	return it.key
+}
+
+func (it *s3Iterator) Err() error {
+	return it.err
+}
+
+func (it *s3Iterator) Close() error {
+	it.more = false
+	it.keys = nil
 	return nil
 }
 
 func (s S3) Fetch(path string) (io.ReadCloser, error) {
+	return s.FetchContext(context.Background(), path)
+}
+
+// FetchContext is like Fetch, cancelling ctx stops the request and reading its body.
+// A connection dropped while reading is resumed where it stopped, up to MaxRetries times.
+func (s S3) FetchContext(ctx context.Context, path string) (io.ReadCloser, error) {
 	if err := s.checkAwsKeys(); err != nil {
 		return nil, err
 	}
-	req, err := S3ObjectReq("GET", s.Bucket, path, nil)
+	resp, err := s.get(ctx, path, nil)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := s.client.Do(req)
+	b := &httpBody{
+		ReadCloser: s.Throttle.readCloser(resp.Body),
+		length:     resp.ContentLength,
+		metadata:   userMetadata(resp.Header),
+	}
+	// Without an ETag another version of the object could be resumed into this one.
+	if etag := resp.Header.Get("ETag"); etag != "" && s.MaxRetries > 0 {
+		b.retries = s.MaxRetries
+		b.resume = func(offset int64) (io.ReadCloser, error) {
+			return s.fetchRange(ctx, path, offset, -1, etag)
+		}
+	}
+	return b, nil
+}
+
+// get requests the object at path with the headers set by header, nil sets none.
+func (s S3) get(ctx context.Context, path string, header func(req *http.Request)) (*http.Response, error) {
+	resp, err := s.send(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", fullPath(s.redirected(s.readBucket()), path), nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if header != nil {
+			header(req)
+		}
+		return req, s.sign(req)
+	})
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return nil, err
 	}
-	if code := resp.StatusCode; code != http.StatusOK {
-		// Don't output body here as it might be a huge file and we can return the body directly
-		return nil, errors.New(fmt.Sprintf("Unexpected status code: %d\n%s", code))
+	if code := resp.StatusCode; code != http.StatusOK && code != http.StatusPartialContent {
+		e := parseS3Error(resp, "Fetching "+path)
+		drain(resp.Body)
+		switch {
+		case e.Code == "InvalidObjectState":
+			e.hint = "Object is archived and must be restored before it can be fetched"
+		case code == http.StatusPreconditionFailed:
+			e.hint = "Object changed while it was being fetched"
+		case code == http.StatusRequestedRangeNotSatisfiable:
+			e.hint = "Range is past the end of the object"
+		}
+		return nil, e
 	}
+	return resp, nil
+}
 
-	return resp.Body, nil
+// httpBody is a fetched object, which knows its length from the Content-Length of the response.
+type httpBody struct {
+	io.ReadCloser
+	length   int64
+	metadata map[string]string
+	// resume fetches the object again from offset after the connection dropped, nil never does.
+	resume  func(offset int64) (io.ReadCloser, error)
+	retries int
+	read    int64
 }
 
-func fullPath(bucket, path string) string {
-	if len(path) > 0 {
-		if string(path[0]) != "/" && string(bucket[len(bucket)-1]) != "/" {
-			path = "/" + path
+// Read carries on from where a dropped connection stopped, for as long as retries are left.
+func (b *httpBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err == nil || err == io.EOF || b.resume == nil || b.retries == 0 {
+		return n, err
+	}
+	b.retries--
+	r, rerr := b.resume(b.read)
+	if rerr != nil {
+		return n, err
+	}
+	b.ReadCloser.Close()
+	b.ReadCloser = r
+	return n, nil
+}
+
+// Metadata is the user metadata the object was saved with.
+func (b *httpBody) Metadata() map[string]string {
+	return b.metadata
+}
+
+// Length is the size of the object, -1 if S3 did not tell.
+func (b *httpBody) Length() int64 {
+	return b.length
+}
+
+// Close drains what is left of a small object, so a caller stopping at the end of a tar archive
+// does not cost the connection.
+func (b *httpBody) Close() error {
+	return drain(b.ReadCloser)
+}
+
+// Stat asks S3 for the size, last modification and ETag of the object at path with a HEAD request,
+// ErrNotFound if there is no such object.
+func (s S3) Stat(path string) (ObjectInfo, error) {
+	if err := s.checkAwsKeys(); err != nil {
+		return ObjectInfo{}, err
+	}
+	resp, err := s.send(func() (*http.Request, error) {
+		return s.objectReq("HEAD", s.readBucket(), path, false, nil)
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	drain(resp.Body)
+	switch code := resp.StatusCode; code {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ObjectInfo{}, ErrNotFound
+	default:
+		return ObjectInfo{}, &S3Error{StatusCode: code, RequestID: resp.Header.Get("x-amz-request-id"), op: "Stating " + path}
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return ObjectInfo{}, errors.New("Invalid Last-Modified for " + path + ": " + resp.Header.Get("Last-Modified"))
+	}
+	return ObjectInfo{
+		Key:      strings.TrimLeft(path, "/"),
+		Size:     resp.ContentLength,
+		ModTime:  modified,
+		ETag:     strings.Trim(resp.Header.Get("ETag"), `"`),
+		Metadata: userMetadata(resp.Header),
+	}, nil
+}
+
+// Delete removes the object at path from the bucket.
+func (s S3) Delete(path string) error {
+	if err := s.checkAwsKeys(); err != nil {
+		return err
+	}
+	s.ListRate.Wait(1)
+	resp, err := s.send(func() (*http.Request, error) {
+		return s.objectReq("DELETE", s.Bucket, path, false, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer drain(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	}
+	e := parseS3Error(resp, "Deleting "+path)
+	switch resp.StatusCode {
+	case http.StatusForbidden:
+		if strings.Contains(strings.ToLower(e.Message), "object lock") {
+			e.hint = "Object is protected by Object Lock, it cannot be deleted until its retention period ends and any legal hold is removed"
+		} else {
+			e.hint = "Access denied, check the bucket policy allows s3:DeleteObject and the object has no Object Lock retention or legal hold"
 		}
+	case http.StatusNotFound:
+		e.hint = "Not found"
+	}
+	return e
+}
+
+// fullPath joins the bucket URL and the key of an object with exactly one slash between them,
+// whichever slashes either side has, so the same key always names the same object.
+func fullPath(bucket, path string) string {
+	if path == "" {
+		return bucket
 	}
-	return bucket + path
+	return strings.TrimRight(bucket, "/") + "/" + strings.TrimLeft(path, "/")
 }
 
 func S3ObjectReq(method, bucket, path string, body io.Reader) (req *http.Request, err error) {
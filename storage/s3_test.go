@@ -2,18 +2,26 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var resource = os.Getenv("TestS3Object")
@@ -48,7 +56,7 @@ func TestS3(t *testing.T) {
 			So(walker, ShouldNotBeNil)
 			Convey("A request to get list of objects should succeed", func() {
 				total := 0
-				err := walker.Walk(path.Dir(u.Path), func(p string, err error) error {
+				err := walker.Walk(path.Dir(u.Path), func(p string, _ ObjectInfo, err error) error {
 					So(err, ShouldBeNil)
 					So(p, ShouldEqual, strings.TrimLeft(u.Path, "/"))
 					total++
@@ -72,9 +80,6 @@ func TestS3(t *testing.T) {
 			})
 		})
 	})
-	Convey("Listing more than 1000 objects should be possible", t, func() {
-		SkipSo("Not implemented")
-	})
 }
 
 func TestS3File(t *testing.T) {
@@ -88,11 +93,11 @@ func TestS3File(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	builder := func(method, bucket, path string, body io.Reader) (req *http.Request, err error) {
+	builder := func(method, bucket, path string, part bool, body io.Reader) (req *http.Request, err error) {
 		return http.NewRequest("PUT", ts.URL, body)
 	}
 
-	f := news3FileWriter("bucket", "path", builder)
+	f := news3FileWriter("bucket", "path", builder, http.DefaultClient)
 	Convey("A new S3File", t, func() {
 		Convey("Implements Writer", func() {
 			w := io.WriteCloser(f)
@@ -115,3 +120,1202 @@ func TestS3File(t *testing.T) {
 		})
 	})
 }
+
+// setTestAwsKeys makes sure checkAwsKeys passes when talking to stub servers.
+func setTestAwsKeys() {
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	}
+	if os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	}
+}
+
+func TestS3ReadWriteEndpoints(t *testing.T) {
+	setTestAwsKeys()
+	var writes, reads []string
+	write := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writes = append(writes, r.Method)
+	}))
+	defer write.Close()
+	read := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reads = append(reads, r.Method)
+		w.Write([]byte("Foo"))
+	}))
+	defer read.Close()
+
+	Convey("Given an S3 storage with separate read and write endpoints", t, func() {
+		writes, reads = nil, nil
+		store := NewS3(write.URL)
+		store.ReadBucket = read.URL
+
+		Convey("Save should PUT to the write endpoint", func() {
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			w.Write([]byte("Foo"))
+			So(w.Close(), ShouldBeNil)
+			So(writes, ShouldResemble, []string{"PUT"})
+			So(reads, ShouldBeEmpty)
+		})
+		Convey("Fetch should GET from the read endpoint", func() {
+			r, err := store.Fetch("object")
+			So(err, ShouldBeNil)
+			r.Close()
+			So(reads, ShouldResemble, []string{"GET"})
+			So(writes, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestS3ObjectLock(t *testing.T) {
+	setTestAwsKeys()
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer ts.Close()
+
+	Convey("Given an S3 storage with object lock retention", t, func() {
+		store := NewS3(ts.URL)
+		store.ObjectLockMode = "COMPLIANCE"
+		store.ObjectLockRetainUntil = time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+		store.LegalHold = true
+
+		Convey("Saved objects should carry the signed object lock headers", func() {
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			w.Write([]byte("Foo"))
+			So(w.Close(), ShouldBeNil)
+			So(header.Get("x-amz-object-lock-mode"), ShouldEqual, "COMPLIANCE")
+			So(header.Get("x-amz-object-lock-retain-until-date"), ShouldEqual, "2030-01-02T03:04:05Z")
+			So(header.Get("x-amz-object-lock-legal-hold"), ShouldEqual, "ON")
+			So(header.Get("Content-MD5"), ShouldNotBeEmpty)
+			auth := strings.ToLower(header.Get("Authorization"))
+			So(auth, ShouldContainSubstring, "x-amz-object-lock-mode")
+			So(auth, ShouldContainSubstring, "x-amz-object-lock-retain-until-date")
+			So(auth, ShouldContainSubstring, "x-amz-object-lock-legal-hold")
+		})
+		Convey("An unknown mode should fail the upload", func() {
+			store.ObjectLockMode = "FOREVER"
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestS3ServerSideEncryption(t *testing.T) {
+	setTestAwsKeys()
+	Convey("Given an S3 storage encrypting with a KMS key", t, func() {
+		fake := &multipartServer{objects: make(map[string][]byte)}
+		var headers []http.Header
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			headers = append(headers, r.Header)
+			fake.ServeHTTP(w, r)
+		}))
+		defer ts.Close()
+		store := NewS3(ts.URL)
+		store.ServerSideEncryption = "aws:kms"
+		store.SSEKMSKeyId = "alias/backups"
+
+		Convey("A single PUT should carry the signed encryption headers", func() {
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			w.Write([]byte("Foo"))
+			So(w.Close(), ShouldBeNil)
+			So(headers, ShouldHaveLength, 1)
+			So(headers[0].Get("x-amz-server-side-encryption"), ShouldEqual, "aws:kms")
+			So(headers[0].Get("x-amz-server-side-encryption-aws-kms-key-id"), ShouldEqual, "alias/backups")
+			auth := strings.ToLower(headers[0].Get("Authorization"))
+			So(auth, ShouldContainSubstring, "x-amz-server-side-encryption")
+			So(auth, ShouldContainSubstring, "x-amz-server-side-encryption-aws-kms-key-id")
+		})
+		Convey("A multipart upload should ask for encryption when initiated only", func() {
+			store.PartSize = 2
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			w.Write([]byte("Foo"))
+			So(w.Close(), ShouldBeNil)
+			So(fake.requests, ShouldResemble, []string{"initiate", "part 1", "part 2", "complete"})
+			So(headers[0].Get("x-amz-server-side-encryption"), ShouldEqual, "aws:kms")
+			for _, h := range headers[1:] {
+				So(h.Get("x-amz-server-side-encryption"), ShouldBeEmpty)
+			}
+		})
+		Convey("A KMS key without aws:kms should fail the upload", func() {
+			store.ServerSideEncryption = "AES256"
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldNotBeNil)
+			So(headers, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestS3StorageClass(t *testing.T) {
+	setTestAwsKeys()
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		if r.Method == "GET" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "<Error><Code>InvalidObjectState</Code><Message>The operation is not valid for the object's storage class</Message></Error>")
+		}
+	}))
+	defer ts.Close()
+
+	Convey("Given an S3 storage saving to STANDARD_IA", t, func() {
+		store := NewS3(ts.URL)
+		store.StorageClass = "STANDARD_IA"
+
+		Convey("Saved objects should carry the signed storage class header", func() {
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			w.Write([]byte("Foo"))
+			So(w.Close(), ShouldBeNil)
+			So(header.Get("x-amz-storage-class"), ShouldEqual, "STANDARD_IA")
+			So(strings.ToLower(header.Get("Authorization")), ShouldContainSubstring, "x-amz-storage-class")
+		})
+		Convey("An unknown class should fail the upload", func() {
+			store.StorageClass = "COLD"
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldNotBeNil)
+		})
+		Convey("Fetching an archived object should tell it needs to be restored", func() {
+			_, err := store.Fetch("object")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "must be restored")
+		})
+	})
+}
+
+// corruptingTransport flips the first byte of every PUT body after it has been hashed and signed.
+type corruptingTransport struct{}
+
+func (corruptingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "PUT" {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	body[0] ^= 0xff
+	corrupted := *req
+	corrupted.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return http.DefaultTransport.RoundTrip(&corrupted)
+}
+
+func TestS3ContentMD5(t *testing.T) {
+	setTestAwsKeys()
+	Convey("Given a bucket storing whatever it receives", t, func() {
+		fake := &multipartServer{objects: make(map[string][]byte)}
+		var header http.Header
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header
+			if r.Method == "PUT" && r.URL.RawQuery == "" {
+				body, _ := ioutil.ReadAll(r.Body)
+				w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+				return
+			}
+			fake.ServeHTTP(w, r)
+		}))
+		defer ts.Close()
+		store := NewS3(ts.URL)
+
+		Convey("Uploads should carry the signed MD5 of their body", func() {
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			w.Write([]byte("Foo"))
+			So(w.Close(), ShouldBeNil)
+			sum := md5.Sum([]byte("Foo"))
+			So(header.Get("Content-MD5"), ShouldEqual, base64.StdEncoding.EncodeToString(sum[:]))
+			So(strings.ToLower(header.Get("Authorization")), ShouldContainSubstring, "content-md5")
+		})
+		Convey("A body corrupted on the way should fail the upload", func() {
+			store.Client = &http.Client{Transport: corruptingTransport{}}
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			w.Write([]byte("Foo"))
+			err = w.Close()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "differs from what was sent")
+		})
+		Convey("A part corrupted on the way should abort the multipart upload", func() {
+			store.Client = &http.Client{Transport: corruptingTransport{}}
+			store.PartSize = 2
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			_, err = w.Write([]byte("Foo"))
+			So(err, ShouldNotBeNil)
+			So(w.Close(), ShouldNotBeNil)
+			So(fake.requests, ShouldResemble, []string{"initiate", "part 1", "abort"})
+		})
+	})
+}
+
+func TestS3ContentEncoding(t *testing.T) {
+	setTestAwsKeys()
+	var stored []byte
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			header = r.Header
+			stored, _ = ioutil.ReadAll(r.Body)
+		case "GET":
+			w.Header().Set("Content-Encoding", header.Get("Content-Encoding"))
+			w.Write(stored)
+		}
+	}))
+	defer ts.Close()
+
+	Convey("Given gzip compression over S3 with a gzip content encoding", t, func() {
+		s3 := NewS3(ts.URL)
+		s3.ContentEncoding = "gzip"
+		store := NewGzipSaveFetcher(s3)
+
+		w, err := store.Save("object.tar.gz")
+		So(err, ShouldBeNil)
+		w.Write([]byte("Foo"))
+		So(w.Close(), ShouldBeNil)
+
+		Convey("The upload should carry a signed Content-Encoding header", func() {
+			So(header.Get("Content-Encoding"), ShouldEqual, "gzip")
+			So(strings.ToLower(header.Get("Authorization")), ShouldContainSubstring, "content-encoding")
+		})
+		Convey("Fetching should decompress the object exactly once", func() {
+			r, err := store.Fetch("object.tar.gz")
+			So(err, ShouldBeNil)
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "Foo")
+			So(r.Close(), ShouldBeNil)
+		})
+	})
+}
+
+func TestFullPath(t *testing.T) {
+	Convey("There should be exactly one slash between the bucket and the key", t, func() {
+		for _, c := range []struct{ bucket, path, expected string }{
+			{"https://b.s3.amazonaws.com", "dump/a.tar", "https://b.s3.amazonaws.com/dump/a.tar"},
+			{"https://b.s3.amazonaws.com", "/dump/a.tar", "https://b.s3.amazonaws.com/dump/a.tar"},
+			{"https://b.s3.amazonaws.com/", "dump/a.tar", "https://b.s3.amazonaws.com/dump/a.tar"},
+			{"https://b.s3.amazonaws.com/", "/dump/a.tar", "https://b.s3.amazonaws.com/dump/a.tar"},
+			{"https://s3.amazonaws.com/b//", "//dump/a.tar", "https://s3.amazonaws.com/b/dump/a.tar"},
+			{"https://b.s3.amazonaws.com", "dump/a.tar?uploads", "https://b.s3.amazonaws.com/dump/a.tar?uploads"},
+			{"https://b.s3.amazonaws.com", "", "https://b.s3.amazonaws.com"},
+		} {
+			So(fullPath(c.bucket, c.path), ShouldEqual, c.expected)
+		}
+	})
+}
+
+func TestS3Slashes(t *testing.T) {
+	setTestAwsKeys()
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+	}))
+	defer ts.Close()
+
+	Convey("Given a bucket URL ending with a slash", t, func() {
+		paths = nil
+		s := NewS3(ts.URL + "/")
+
+		Convey("Save and Fetch of a key with a leading slash should reach the same object", func() {
+			w, err := s.Save("/dump/a.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			r, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			r.Close()
+			So(paths, ShouldResemble, []string{"PUT /dump/a.tar", "GET /dump/a.tar"})
+		})
+	})
+}
+
+func TestS3ContentType(t *testing.T) {
+	setTestAwsKeys()
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer ts.Close()
+
+	Convey("Given an S3 storage", t, func() {
+		s := NewS3(ts.URL)
+		save := func(path string) string {
+			w, err := s.Save(path)
+			So(err, ShouldBeNil)
+			w.Write([]byte("{}"))
+			So(w.Close(), ShouldBeNil)
+			return header.Get("Content-Type")
+		}
+
+		Convey("A JSON object should be uploaded with a signed application/json Content-Type", func() {
+			So(save("dump/"+ManifestFile), ShouldEqual, "application/json")
+			So(strings.ToLower(header.Get("Authorization")), ShouldContainSubstring, "content-type")
+		})
+		Convey("Other objects should get the type of their suffix or the default one", func() {
+			So(save("dump/0.tar.gz"), ShouldEqual, "application/gzip")
+			So(save("dump/0.bson"), ShouldEqual, "application/bson")
+			So(save("dump/"+CompleteMarker), ShouldEqual, "application/octet-stream")
+		})
+		Convey("The mapping of the storage should take precedence", func() {
+			s.ContentTypes = map[string]string{".tar.gz": "application/x-gtar"}
+			So(save("dump/0.tar.gz"), ShouldEqual, "application/x-gtar")
+			So(save("dump/0.json"), ShouldEqual, "application/json")
+		})
+		Convey("A forced type should be used for every object", func() {
+			s.ContentType = "text/plain"
+			So(save("dump/0.json"), ShouldEqual, "text/plain")
+		})
+	})
+}
+
+// listingServer stubs a bucket listing of keys, answering pageSize keys or common prefixes per request.
+// The number of listing requests is counted in lists.
+func listingServer(keys []string, pageSize int, lists *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*lists++
+		query := r.URL.Query()
+		prefix, marker, delimiter := query.Get("prefix"), query.Get("marker"), query.Get("delimiter")
+		var matching []string
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) || key <= marker {
+				continue
+			}
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					key = key[:len(prefix)+i+len(delimiter)]
+				}
+			}
+			if key > marker && (len(matching) == 0 || matching[len(matching)-1] != key) {
+				matching = append(matching, key)
+			}
+		}
+		truncated := len(matching) > pageSize
+		if truncated {
+			matching = matching[:pageSize]
+		}
+		fmt.Fprintf(w, "<ListBucketResult><Prefix>%s</Prefix><IsTruncated>%t</IsTruncated>", prefix, truncated)
+		if truncated && delimiter != "" {
+			fmt.Fprintf(w, "<NextMarker>%s</NextMarker>", matching[len(matching)-1])
+		}
+		for _, key := range matching {
+			if delimiter != "" && strings.HasSuffix(key, delimiter) {
+				fmt.Fprintf(w, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", key)
+				continue
+			}
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>2014-06-01T12:00:00.000Z</LastModified><Size>3</Size></Contents>", key)
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	}))
+}
+
+func TestS3WalkPrefixes(t *testing.T) {
+	setTestAwsKeys()
+	keys := []string{
+		"host/db/1/a", "host/db/1/b", "host/db/2/a", "host/db/3/a", "host/db/3/b", "host/db/4/a", "host/db/notes", "other/db/1/a",
+	}
+	lists := 0
+	ts := listingServer(keys, 2, &lists)
+	defer ts.Close()
+
+	Convey("Given dumps stored below host/db/timestamp", t, func() {
+		lists = 0
+		store := NewS3(ts.URL)
+		var visited []string
+		walkfn := func(fpath string, info ObjectInfo, err error) error {
+			visited = append(visited, fpath)
+			So(info.Key, ShouldEqual, fpath)
+			return err
+		}
+
+		Convey("WalkPrefixes should visit each timestamp once across pages", func() {
+			So(store.WalkPrefixes("host/db", walkfn), ShouldBeNil)
+			So(visited, ShouldResemble, []string{"host/db/1/", "host/db/2/", "host/db/3/", "host/db/4/"})
+			So(lists, ShouldEqual, 3)
+		})
+		Convey("WalkPrefixes without a path should give the top level", func() {
+			So(store.WalkPrefixes("", walkfn), ShouldBeNil)
+			So(visited, ShouldResemble, []string{"host/", "other/"})
+			So(lists, ShouldEqual, 1)
+		})
+		Convey("WalkPrefixes should carry on after the last prefix when S3 gives no NextMarker", func() {
+			stripped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				resp, err := http.Get(ts.URL + r.URL.RequestURI())
+				So(err, ShouldBeNil)
+				defer resp.Body.Close()
+				body, _ := ioutil.ReadAll(resp.Body)
+				w.Write(regexp.MustCompile("<NextMarker>.*</NextMarker>").ReplaceAll(body, nil))
+			}))
+			defer stripped.Close()
+			So(NewS3(stripped.URL).WalkPrefixes("host/db", walkfn), ShouldBeNil)
+			So(visited, ShouldResemble, []string{"host/db/1/", "host/db/2/", "host/db/3/", "host/db/4/"})
+			So(lists, ShouldEqual, 3)
+		})
+	})
+}
+
+func TestS3WalkIter(t *testing.T) {
+	setTestAwsKeys()
+	keys := []string{"dump/a", "dump/b", "dump/c", "dump/d", "dump/e", "other/f"}
+	lists := 0
+	ts := listingServer(keys, 2, &lists)
+	defer ts.Close()
+
+	Convey("Given a bucket listing spanning several pages", t, func() {
+		lists = 0
+		store := NewS3(ts.URL)
+		it := Iterator(store.WalkIter("dump"))
+
+		Convey("Iterating should visit every key below the prefix", func() {
+			var visited []string
+			for it.Next() {
+				visited = append(visited, it.Key())
+			}
+			So(it.Err(), ShouldBeNil)
+			So(visited, ShouldResemble, keys[:5])
+			So(lists, ShouldEqual, 3)
+		})
+		Convey("Stopping early should not request the remaining pages", func() {
+			So(it.Next(), ShouldBeTrue)
+			So(it.Next(), ShouldBeTrue)
+			So(it.Next(), ShouldBeTrue)
+			So(it.Key(), ShouldEqual, "dump/c")
+			So(it.Close(), ShouldBeNil)
+			So(it.Next(), ShouldBeFalse)
+			So(lists, ShouldEqual, 2)
+		})
+	})
+}
+
+func TestS3WalkPages(t *testing.T) {
+	setTestAwsKeys()
+	keys := []string{"dump/a b", "dump/a+b", "dump/a=b", "dump/c%2F", "dump/d", "other/e"}
+	lists := 0
+	ts := listingServer(keys, 2, &lists)
+	defer ts.Close()
+
+	Convey("Given a bucket listing spanning several pages", t, func() {
+		lists = 0
+		store := NewS3(ts.URL)
+
+		Convey("Walk should visit every key across all pages", func() {
+			var visited []string
+			err := store.Walk("dump", func(fpath string, _ ObjectInfo, err error) error {
+				visited = append(visited, fpath)
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(visited, ShouldResemble, keys[:5])
+			So(lists, ShouldEqual, 3)
+		})
+		Convey("Walk should tell the size and last modification of each key", func() {
+			err := store.Walk("dump", func(fpath string, info ObjectInfo, err error) error {
+				So(info.Key, ShouldEqual, fpath)
+				So(info.Size, ShouldEqual, 3)
+				So(info.ModTime.Equal(time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)), ShouldBeTrue)
+				return err
+			})
+			So(err, ShouldBeNil)
+		})
+		Convey("An error from walkfn should stop the listing", func() {
+			stop := errors.New("stop")
+			err := store.Walk("dump", func(fpath string, _ ObjectInfo, err error) error {
+				return stop
+			})
+			So(err, ShouldEqual, stop)
+			So(lists, ShouldEqual, 1)
+		})
+	})
+	Convey("Given a bucket failing on its second page", t, func() {
+		pages := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if pages++; pages > 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, "<ListBucketResult><IsTruncated>true</IsTruncated><Contents><Key>dump/a</Key></Contents></ListBucketResult>")
+		}))
+		defer ts.Close()
+
+		Convey("Walk should return the error instead of a partial listing", func() {
+			err := NewS3(ts.URL).Walk("dump", func(fpath string, _ ObjectInfo, err error) error {
+				return err
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestS3WalkEmptyPrefix(t *testing.T) {
+	setTestAwsKeys()
+	keys := []string{"dump/a", "other/b"}
+	lists := 0
+	ts := listingServer(keys, 1000, &lists)
+	defer ts.Close()
+
+	Convey("Walking without a prefix should list the whole bucket", t, func() {
+		for _, prefix := range []string{"", "/"} {
+			var visited []string
+			err := NewS3(ts.URL).Walk(prefix, func(fpath string, _ ObjectInfo, err error) error {
+				visited = append(visited, fpath)
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(visited, ShouldResemble, keys)
+		}
+	})
+	Convey("A prefix ending in a slash should be used as is", t, func() {
+		var visited []string
+		err := NewS3(ts.URL).Walk("dump/", func(fpath string, _ ObjectInfo, err error) error {
+			visited = append(visited, fpath)
+			return err
+		})
+		So(err, ShouldBeNil)
+		So(visited, ShouldResemble, keys[:1])
+	})
+}
+
+func TestS3FetchError(t *testing.T) {
+	setTestAwsKeys()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+		fmt.Fprint(w, strings.Repeat("x", 10*1024))
+	}))
+	defer ts.Close()
+
+	Convey("Fetching a missing object should report the status and code of the error", t, func() {
+		_, err := NewS3(ts.URL).Fetch("dump/missing.tar")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "Unexpected status code: 404 NoSuchKey")
+		So(IsNotFound(err), ShouldBeTrue)
+		So(len(err.Error()), ShouldBeLessThan, 5*1024)
+	})
+}
+
+func TestS3Error(t *testing.T) {
+	Convey("An AccessDenied error document should be parsed", t, func() {
+		body := `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>AccessDenied</Code><Message>Access Denied</Message><RequestId>4442587FB7D0A2F9</RequestId><HostId>x</HostId></Error>`
+		err := s3ErrorOf(http.StatusForbidden, []byte(body))
+		So(*err, ShouldResemble, S3Error{StatusCode: 403, Code: "AccessDenied", Message: "Access Denied", RequestID: "4442587FB7D0A2F9"})
+		So(err.Error(), ShouldEqual, "Unexpected status code: 403 AccessDenied: Access Denied (request 4442587FB7D0A2F9)")
+		So(IsAccessDenied(err), ShouldBeTrue)
+		So(IsNotFound(err), ShouldBeFalse)
+	})
+	Convey("A body that is no error document should be kept as the message", t, func() {
+		err := s3ErrorOf(http.StatusBadGateway, []byte("Bad gateway\n"))
+		So(err.Code, ShouldEqual, "")
+		So(err.Message, ShouldEqual, "Bad gateway")
+	})
+	Convey("A SlowDown should tell S3 throttled us", t, func() {
+		err := s3ErrorOf(http.StatusServiceUnavailable, []byte("<Error><Code>SlowDown</Code></Error>"))
+		So(IsThrottled(err), ShouldBeTrue)
+	})
+}
+
+func TestS3Config(t *testing.T) {
+	Convey("Buckets should be addressed according to the config", t, func() {
+		for _, c := range []struct {
+			config S3Config
+			bucket string
+		}{
+			{S3Config{Bucket: "mongotool"}, "https://mongotool.s3.amazonaws.com"},
+			{S3Config{Bucket: "mongotool", Region: "eu-west-1"}, "https://mongotool.s3.eu-west-1.amazonaws.com"},
+			{S3Config{Bucket: "mongotool", Region: "eu-west-1", PathStyle: true}, "https://s3.eu-west-1.amazonaws.com/mongotool"},
+			{S3Config{Endpoint: "http://minio.local:9000", Bucket: "backups", PathStyle: true}, "http://minio.local:9000/backups"},
+			{S3Config{Endpoint: "https://ams3.digitaloceanspaces.com", Bucket: "backups"}, "https://backups.ams3.digitaloceanspaces.com"},
+			{S3Config{Endpoint: "http://minio.local:9000", Bucket: "backups", Region: "us-east-1"}, "http://backups.minio.local:9000"},
+		} {
+			s, err := NewS3WithConfig(c.config)
+			So(err, ShouldBeNil)
+			So(s.Bucket, ShouldEqual, c.bucket)
+		}
+	})
+	Convey("Incomplete configs should be refused", t, func() {
+		_, err := NewS3WithConfig(S3Config{})
+		So(err, ShouldNotBeNil)
+		_, err = NewS3WithConfig(S3Config{Endpoint: "minio.local:9000", Bucket: "backups"})
+		So(err, ShouldNotBeNil)
+	})
+	Convey("A region other than us-east-1 should be refused on a custom endpoint, it would not be signed for", t, func() {
+		_, err := NewS3WithConfig(S3Config{Endpoint: "http://minio.local:9000", Bucket: "backups", Region: "eu-west-1"})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "eu-west-1")
+	})
+	Convey("A path style bucket should be used below its path", t, func() {
+		setTestAwsKeys()
+		var paths []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+			if r.Method == "GET" && r.URL.Path == "/backups" {
+				fmt.Fprint(w, "<ListBucketResult><Contents><Key>dump/a.tar</Key></Contents></ListBucketResult>")
+			}
+		}))
+		defer ts.Close()
+
+		s, err := NewS3WithConfig(S3Config{Endpoint: ts.URL, Bucket: "backups", PathStyle: true})
+		So(err, ShouldBeNil)
+		w, err := s.Save("dump/a.tar")
+		So(err, ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+		r, err := s.Fetch("dump/a.tar")
+		So(err, ShouldBeNil)
+		r.Close()
+		So(s.Walk("dump", func(fpath string, _ ObjectInfo, err error) error { return err }), ShouldBeNil)
+		So(paths, ShouldResemble, []string{
+			"PUT /backups/dump/a.tar?",
+			"GET /backups/dump/a.tar?",
+			"GET /backups?prefix=dump%2F",
+		})
+	})
+}
+
+func TestS3LifecycleWarnings(t *testing.T) {
+	setTestAwsKeys()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "lifecycle" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `<LifecycleConfiguration>
+			<Rule><ID>cleanup-dumps</ID><Filter><Prefix>dump/</Prefix></Filter><Status>Enabled</Status>
+				<Expiration><Days>30</Days></Expiration></Rule>
+			<Rule><ID>disabled</ID><Filter><Prefix></Prefix></Filter><Status>Disabled</Status>
+				<Expiration><Days>1</Days></Expiration></Rule>
+			<Rule><ID>logs</ID><Prefix>logs/</Prefix><Status>Enabled</Status>
+				<Expiration><Days>7</Days></Expiration></Rule>
+		</LifecycleConfiguration>`)
+	}))
+	defer ts.Close()
+
+	Convey("Given a bucket with a lifecycle rule expiring dumps after 30 days", t, func() {
+		store := NewS3(ts.URL)
+
+		Convey("Backups meant to be kept forever should be warned about", func() {
+			warnings, err := store.LifecycleWarnings("/dump", 0)
+			So(err, ShouldBeNil)
+			So(warnings, ShouldHaveLength, 1)
+			So(warnings[0], ShouldContainSubstring, "cleanup-dumps")
+			So(warnings[0], ShouldContainSubstring, "30 days")
+		})
+		Convey("Backups meant to be kept for 90 days should be warned about", func() {
+			warnings, err := store.LifecycleWarnings("/dump", 90*24*time.Hour)
+			So(err, ShouldBeNil)
+			So(warnings, ShouldHaveLength, 1)
+		})
+		Convey("Backups meant to be kept for a week should be fine", func() {
+			warnings, err := store.LifecycleWarnings("/dump", 7*24*time.Hour)
+			So(err, ShouldBeNil)
+			So(warnings, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestS3Timeouts(t *testing.T) {
+	setTestAwsKeys()
+	Convey("Given a server accepting connections but never finishing the TLS handshake", t, func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer ln.Close()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+		s := NewS3("https://" + ln.Addr().String())
+		s.SetTimeouts(100*time.Millisecond, 10*time.Second)
+		s.MaxRetries = 0
+
+		Convey("Fetch should fail at the connect timeout", func() {
+			started := time.Now()
+			_, err := s.Fetch("dump/a.tar")
+			So(err, ShouldNotBeNil)
+			So(time.Since(started), ShouldBeLessThan, 2*time.Second)
+		})
+	})
+	Convey("Given a server answering at once but sending the body slowly", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			for n := 0; n < 5; n++ {
+				w.Write([]byte("chunk"))
+				w.(http.Flusher).Flush()
+				time.Sleep(50 * time.Millisecond)
+			}
+		}))
+		defer ts.Close()
+		s := NewS3(ts.URL)
+		s.SetTimeouts(100*time.Millisecond, 100*time.Millisecond)
+
+		Convey("The transfer should outlast the request timeout", func() {
+			r, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, strings.Repeat("chunk", 5))
+		})
+	})
+	Convey("Given a server slow to answer", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(500 * time.Millisecond)
+		}))
+		defer ts.Close()
+		s := NewS3(ts.URL)
+		s.SetTimeouts(time.Second, 100*time.Millisecond)
+
+		Convey("Save should fail at the request timeout", func() {
+			w, err := s.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldNotBeNil)
+		})
+	})
+}
+
+// countingTransport counts the requests it sends.
+type countingTransport struct {
+	requests *int
+}
+
+func (c countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	*c.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestS3Client(t *testing.T) {
+	setTestAwsKeys()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.URL.Path == "/" {
+			fmt.Fprint(w, "<ListBucketResult><Contents><Key>dump/a</Key></Contents></ListBucketResult>")
+		}
+	}))
+	defer ts.Close()
+
+	Convey("Given an S3 bucket with a client of our own", t, func() {
+		requests := 0
+		s := NewS3(ts.URL)
+		s.Client = &http.Client{Transport: countingTransport{&requests}}
+
+		Convey("Save, Fetch and Walk should all send through it", func() {
+			w, err := s.Save("dump/a")
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldBeNil)
+			r, err := s.Fetch("dump/a")
+			So(err, ShouldBeNil)
+			r.Close()
+			So(s.Walk("dump", func(string, ObjectInfo, error) error { return nil }), ShouldBeNil)
+			So(requests, ShouldEqual, 3)
+		})
+		Convey("SetTimeouts should leave the given client alone", func() {
+			given := s.Client
+			s.SetTimeouts(time.Second, time.Second)
+			_, ok := given.Transport.(countingTransport)
+			So(ok, ShouldBeTrue)
+			So(s.Client, ShouldNotEqual, given)
+		})
+	})
+	Convey("Without a client of our own, the default one should time out", t, func() {
+		transport := NewS3("https://bucket.s3.amazonaws.com").httpClient().Transport.(*http.Transport)
+		So(transport.TLSHandshakeTimeout, ShouldEqual, DefaultConnectTimeout)
+		So(transport.ResponseHeaderTimeout, ShouldEqual, DefaultRequestTimeout)
+	})
+}
+
+func TestS3KeepAlive(t *testing.T) {
+	setTestAwsKeys()
+	var mu sync.Mutex
+	conns := 0
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/dump/missing":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+		case r.Method == "GET":
+			w.Write(bytes.Repeat([]byte("x"), 1024))
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	Convey("Given many sequential requests over one client", t, func() {
+		s := NewS3(ts.URL)
+		s.Client = &http.Client{Transport: newS3Transport(time.Second, time.Second)}
+		requests := 0
+		for n := 0; n < 50; n++ {
+			r, err := s.Fetch("dump/a")
+			So(err, ShouldBeNil)
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(b, ShouldHaveLength, 1024)
+			So(r.Close(), ShouldBeNil)
+
+			// Closed without reading, like a tar reader stopping at the end of the archive.
+			r, err = s.Fetch("dump/b")
+			So(err, ShouldBeNil)
+			So(r.Close(), ShouldBeNil)
+
+			_, err = s.Fetch("dump/missing")
+			So(err, ShouldNotBeNil)
+
+			w, err := s.Save("dump/c")
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldBeNil)
+
+			So(s.Delete("dump/c"), ShouldBeNil)
+			requests += 5
+		}
+
+		Convey("Every request should succeed reusing a few connections", func() {
+			mu.Lock()
+			defer mu.Unlock()
+			So(conns, ShouldBeGreaterThan, 0)
+			So(conns, ShouldBeLessThan, requests/10)
+		})
+	})
+}
+
+func TestS3Context(t *testing.T) {
+	setTestAwsKeys()
+	Convey("Given a server that never answers", t, func() {
+		release := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}))
+		defer ts.Close()
+		defer close(release)
+		s := NewS3(ts.URL)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		Convey("FetchContext should give up with the context", func() {
+			_, err := s.FetchContext(ctx, "dump/a.tar")
+			So(err, ShouldEqual, context.DeadlineExceeded)
+		})
+		Convey("WalkContext should give up with the context", func() {
+			err := s.WalkContext(ctx, "dump", func(string, ObjectInfo, error) error { return nil })
+			So(err, ShouldEqual, context.DeadlineExceeded)
+		})
+		Convey("Closing a writer from SaveContext should give up with the context", func() {
+			w, err := s.SaveContext(ctx, "dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldEqual, context.DeadlineExceeded)
+		})
+	})
+}
+
+func TestS3Delete(t *testing.T) {
+	setTestAwsKeys()
+	Convey("Given a bucket answering deletes by key", t, func() {
+		var deleted []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "DELETE" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			switch r.URL.Path {
+			case "/dump/denied.tar":
+				w.WriteHeader(http.StatusForbidden)
+			case "/dump/locked.tar":
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>AccessDenied</Code><Message>Access Denied because object protected by object lock.</Message><RequestId>4442587FB7D0A2F9</RequestId></Error>`))
+			case "/dump/missing.tar":
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				deleted = append(deleted, r.URL.Path)
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}))
+		defer ts.Close()
+		s := NewS3(ts.URL)
+
+		Convey("A 204 should be a success", func() {
+			So(s.Delete("dump/a.tar"), ShouldBeNil)
+			So(deleted, ShouldResemble, []string{"/dump/a.tar"})
+		})
+		Convey("A 403 should tell access was denied", func() {
+			err := s.Delete("dump/denied.tar")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Access denied")
+		})
+		Convey("A 403 for an object under Object Lock should name the retention and legal hold", func() {
+			err := s.Delete("dump/locked.tar")
+			So(err, ShouldNotBeNil)
+			So(IsAccessDenied(err), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "protected by Object Lock")
+			So(err.Error(), ShouldContainSubstring, "retention period")
+			So(err.Error(), ShouldContainSubstring, "legal hold")
+		})
+		Convey("A 404 should tell the object was not found", func() {
+			err := s.Delete("dump/missing.tar")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Not found")
+		})
+	})
+}
+
+func TestS3Stat(t *testing.T) {
+	setTestAwsKeys()
+	Convey("Given a bucket answering HEAD requests", t, func() {
+		var methods []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			methods = append(methods, r.Method)
+			if r.URL.Path == "/dump/missing.tar" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", "1234")
+			w.Header().Set("Last-Modified", "Sun, 01 Jun 2014 12:00:00 GMT")
+			w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		}))
+		defer ts.Close()
+		s := NewS3(ts.URL)
+
+		Convey("Stat should tell the size, modification and ETag without fetching", func() {
+			info, err := s.Stat("/dump/a.tar")
+			So(err, ShouldBeNil)
+			So(info.Key, ShouldEqual, "dump/a.tar")
+			So(info.Size, ShouldEqual, 1234)
+			So(info.ModTime.Equal(time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)), ShouldBeTrue)
+			So(info.ETag, ShouldEqual, "d41d8cd98f00b204e9800998ecf8427e")
+			So(methods, ShouldResemble, []string{"HEAD"})
+		})
+		Convey("Stat of a missing object should give ErrNotFound", func() {
+			_, err := s.Stat("dump/missing.tar")
+			So(err, ShouldEqual, ErrNotFound)
+		})
+	})
+}
+
+func TestS3Metadata(t *testing.T) {
+	setTestAwsKeys()
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			header = r.Header
+			return
+		}
+		for k, v := range header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				w.Header()[k] = v
+			}
+		}
+		w.Header().Set("Last-Modified", "Sun, 01 Jun 2014 12:00:00 GMT")
+	}))
+	defer ts.Close()
+
+	Convey("Given an object saved with metadata and tags", t, func() {
+		s := NewS3(ts.URL)
+		s.Tagging = map[string]string{"kind": "dump"}
+		w, err := s.SaveWithMetadata("dump/a.tar", map[string]string{"Host": "db1:27017", "version": "2.4.9"})
+		So(err, ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+
+		Convey("The metadata and tags should be sent as signed headers", func() {
+			So(header.Get("X-Amz-Meta-Host"), ShouldEqual, "db1:27017")
+			So(header.Get("X-Amz-Tagging"), ShouldEqual, "kind=dump")
+			So(strings.ToLower(header.Get("Authorization")), ShouldContainSubstring, "x-amz-meta-host")
+		})
+		Convey("Stat should read the metadata back", func() {
+			info, err := s.Stat("dump/a.tar")
+			So(err, ShouldBeNil)
+			So(info.Metadata, ShouldResemble, map[string]string{"host": "db1:27017", "version": "2.4.9"})
+		})
+		Convey("Fetch should tell the metadata as well", func() {
+			r, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			So(r.(*httpBody).Metadata()["version"], ShouldEqual, "2.4.9")
+		})
+		Convey("Plain saves should not carry the metadata", func() {
+			w, err := s.Save("dump/b.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(header.Get("X-Amz-Meta-Host"), ShouldEqual, "")
+		})
+	})
+}
+
+func TestS3EmptyObjects(t *testing.T) {
+	setTestAwsKeys()
+	var puts []*http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		puts = append(puts, r)
+	}))
+	defer ts.Close()
+
+	Convey("Given an S3 storage", t, func() {
+		puts = nil
+		s := NewS3(ts.URL)
+
+		Convey("Closing a writer nothing was written to should store an empty object", func() {
+			w, err := s.Save("dump/empty")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(puts, ShouldHaveLength, 1)
+			So(puts[0].ContentLength, ShouldEqual, 0)
+			So(puts[0].TransferEncoding, ShouldBeEmpty)
+		})
+		Convey("With SkipEmpty it should store nothing", func() {
+			s.SkipEmpty = true
+			w, err := s.Save("dump/empty")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(puts, ShouldBeEmpty)
+		})
+		Convey("An object should be sent with its Content-Length, throttled or not", func() {
+			s.Throttle = NewThrottle(1 << 20)
+			w, err := s.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("Foo"))
+			So(w.Close(), ShouldBeNil)
+			So(puts, ShouldHaveLength, 1)
+			So(puts[0].ContentLength, ShouldEqual, 3)
+			So(puts[0].TransferEncoding, ShouldBeEmpty)
+		})
+		Convey("The Content-Length should match the written bytes and be signed", func() {
+			w, err := s.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			for n := 0; n < 100; n++ {
+				w.Write(bytes.Repeat([]byte("x"), 1000))
+			}
+			So(w.Close(), ShouldBeNil)
+			So(puts[0].ContentLength, ShouldEqual, 100000)
+			So(puts[0].Header.Get("Content-Length"), ShouldEqual, "100000")
+			So(strings.ToLower(puts[0].Header.Get("Authorization")), ShouldContainSubstring, "content-length")
+		})
+		Convey("Closing twice should only upload once", func() {
+			w, err := s.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write([]byte("Foo"))
+			So(w.Close(), ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(puts, ShouldHaveLength, 1)
+		})
+	})
+}
+
+func TestS3SaveNew(t *testing.T) {
+	setTestAwsKeys()
+	var requests []string
+	exists := map[string]bool{"/dump/a.tar": true}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, strings.TrimSpace(r.Method+" "+r.Header.Get("If-None-Match")))
+		switch {
+		case r.Method == "HEAD" && exists[r.URL.Path]:
+			w.Header().Set("Last-Modified", "Sun, 01 Jun 2014 12:00:00 GMT")
+		case r.Method == "HEAD":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == "PUT" && r.Header.Get("If-None-Match") == "*" && r.URL.Path == "/dump/raced.tar":
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}
+	}))
+	defer ts.Close()
+
+	Convey("Given an S3 storage", t, func() {
+		requests = nil
+		s := NewS3(ts.URL)
+
+		Convey("SaveNew should refuse an existing object", func() {
+			_, err := s.SaveNew("dump/a.tar")
+			So(err, ShouldEqual, ErrExists)
+			So(requests, ShouldResemble, []string{"HEAD"})
+		})
+		Convey("SaveNew should upload a new object conditionally", func() {
+			w, err := s.SaveNew("dump/b.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(requests, ShouldResemble, []string{"HEAD", "PUT *"})
+		})
+		Convey("A conditional upload S3 refuses should fail with ErrExists", func() {
+			w, err := s.SaveNew("dump/raced.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldEqual, ErrExists)
+		})
+		Convey("Save should still overwrite", func() {
+			w, err := s.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(requests, ShouldResemble, []string{"PUT"})
+		})
+	})
+}
+
+func TestS3Credentials(t *testing.T) {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	defer os.Setenv("AWS_ACCESS_KEY_ID", id)
+	defer os.Setenv("AWS_SECRET_ACCESS_KEY", secret)
+
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Write([]byte("Foo"))
+	}))
+	defer ts.Close()
+
+	Convey("Given an S3 storage with explicit credentials and none in the environment", t, func() {
+		store := NewS3(ts.URL)
+		store.Instance = nil
+		store.Credentials = &Credentials{AccessKey: "AKIDEXPLICIT", SecretKey: "secret", SessionToken: "session"}
+
+		Convey("Requests should be signed with them", func() {
+			r, err := store.Fetch("object")
+			So(err, ShouldBeNil)
+			r.Close()
+			So(header.Get("Authorization"), ShouldContainSubstring, "Credential=AKIDEXPLICIT")
+			So(header.Get("X-Amz-Security-Token"), ShouldEqual, "session")
+		})
+		Convey("Credentials without a secret key should be refused", func() {
+			store.Credentials = &Credentials{AccessKey: "AKIDEXPLICIT"}
+			_, err := store.Fetch("object")
+			So(err, ShouldNotBeNil)
+			_, err = store.Save("object")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestS3SessionToken(t *testing.T) {
+	setTestAwsKeys()
+	os.Setenv("AWS_SESSION_TOKEN", "session")
+	defer os.Unsetenv("AWS_SESSION_TOKEN")
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer ts.Close()
+
+	Convey("A session token in the environment should be sent and signed", t, func() {
+		w, err := NewS3(ts.URL).Save("object")
+		So(err, ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+		So(header.Get("X-Amz-Security-Token"), ShouldEqual, "session")
+		So(strings.ToLower(header.Get("Authorization")), ShouldContainSubstring, "x-amz-security-token")
+	})
+}
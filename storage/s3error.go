@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// S3Error is an error answered by S3, with the Code and Message of its XML error document when it
+// had one, so callers can tell a NoSuchKey from an AccessDenied without matching strings.
+type S3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+	// op tells what was being done, hint what to do about it.
+	op   string
+	hint string
+}
+
+func (e *S3Error) Error() string {
+	msg := fmt.Sprintf("Unexpected status code: %d", e.StatusCode)
+	if e.Code != "" {
+		msg += " " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	if e.op != "" {
+		msg = e.op + ": " + msg
+	}
+	if e.hint != "" {
+		msg += ". " + e.hint
+	}
+	return msg
+}
+
+// parseS3Error reads the error document of a response failing to op, only the start of a body that
+// is not one is kept as Message, it might be a huge object.
+func parseS3Error(resp *http.Response, op string) *S3Error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	e := s3ErrorOf(resp.StatusCode, body)
+	e.op = op
+	if e.RequestID == "" {
+		e.RequestID = resp.Header.Get("x-amz-request-id")
+	}
+	return e
+}
+
+// s3ErrorOf parses an error document answered with status.
+func s3ErrorOf(status int, body []byte) *S3Error {
+	doc := struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string
+		Message   string
+		RequestId string
+	}{}
+	if xml.Unmarshal(body, &doc) != nil {
+		return &S3Error{StatusCode: status, Message: strings.TrimSpace(string(body))}
+	}
+	return &S3Error{StatusCode: status, Code: doc.Code, Message: doc.Message, RequestID: doc.RequestId}
+}
+
+// IsNotFound tells if err is about an object or a bucket that does not exist, on any storage.
+func IsNotFound(err error) bool {
+	if err == ErrNotFound || os.IsNotExist(err) {
+		return true
+	}
+	if e, ok := err.(*GCSError); ok {
+		return e.StatusCode == http.StatusNotFound
+	}
+	e, ok := err.(*S3Error)
+	return ok && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey" || e.Code == "NoSuchBucket")
+}
+
+// IsAccessDenied tells if err is S3 or GCS refusing the credentials or the request they were used for.
+func IsAccessDenied(err error) bool {
+	if e, ok := err.(*GCSError); ok {
+		return e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusUnauthorized
+	}
+	e, ok := err.(*S3Error)
+	return ok && (e.StatusCode == http.StatusForbidden || e.Code == "AccessDenied")
+}
+
+// IsThrottled tells if err is S3 or GCS asking to slow down.
+func IsThrottled(err error) bool {
+	if e, ok := err.(*GCSError); ok {
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable ||
+			e.Reason == "rateLimitExceeded"
+	}
+	e, ok := err.(*S3Error)
+	return ok && (e.Code == "SlowDown" || e.StatusCode == http.StatusServiceUnavailable)
+}
+
+// isTransient tells if err is S3 failing in a way worth trying again: throttled, an InternalError
+// or any other 5xx, or a RequestTimeout while it waited for the body.
+func isTransient(err error) bool {
+	e, ok := err.(*S3Error)
+	return ok && (IsThrottled(e) || e.StatusCode >= 500 || e.Code == "RequestTimeout")
+}
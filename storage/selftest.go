@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// Check is the outcome of one step of SelfTest.
+type Check struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+func (c Check) String() string {
+	if c.Err != nil {
+		return fmt.Sprintf("FAIL  %-8s %v (%v)", c.Name, c.Err, c.Duration)
+	}
+	return fmt.Sprintf("PASS  %-8s (%v)", c.Name, c.Duration)
+}
+
+// SelfTest exercises store end to end below prefix: a small known object is saved,
+// found again by walking, then fetched and compared with what was saved, and copied
+// with Copy to a second key whose content is compared as well.
+// A failing step ends the test, the checks run so far are returned. Once saved the
+// objects are deleted again when store is a Deleter, even after a failing step, and
+// found gone when it is a Stater too. Other storages are left with the objects.
+func SelfTest(store SaveFetcher, prefix string) []Check {
+	key := path.Join(prefix, fmt.Sprintf("mongotool-selftest-%d", time.Now().UnixNano()))
+	copyKey := key + "-copy"
+	content := []byte("mongotool selftest " + key)
+
+	var checks []Check
+	run := func(name string, f func() error) bool {
+		start := time.Now()
+		err := f()
+		checks = append(checks, Check{name, err, time.Since(start)})
+		return err == nil
+	}
+
+	ok := run("save", func() error {
+		w, err := store.Save(key)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(content); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
+	ok = ok && run("walk", func() error {
+		walker, isWalker := store.(Walker)
+		if !isWalker {
+			return errors.New("Storage does not implement Walker")
+		}
+		found := false
+		err := walker.Walk(path.Dir(key), func(fpath string, _ ObjectInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.TrimLeft(fpath, "/") == strings.TrimLeft(key, "/") {
+				found = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errors.New("Saved object not found by Walk: " + key)
+		}
+		return nil
+	})
+	fetch := func(key string) error {
+		r, err := store.Fetch(key)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(io.LimitReader(r, int64(len(content))+1))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b, content) {
+			return errors.New("Fetched object differs from what was saved: " + key)
+		}
+		return nil
+	}
+	ok = ok && run("fetch", func() error {
+		return fetch(key)
+	})
+	copied := false
+	ok = ok && run("copy", func() error {
+		err := Copy(store, renamingSaver{store, key, copyKey}, key)
+		copied = err == nil
+		if err != nil {
+			return err
+		}
+		return fetch(copyKey)
+	})
+	if deleter, isDeleter := store.(Deleter); isDeleter && len(checks) > 0 && checks[0].Err == nil {
+		keys := []string{key}
+		if copied {
+			keys = append(keys, copyKey)
+		}
+		run("delete", func() error {
+			for _, key := range keys {
+				if err := deleter.Delete(key); err != nil {
+					return err
+				}
+				if st, isStater := store.(Stater); isStater {
+					if _, err := st.Stat(key); err != ErrNotFound {
+						return errors.New(fmt.Sprintf("Deleted object still found by Stat: %s (%v)", key, err))
+					}
+				}
+			}
+			return nil
+		})
+	}
+	return checks
+}
+
+// renamingSaver saves the object at from to the key to instead, so Copy can copy within one storage.
+type renamingSaver struct {
+	Saver
+	from, to string
+}
+
+func (r renamingSaver) Save(path string) (io.WriteCloser, error) {
+	if path == r.from {
+		path = r.to
+	}
+	return r.Saver.Save(path)
+}
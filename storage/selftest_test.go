@@ -0,0 +1,55 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backends := map[string]SaveFetcher{
+		"in-memory":  &memStorage{objects: make(map[string][]byte)},
+		"filesystem": Filesystem{dir},
+		"compressed": NewGzipSaveFetcher(Filesystem{dir}),
+	}
+	for name, store := range backends {
+		Convey("Running the self test against the "+name+" backend", t, func() {
+			checks := SelfTest(store, "selftest")
+			Convey("Should pass every check", func() {
+				_, deletes := store.(Deleter)
+				if deletes {
+					So(checks, ShouldHaveLength, 5)
+					So(checks[4].Name, ShouldEqual, "delete")
+				} else {
+					So(checks, ShouldHaveLength, 4)
+				}
+				So(checks[3].Name, ShouldEqual, "copy")
+				for _, c := range checks {
+					So(c.Err, ShouldBeNil)
+				}
+			})
+		})
+	}
+	Convey("The self test should leave nothing behind on a storage that can delete", t, func() {
+		checks := SelfTest(Filesystem{dir}, "cleanup")
+		So(checks, ShouldHaveLength, 5)
+		files, _ := ioutil.ReadDir(filepath.Join(dir, "cleanup"))
+		So(files, ShouldBeEmpty)
+	})
+	Convey("Running the self test against a corrupting backend", t, func() {
+		checks := SelfTest(&memStorage{objects: make(map[string][]byte), corrupt: true}, "selftest")
+		Convey("Should fail the fetch check", func() {
+			So(checks, ShouldHaveLength, 3)
+			So(checks[2].Name, ShouldEqual, "fetch")
+			So(checks[2].Err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Throttle bounds the bandwidth of the transfers sharing it with a token bucket, which fills at the
+// rate allowed and holds a tenth of a second of it, so bursts are smoothed over the whole transfer.
+// A nil Throttle or one with a zero rate does not limit anything.
+type Throttle struct {
+	rate   float64
+	burst  float64
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewThrottle allows maxBytesPerSecond through the returned Throttle, zero is unlimited.
+func NewThrottle(maxBytesPerSecond int64) *Throttle {
+	rate := float64(maxBytesPerSecond)
+	return &Throttle{rate: rate, burst: rate / 10, tokens: rate / 10, last: time.Now()}
+}
+
+// Wait blocks until n more bytes may be transferred. Bytes taken beyond what the bucket holds are
+// owed, the callers that come next wait for them as well.
+func (t *Throttle) Wait(n int) {
+	if t == nil || t.rate <= 0 || n <= 0 {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+	t.tokens -= float64(n)
+	wait := time.Duration(-t.tokens / t.rate * float64(time.Second))
+	t.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// chunk is the most a single Read is allowed to take at once, so large reads are spread out.
+func (t *Throttle) chunk() int {
+	if n := int(t.burst); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// Reader returns a Reader reading from r no faster than t allows.
+func (t *Throttle) Reader(r io.Reader) io.Reader {
+	if t == nil || t.rate <= 0 {
+		return r
+	}
+	return &throttledReader{r, t}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *Throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if max := tr.t.chunk(); len(p) > max {
+		p = p[:max]
+	}
+	n, err := tr.r.Read(p)
+	tr.t.Wait(n)
+	return n, err
+}
+
+// readCloser gives the throttled reader of a body, closing the body itself.
+func (t *Throttle) readCloser(body io.ReadCloser) io.ReadCloser {
+	if t == nil || t.rate <= 0 {
+		return body
+	}
+	return readCloser{t.Reader(body), body}
+}
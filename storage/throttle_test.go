@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	Convey("Given a throttle of 10000 bytes per second", t, func() {
+		throttle := NewThrottle(10000)
+
+		Convey("Reading 20000 bytes should take about two seconds", func() {
+			start := time.Now()
+			n, err := io.Copy(ioutil.Discard, throttle.Reader(bytes.NewReader(make([]byte, 20000))))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 20000)
+			elapsed := time.Since(start)
+			So(elapsed, ShouldBeGreaterThan, 1700*time.Millisecond)
+			So(elapsed, ShouldBeLessThan, 2500*time.Millisecond)
+		})
+	})
+	Convey("A zero rate should not limit anything", t, func() {
+		r := bytes.NewReader(make([]byte, 1<<20))
+		So(NewThrottle(0).Reader(r), ShouldEqual, r)
+		start := time.Now()
+		var nilThrottle *Throttle
+		nilThrottle.Wait(1 << 30)
+		So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+	})
+}
+
+func TestS3Throttle(t *testing.T) {
+	setTestAwsKeys()
+	content := bytes.Repeat([]byte("x"), 4000)
+	var received int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			b, _ := ioutil.ReadAll(r.Body)
+			received = len(b)
+			return
+		}
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	Convey("Given an S3 storage throttled to 2000 bytes per second", t, func() {
+		s := NewS3(ts.URL)
+		s.Throttle = NewThrottle(2000)
+
+		Convey("Saving 4000 bytes should take about two seconds", func() {
+			start := time.Now()
+			w, err := s.Save("dump/a.tar")
+			So(err, ShouldBeNil)
+			w.Write(content)
+			So(w.Close(), ShouldBeNil)
+			So(received, ShouldEqual, 4000)
+			elapsed := time.Since(start)
+			So(elapsed, ShouldBeGreaterThan, 1700*time.Millisecond)
+			So(elapsed, ShouldBeLessThan, 2500*time.Millisecond)
+		})
+		Convey("Fetching should be throttled as well", func() {
+			s.Throttle = NewThrottle(8000)
+			start := time.Now()
+			r, err := s.Fetch("dump/a.tar")
+			So(err, ShouldBeNil)
+			b, err := ioutil.ReadAll(r)
+			r.Close()
+			So(err, ShouldBeNil)
+			So(len(b), ShouldEqual, 4000)
+			elapsed := time.Since(start)
+			So(elapsed, ShouldBeGreaterThan, 400*time.Millisecond)
+			So(elapsed, ShouldBeLessThan, 700*time.Millisecond)
+		})
+	})
+}
+
+func TestS3ListRate(t *testing.T) {
+	setTestAwsKeys()
+	keys := []string{"host/db/1/COMPLETE", "host/db/1/a", "host/db/2/COMPLETE", "host/db/2/a", "host/db/3/COMPLETE"}
+	lists := 0
+	ts := listingServer(keys, 1, &lists)
+	defer ts.Close()
+
+	Convey("Given an S3 storage allowed 10 LIST and DELETE requests per second", t, func() {
+		lists = 0
+		s := NewS3(ts.URL)
+		s.ListRate = NewThrottle(10)
+
+		Convey("Walking five pages should take about four tenths of a second", func() {
+			start := time.Now()
+			So(s.Walk("host/db", func(fpath string, _ ObjectInfo, err error) error {
+				return err
+			}), ShouldBeNil)
+			So(lists, ShouldEqual, 5)
+			elapsed := time.Since(start)
+			So(elapsed, ShouldBeGreaterThan, 350*time.Millisecond)
+			So(elapsed, ShouldBeLessThan, 800*time.Millisecond)
+		})
+		Convey("Pruning should pace its listing and deletes alike", func() {
+			start := time.Now()
+			deleted, err := Prune(s, "host/db", PrunePolicy{KeepLast: 1})
+			So(err, ShouldBeNil)
+			So(deleted, ShouldHaveLength, 2)
+			// Five LIST and four DELETE requests.
+			elapsed := time.Since(start)
+			So(elapsed, ShouldBeGreaterThan, 750*time.Millisecond)
+			So(elapsed, ShouldBeLessThan, 1300*time.Millisecond)
+		})
+		Convey("GET and PUT requests should not be paced", func() {
+			s.ListRate = NewThrottle(1)
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				r, err := s.Fetch("host/db/1/a")
+				So(err, ShouldBeNil)
+				r.Close()
+			}
+			So(time.Since(start), ShouldBeLessThan, 300*time.Millisecond)
+		})
+	})
+}
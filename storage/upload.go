@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultUploadConcurrency is how many objects SaveAll sends at the same time when given zero.
+// Uploads of small objects mostly wait on the round trip to the backend, so raise it towards a
+// distant bucket, as long as the backend or an AdaptiveLimit on it does not throttle the requests.
+const DefaultUploadConcurrency = 8
+
+// Upload is one object for SaveAll, Body is stored at Path.
+// A Body that is also an io.Closer is closed once its upload is done.
+type Upload struct {
+	Path string
+	Body io.Reader
+}
+
+// UploadErrors tells why uploads of SaveAll failed, keyed by their path.
+type UploadErrors map[string]error
+
+func (e UploadErrors) Error() string {
+	paths := make([]string, 0, len(e))
+	for fpath := range e {
+		paths = append(paths, fpath)
+	}
+	sort.Strings(paths)
+	msgs := make([]string, len(paths))
+	for n, fpath := range paths {
+		msgs[n] = fmt.Sprintf("%s: %v", fpath, e[fpath])
+	}
+	return fmt.Sprintf("%d uploads failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// SaveAll stores every upload on s with up to concurrency of them in flight, DefaultUploadConcurrency
+// when zero. Each object is written from start to end by a single goroutine. A failing upload does
+// not stop the others, the failures are returned together as UploadErrors.
+func SaveAll(s Saver, uploads []Upload, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = DefaultUploadConcurrency
+	}
+	queue := make(chan Upload)
+	failed := make(UploadErrors)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range queue {
+				if err := saveOne(s, u); err != nil {
+					mu.Lock()
+					failed[u.Path] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, u := range uploads {
+		queue <- u
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(failed) == 0 {
+		return nil
+	}
+	return failed
+}
+
+// saveOne copies the body of u to a new object on s.
+func saveOne(s Saver, u Upload) error {
+	if c, ok := u.Body.(io.Closer); ok {
+		defer c.Close()
+	}
+	w, err := s.Save(u.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, u.Body); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// poolStorage keeps objects in memory, recording how many uploads were in flight at most.
+type poolStorage struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	inflight int
+	peak     int
+	// fail names an object whose upload fails on Close.
+	fail string
+}
+
+type poolWriter struct {
+	bytes.Buffer
+	path  string
+	store *poolStorage
+}
+
+func (p *poolStorage) Save(path string) (io.WriteCloser, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inflight++; p.inflight > p.peak {
+		p.peak = p.inflight
+	}
+	return &poolWriter{path: path, store: p}, nil
+}
+
+func (w *poolWriter) Close() error {
+	// Long enough for the other workers to start their uploads.
+	time.Sleep(10 * time.Millisecond)
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	w.store.inflight--
+	if w.path == w.store.fail {
+		return errors.New("upload failed")
+	}
+	w.store.objects[w.path] = w.Bytes()
+	return nil
+}
+
+func TestSaveAll(t *testing.T) {
+	Convey("Given many small objects to upload", t, func() {
+		store := &poolStorage{objects: make(map[string][]byte)}
+		var uploads []Upload
+		for n := 0; n < 20; n++ {
+			uploads = append(uploads, Upload{fmt.Sprintf("dump/%02d", n), strings.NewReader(strings.Repeat("x", n))})
+		}
+
+		Convey("They should be stored intact with at most concurrency in flight", func() {
+			So(SaveAll(store, uploads, 4), ShouldBeNil)
+			So(store.objects, ShouldHaveLength, 20)
+			for n := 0; n < 20; n++ {
+				So(string(store.objects[fmt.Sprintf("dump/%02d", n)]), ShouldEqual, strings.Repeat("x", n))
+			}
+			So(store.peak, ShouldBeGreaterThan, 1)
+			So(store.peak, ShouldBeLessThanOrEqualTo, 4)
+		})
+		Convey("Zero concurrency should use the default", func() {
+			So(SaveAll(store, uploads, 0), ShouldBeNil)
+			So(store.peak, ShouldBeLessThanOrEqualTo, DefaultUploadConcurrency)
+		})
+		Convey("A failing upload should be reported without stopping the others", func() {
+			store.fail = "dump/03"
+			err := SaveAll(store, uploads, 4)
+			So(err, ShouldNotBeNil)
+			failed, ok := err.(UploadErrors)
+			So(ok, ShouldBeTrue)
+			So(failed, ShouldHaveLength, 1)
+			So(failed["dump/03"], ShouldNotBeNil)
+			So(store.objects, ShouldHaveLength, 19)
+			So(err.Error(), ShouldContainSubstring, "dump/03: upload failed")
+		})
+	})
+}
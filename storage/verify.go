@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+)
+
+// verifyWriteCloser hashes everything written so it can be compared with what is read back.
+type verifyWriteCloser struct {
+	io.WriteCloser
+	hash  hash.Hash
+	path  string
+	store Fetcher
+}
+
+func (v *verifyWriteCloser) Write(p []byte) (int, error) {
+	v.hash.Write(p)
+	return v.WriteCloser.Write(p)
+}
+
+// Close finishes the upload, then fetches the object back and compares checksums.
+func (v *verifyWriteCloser) Close() error {
+	if err := v.WriteCloser.Close(); err != nil {
+		return err
+	}
+	r, err := v.store.Fetch(v.path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), v.hash.Sum(nil)) {
+		return errors.New("Verification failed, stored object differs from what was sent: " + v.path)
+	}
+	return nil
+}
+
+// VerifySaveFetcher wraps another SaveFetcher to read back every saved object and compare it
+// with what was written. This doubles the traffic, but catches silent corruption in the storage.
+type VerifySaveFetcher struct {
+	s SaveFetcher
+}
+
+func NewVerifySaveFetcher(s SaveFetcher) SaveFetcher {
+	return &VerifySaveFetcher{s}
+}
+
+func (v *VerifySaveFetcher) Save(path string) (io.WriteCloser, error) {
+	return v.save(path, v.s.Save)
+}
+
+func (v *VerifySaveFetcher) SaveNew(path string) (io.WriteCloser, error) {
+	return v.save(path, saveNewOf(v.s))
+}
+
+func (v *VerifySaveFetcher) save(path string, open func(string) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	w, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyWriteCloser{w, sha256.New(), path, v.s}, nil
+}
+
+func (v *VerifySaveFetcher) Fetch(path string) (io.ReadCloser, error) {
+	return v.s.Fetch(path)
+}
+
+func (v *VerifySaveFetcher) Walk(path string, walkfn WalkFunc) error {
+	w := v.s.(Walker)
+	return w.Walk(path, walkfn)
+}
+
+func (v *VerifySaveFetcher) WalkIter(path string) Iterator {
+	w := v.s.(IterWalker)
+	return w.WalkIter(path)
+}
+
+func (v *VerifySaveFetcher) WalkPrefixes(path string, walkfn WalkFunc) error {
+	w := v.s.(PrefixWalker)
+	return w.WalkPrefixes(path, walkfn)
+}
+
+func (v *VerifySaveFetcher) Stat(path string) (ObjectInfo, error) {
+	return stat(v.s, path)
+}
+
+func (v *VerifySaveFetcher) Delete(path string) error {
+	d := v.s.(Deleter)
+	return d.Delete(path)
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// memStorage keeps saved objects in memory, corrupt flips the first byte of everything fetched.
+type memStorage struct {
+	objects map[string][]byte
+	corrupt bool
+}
+
+type memWriter struct {
+	bytes.Buffer
+	path  string
+	store *memStorage
+}
+
+func (w *memWriter) Close() error {
+	w.store.objects[w.path] = w.Bytes()
+	return nil
+}
+
+func (m *memStorage) Save(path string) (io.WriteCloser, error) {
+	return &memWriter{path: path, store: m}, nil
+}
+
+func (m *memStorage) Fetch(path string) (io.ReadCloser, error) {
+	b := append([]byte{}, m.objects[path]...)
+	if m.corrupt && len(b) > 0 {
+		b[0] ^= 0xff
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *memStorage) Walk(prefix string, walkfn WalkFunc) error {
+	for fpath := range m.objects {
+		if strings.HasPrefix(fpath, prefix) {
+			if err := walkfn(fpath, ObjectInfo{Key: fpath, Size: int64(len(m.objects[fpath]))}, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestVerifySaveFetcher(t *testing.T) {
+	Convey("Given a verifying storage", t, func() {
+		mem := &memStorage{objects: make(map[string][]byte)}
+		store := NewVerifySaveFetcher(mem)
+
+		Convey("Saving should succeed when the object reads back intact", func() {
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldBeNil)
+		})
+		Convey("Saving should fail when the object reads back altered", func() {
+			mem.corrupt = true
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			err = w.Close()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Verification failed")
+		})
+	})
+}
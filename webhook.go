@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// webhookTimeout bounds how long a finished command waits on a webhook.
+const webhookTimeout = 10 * time.Second
+
+// webhookPayload is what gets POSTed to a webhook once a dump or restore is done.
+type webhookPayload struct {
+	Command  string  `json:"command"`
+	Path     string  `json:"path"`
+	Status   string  `json:"status"`
+	Started  string  `json:"started"`
+	Duration float64 `json:"duration_seconds"`
+	Objects  int64   `json:"objects"`
+	Bytes    int64   `json:"bytes"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// webhook notifies URL when a command finishes, signing the payload when Secret is set.
+type webhook struct {
+	URL    string
+	Secret string
+	// Objects and Bytes are what the command got through, reported as they are when it finishes.
+	Objects int64
+	Bytes   int64
+
+	command string
+	path    string
+	started time.Time
+	client  *http.Client
+	once    sync.Once
+}
+
+// startWebhook begins timing command and makes sure the webhook is called even when the
+// command exits early. It returns nil when no URL is given.
+func startWebhook(url, secret, command, path string) *webhook {
+	if url == "" {
+		return nil
+	}
+	w := &webhook{
+		URL:     url,
+		Secret:  secret,
+		command: command,
+		path:    path,
+		started: time.Now(),
+		client:  &http.Client{Timeout: webhookTimeout},
+	}
+	atexit(w.Done)
+	return w
+}
+
+// Done reports the outcome of the command, only the first call has any effect.
+// The webhook is best-effort, failing to deliver only prints a warning.
+func (w *webhook) Done() {
+	if w == nil {
+		return
+	}
+	w.once.Do(func() {
+		exitMu.Lock()
+		p := webhookPayload{
+			Command:  w.command,
+			Path:     w.path,
+			Status:   "success",
+			Started:  w.started.UTC().Format(time.RFC3339),
+			Duration: time.Since(w.started).Seconds(),
+			Objects:  w.Objects,
+			Bytes:    w.Bytes,
+		}
+		if exitStatus != 0 {
+			p.Status = "failure"
+			p.Error = lastError
+		}
+		exitMu.Unlock()
+		if err := w.send(p); err != nil {
+			fmt.Fprintln(os.Stderr, "WARNING: webhook failed:", err)
+		}
+	})
+}
+
+// send POSTs p as JSON, with an X-Mongotool-Signature header holding the hex HMAC-SHA256
+// of the body when a secret is set.
+func (w *webhook) send(p webhookPayload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Mongotool-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(fmt.Sprintf("%s answered %s", w.URL, resp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	Convey("Given a webhook receiver", t, func() {
+		var bodies [][]byte
+		var signatures []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, b)
+			signatures = append(signatures, r.Header.Get("X-Mongotool-Signature"))
+		}))
+		defer ts.Close()
+
+		Convey("A finished dump should be reported once with a signed payload", func() {
+			hook := startWebhook(ts.URL, "secret", "dump", "/backups/dump")
+			hook.Objects, hook.Bytes = 3, 120
+			hook.Done()
+			hook.Done()
+
+			So(bodies, ShouldHaveLength, 1)
+			var p webhookPayload
+			So(json.Unmarshal(bodies[0], &p), ShouldBeNil)
+			So(p.Command, ShouldEqual, "dump")
+			So(p.Path, ShouldEqual, "/backups/dump")
+			So(p.Status, ShouldEqual, "success")
+			So(p.Objects, ShouldEqual, 3)
+			So(p.Bytes, ShouldEqual, 120)
+			So(p.Error, ShouldEqual, "")
+
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write(bodies[0])
+			So(signatures[0], ShouldEqual, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		})
+		Convey("A failed restore should carry the error", func() {
+			defer func() { exitStatus, lastError = 0, "" }()
+			hook := startWebhook(ts.URL, "", "restore", "/backups/dump")
+			errorf("Error connecting to %s: %v", "localhost", "refused")
+			hook.Done()
+
+			So(bodies, ShouldHaveLength, 1)
+			var p webhookPayload
+			So(json.Unmarshal(bodies[0], &p), ShouldBeNil)
+			So(p.Status, ShouldEqual, "failure")
+			So(p.Error, ShouldEqual, "Error connecting to localhost: refused")
+			So(signatures[0], ShouldEqual, "")
+		})
+		Convey("No URL should mean no webhook", func() {
+			hook := startWebhook("", "", "dump", "/backups/dump")
+			So(hook, ShouldBeNil)
+			hook.Done()
+		})
+	})
+}